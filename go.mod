@@ -130,3 +130,5 @@ require (
 )
 
 replace github.com/golang/glog => github.com/kubermatic/glog-gokit v0.0.0-20181129151237-8ab7e4c2d352
+
+replace github.com/prometheus/tsdb => ./third_party/tsdb
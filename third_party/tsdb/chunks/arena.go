@@ -0,0 +1,98 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunks
+
+import (
+	"github.com/pkg/errors"
+	"github.com/prometheus/tsdb/chunkenc"
+)
+
+// ErrArenaFull is returned by Reader.ChunkArena if the arena cannot hold the
+// chunk. Use errors.Cause to match it.
+var ErrArenaFull = errors.New("arena full")
+
+// Arena hands out consecutive parts of a single buffer allocated up front,
+// so that many chunks can be decoded without further allocations. All parts
+// are released at once by Reset. An Arena must not be used concurrently.
+type Arena struct {
+	b []byte
+	n int
+}
+
+// NewArena returns an Arena of size bytes.
+func NewArena(size int) *Arena {
+	return &Arena{b: make([]byte, size)}
+}
+
+// alloc returns the next n bytes of the arena.
+func (a *Arena) alloc(n int) ([]byte, error) {
+	if n > len(a.b)-a.n {
+		return nil, errors.Wrapf(ErrArenaFull, "%d of %d bytes used, %d bytes requested", a.n, len(a.b), n)
+	}
+	b := a.b[a.n : a.n+n : a.n+n]
+	a.n += n
+	return b, nil
+}
+
+// Len returns the number of bytes handed out since the last reset.
+func (a *Arena) Len() int {
+	return a.n
+}
+
+// Reset makes the whole arena available again. All chunks decoded into the
+// arena before become invalid, as their bytes are overwritten by the chunks
+// decoded afterwards.
+func (a *Arena) Reset() {
+	a.n = 0
+}
+
+// ChunkArena returns the chunk ref like Chunk, but with its bytes copied into
+// the arena. The chunk is only valid until the arena is reset: neither it
+// nor iterators over it may be used once Reset was called. The decoded
+// cache is not used. Encrypted or transformed chunks are decoded into
+// separately allocated memory first, which is then copied into the arena.
+func (s *Reader) ChunkArena(ref uint64, arena *Arena) (chunkenc.Chunk, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	if s.closed {
+		return nil, errReaderClosed
+	}
+	seq, f, err := s.lookupFrame(ref)
+	if err != nil {
+		return nil, err
+	}
+	_, hasTransform := s.opts.DecodeTransforms[f.enc]
+
+	if !hasTransform && s.segs[seq].flags&(SegmentFlagEncrypted|SegmentFlagDictCompressed) == 0 {
+		b, err := arena.alloc(len(f.data))
+		if err != nil {
+			return nil, err
+		}
+		copy(b, f.data)
+		return s.getChunk(f.enc, b)
+	}
+	c, err := s.decodeFrame(seq, f)
+	if err != nil {
+		return nil, err
+	}
+	defer s.putChunk(c)
+
+	b, err := arena.alloc(len(c.Bytes()))
+	if err != nil {
+		return nil, err
+	}
+	copy(b, c.Bytes())
+	return s.getChunk(c.Encoding(), b)
+}
@@ -0,0 +1,121 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunks
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// V2 segments written with an intra-chunk checksum interval store a checksum
+// for every block of that many bytes of the data of each chunk. The block
+// checksums follow the data, the last block may be shorter, and are followed
+// by the regular checksum over the encoding and the whole data:
+//
+//   ┌────────────┬──────────┬─────────────┬─────────────┬─────┬────────────┐
+//   │ len <uvar> │ enc <1b> │ data <len>  │ block CRC32 │ ... │ CRC32 <4b> │
+//   └────────────┴──────────┴─────────────┴─────────────┴─────┴────────────┘
+//
+// The data length does not include the block checksums. In segments with
+// leading checksums, the regular checksum precedes the data instead. The log2 of the
+// interval is stored in 4 bits of the header flags. Zero means the segment
+// has no block checksums.
+const (
+	segmentCRCIntervalShift = 20
+	segmentCRCIntervalMask  = 0xf << segmentCRCIntervalShift
+
+	// MaxIntraChunkCRCInterval is the largest supported intra-chunk checksum
+	// interval.
+	MaxIntraChunkCRCInterval = 1 << 15
+)
+
+// segmentCRCInterval returns the intra-chunk checksum interval encoded in the
+// header flags of a segment. It is 0 for segments without block checksums.
+func segmentCRCInterval(flags uint32) int {
+	log2 := (flags & segmentCRCIntervalMask) >> segmentCRCIntervalShift
+	if log2 == 0 {
+		return 0
+	}
+	return 1 << log2
+}
+
+// crcIntervalFlags returns the header flags encoding the intra-chunk
+// checksum interval n, which must be a power of two.
+func crcIntervalFlags(n int) uint32 {
+	var log2 uint32
+	for ; 1<<log2 < n; log2++ {
+	}
+	return log2 << segmentCRCIntervalShift
+}
+
+// blockSumsSize returns the size of the block checksums of chunk data of
+// length l for the given interval.
+func blockSumsSize(l, interval int) int {
+	if interval == 0 {
+		return 0
+	}
+	return (l + interval - 1) / interval * crc32Size
+}
+
+// appendBlockSums appends the checksums of all blocks of data to b. It does
+// nothing for an interval of 0.
+func appendBlockSums(b, data []byte, interval int) []byte {
+	var buf [crc32Size]byte
+
+	if interval == 0 {
+		return b
+	}
+
+	for start := 0; start < len(data); start += interval {
+		end := start + interval
+		if end > len(data) {
+			end = len(data)
+		}
+		binary.BigEndian.PutUint32(buf[:], crc32Checksum(data[start:end]))
+		b = append(b, buf[:]...)
+	}
+	return b
+}
+
+// BlockChecksumErr describes the first block of the data of a chunk whose
+// intra-chunk checksum does not match. It is returned in place of the
+// checksum error of chunks in segments written with IntraChunkCRCInterval.
+type BlockChecksumErr struct {
+	// Start and End delimit the block within the chunk data.
+	Start, End int
+	// Err is the checksum error of the whole chunk.
+	Err error
+}
+
+func (e *BlockChecksumErr) Error() string {
+	return fmt.Sprintf("corrupted chunk data in bytes [%d, %d): %s", e.Start, e.End, e.Err)
+}
+
+// locateCorruption returns a BlockChecksumErr for the first block of f whose
+// checksum does not match. It returns err if f has no block checksums or all
+// of them match, i.e. the encoding or one of the checksums is corrupted.
+func locateCorruption(f chunkFrame, err error) error {
+	sums := f.sums
+	for start := 0; start < len(f.data) && len(sums) >= crc32Size; start += f.interval {
+		end := start + f.interval
+		if end > len(f.data) {
+			end = len(f.data)
+		}
+		if crc32Checksum(f.data[start:end]) != binary.BigEndian.Uint32(sums) {
+			return &BlockChecksumErr{Start: start, End: end, Err: err}
+		}
+		sums = sums[crc32Size:]
+	}
+	return err
+}
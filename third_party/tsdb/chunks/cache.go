@@ -0,0 +1,159 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunks
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/prometheus/tsdb/chunkenc"
+)
+
+// chunkCache is a size-bounded LRU cache of decoded chunks. Concurrent loads
+// of the same reference are deduplicated.
+type chunkCache struct {
+	mtx      sync.Mutex
+	maxBytes int64
+	size     int64
+	lru      *list.List // Most recently used entries first.
+	items    map[uint64]*list.Element
+	inflight map[uint64]*cacheLoad
+}
+
+type cacheEntry struct {
+	ref  uint64
+	c    chunkenc.Chunk
+	size int64
+}
+
+// cacheLoad is a load of a chunk in progress.
+type cacheLoad struct {
+	done chan struct{}
+	c    chunkenc.Chunk
+	err  error
+}
+
+func newChunkCache(maxBytes int64) *chunkCache {
+	return &chunkCache{
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		items:    map[uint64]*list.Element{},
+		inflight: map[uint64]*cacheLoad{},
+	}
+}
+
+// get returns the chunk for ref from the cache. If it is not cached, it is
+// loaded with load and added to the cache. If a load of ref is already in
+// progress, get waits for its result instead.
+func (c *chunkCache) get(ref uint64, load func(uint64) (chunkenc.Chunk, error)) (chunkenc.Chunk, error) {
+	c.mtx.Lock()
+	if e, ok := c.items[ref]; ok {
+		c.lru.MoveToFront(e)
+		c.mtx.Unlock()
+		return e.Value.(*cacheEntry).c, nil
+	}
+	if l, ok := c.inflight[ref]; ok {
+		c.mtx.Unlock()
+		<-l.done
+		return l.c, l.err
+	}
+	l := &cacheLoad{done: make(chan struct{})}
+	c.inflight[ref] = l
+	c.mtx.Unlock()
+
+	l.c, l.err = load(ref)
+
+	c.mtx.Lock()
+	delete(c.inflight, ref)
+	if l.err == nil {
+		c.add(ref, l.c)
+	}
+	c.mtx.Unlock()
+	close(l.done)
+
+	return l.c, l.err
+}
+
+// add inserts chunk chk as ref and evicts the least recently used entries
+// exceeding the size limit. Chunks larger than the limit are not cached.
+// The cache must be locked.
+func (c *chunkCache) add(ref uint64, chk chunkenc.Chunk) {
+	size := int64(len(chk.Bytes()))
+	if size > c.maxBytes {
+		return
+	}
+	c.items[ref] = c.lru.PushFront(&cacheEntry{ref: ref, c: chk, size: size})
+	c.size += size
+
+	for c.size > c.maxBytes {
+		e := c.lru.Back()
+		ce := e.Value.(*cacheEntry)
+		c.lru.Remove(e)
+		delete(c.items, ce.ref)
+		c.size -= ce.size
+	}
+}
+
+// bytes returns the size of all cached chunks.
+func (c *chunkCache) bytes() int64 {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	return c.size
+}
+
+// reset removes all cached chunks.
+func (c *chunkCache) reset() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.lru.Init()
+	c.items = map[uint64]*list.Element{}
+	c.size = 0
+}
+
+// PrefetchDecoded decodes the chunks for refs on a background goroutine and
+// adds them to the decoded chunk cache, so that later calls to Chunk do not
+// have to decode them. Refs are loaded like by Chunk, including overrides
+// of an overlay and the MmapWithFallback option. Refs that are cached or being loaded already are not
+// decoded again. Errors are not reported as they resurface when the chunk is
+// requested. Prefetching stops once the Reader is closed. It is a no-op if
+// the Reader has no cache.
+func (s *Reader) PrefetchDecoded(refs []uint64) {
+	if s.cache == nil {
+		return
+	}
+	refs = append([]uint64(nil), refs...)
+
+	go func() {
+		for _, ref := range refs {
+			if !s.prefetch(ref) {
+				return
+			}
+		}
+	}()
+}
+
+// prefetch adds the chunk for ref to the cache unless the Reader is closed,
+// in which case it returns false.
+func (s *Reader) prefetch(ref uint64) bool {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	if s.closed {
+		return false
+	}
+	s.chunk(ref)
+	return true
+}
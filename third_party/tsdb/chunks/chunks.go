@@ -0,0 +1,2476 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunks
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/tsdb/chunkenc"
+	"github.com/prometheus/tsdb/fileutil"
+)
+
+const (
+	// MagicChunks is 4 bytes at the head of a series file.
+	MagicChunks = 0x85BD40DD
+	// MagicChunksSize is the size in bytes of MagicChunks.
+	MagicChunksSize = 4
+
+	chunksFormatV1          = 1
+	ChunksFormatVersionSize = 1
+
+	segmentHeaderPaddingSize = 3
+	// SegmentHeaderSize defines the total size of the header part.
+	SegmentHeaderSize = MagicChunksSize + ChunksFormatVersionSize + segmentHeaderPaddingSize
+)
+
+// Chunk fields constants.
+const (
+	// MaxChunkLengthFieldSize defines the maximum size of the data length part.
+	MaxChunkLengthFieldSize = binary.MaxVarintLen32
+	// ChunkEncodingSize defines the size of the chunk encoding part.
+	ChunkEncodingSize = 1
+	// MaxChunkLength is the largest data length that fits into the length
+	// field of a chunk.
+	MaxChunkLength = math.MaxUint32
+	// crc32Size is the size of the checksum of a chunk.
+	crc32Size = 4
+)
+
+// Meta holds information about a chunk of data.
+type Meta struct {
+	// Ref and Chunk hold either a reference that can be used to retrieve
+	// chunk data or the data itself.
+	// Generally, only one of them is set.
+	Ref   uint64
+	Chunk chunkenc.Chunk
+
+	// Time range the data covers.
+	// When MaxTime == math.MaxInt64 the chunk is still open and being appended to.
+	MinTime, MaxTime int64
+}
+
+// writeHash writes the chunk encoding and the stored chunk data into the
+// provided hash. buf is used as scratch space to avoid allocations and must
+// not be empty.
+func writeHash(h hash.Hash, buf []byte, enc chunkenc.Encoding, data []byte) error {
+	buf[0] = byte(enc)
+	if _, err := h.Write(buf[:1]); err != nil {
+		return err
+	}
+	if _, err := h.Write(data); err != nil {
+		return err
+	}
+	return nil
+}
+
+// IsOpen returns true if the chunk is still open and being appended to.
+func (cm *Meta) IsOpen() bool {
+	return cm.MaxTime == math.MaxInt64
+}
+
+// Returns true if the chunk overlaps [mint, maxt].
+func (cm *Meta) OverlapsClosedInterval(mint, maxt int64) bool {
+	// An open chunk covers everything from its first sample onwards.
+	if cm.IsOpen() {
+		return cm.MinTime <= maxt
+	}
+	// The chunk itself is a closed interval [cm.MinTime, cm.MaxTime].
+	return cm.MinTime <= maxt && mint <= cm.MaxTime
+}
+
+// RefsOverlapping returns the references of all metas whose time range
+// overlaps the closed interval [mint, maxt] as determined by
+// OverlapsClosedInterval, in the order of metas. If sorted is set, metas
+// must be sorted by MinTime, which allows skipping all metas starting after
+// maxt with a binary search.
+func RefsOverlapping(metas []Meta, mint, maxt int64, sorted bool) []uint64 {
+	if sorted {
+		metas = metas[:sort.Search(len(metas), func(i int) bool {
+			return metas[i].MinTime > maxt
+		})]
+	}
+	var refs []uint64
+	for i := range metas {
+		if metas[i].OverlapsClosedInterval(mint, maxt) {
+			refs = append(refs, metas[i].Ref)
+		}
+	}
+	return refs
+}
+
+// ErrQuotaExceeded is returned by the Writer if writing a chunk would exceed
+// the configured MaxTotalBytes. Use errors.Cause to match it.
+var ErrQuotaExceeded = errors.New("chunk quota exceeded")
+
+// ErrInsufficientSpace is returned by the Writer if cutting a new segment
+// would leave less than the configured MinFreeBytes on disk. Use errors.Cause
+// to match it.
+var ErrInsufficientSpace = errors.New("insufficient disk space")
+
+var (
+	errInvalidSize     = fmt.Errorf("invalid size")
+	errInvalidFlag     = fmt.Errorf("invalid flag")
+	errInvalidChecksum = fmt.Errorf("invalid checksum")
+	errReaderClosed    = fmt.Errorf("reader closed")
+	errWriterAborted   = fmt.Errorf("writer aborted")
+)
+
+// CorruptionErr is an error that's returned when corruption is encountered.
+type CorruptionErr struct {
+	Segment int
+	Offset  int64
+	Err     error
+}
+
+func (e *CorruptionErr) Error() string {
+	return fmt.Sprintf("corruption in segment %d at %d: %s", e.Segment, e.Offset, e.Err)
+}
+
+var castagnoliTable *crc32.Table
+
+func init() {
+	castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+}
+
+// newCRC32 initializes a CRC32 hash with a preconfigured polynomial, so the
+// polynomial may be easily changed in one location at a later time, if necessary.
+func newCRC32() hash.Hash32 {
+	return crc32.New(castagnoliTable)
+}
+
+// Writer implements the ChunkWriter interface for the standard
+// serialization format.
+type Writer struct {
+	dirFile *os.File
+	files   []*os.File
+	wbuf    *bufio.Writer
+	n       int64
+	crc32   hash.Hash
+	buf     [binary.MaxVarintLen32]byte
+	sum     [crc32Size]byte
+	flen    [frameLengthSize]byte
+
+	segmentSize int64
+	opts        WriterOptions
+	version     byte
+	flags       uint32
+	footer      footerBuilder
+	sealBuf     []byte
+	sumsBuf     []byte
+
+	// Compressor against the dictionary of the tail segment if
+	// DictCompression is set and the dictionary is complete.
+	compressor  *flate.Writer
+	compressBuf bytes.Buffer
+
+	// Size the tail file was pre-allocated to.
+	preallocated int64
+
+	// Total number of bytes written to all segments.
+	written int64
+
+	// Sample counts of all written chunks if WriteSampleCountIndex is set.
+	sampleCounts []sampleCount
+
+	// Number of segments the directory held when the Writer was opened if
+	// their sidecars are extended, see loadSidecars.
+	baseSegments int
+
+	// MinTime of the last written chunk if EnforceTimeOrder is set.
+	lastMinTime    int64
+	hasLastMinTime bool
+
+	// Time range of the chunks in the tail segment and the names of all
+	// finalized segments if NameByTimeRange is set.
+	tailMinTime, tailMaxTime int64
+	segmentNames             []string
+
+	// Checksum of the tail segment and the manifest entries of all finalized
+	// segments if WriteManifest is set.
+	segmentCRC hash.Hash32
+	manifest   []manifestSegment
+
+	// Time range of all written chunks, not counting the MaxTime of open
+	// chunks.
+	minTime, maxTime int64
+	hasOpenChunk     bool
+
+	// Placeholders reserved in the tail segment by reference.
+	placeholders map[uint64]placeholder
+
+	// Size of every finalized segment relative to the segment size.
+	utilization []float64
+
+	// Set once Abort was called.
+	aborted bool
+}
+
+const (
+	defaultChunkSegmentSize = 512 * 1024 * 1024
+
+	// minRecommendedSegmentSize is the smallest size RecommendSegmentSize
+	// returns, so that tiny blocks do not end up with tiny segments.
+	minRecommendedSegmentSize = 1024 * 1024
+	// maxSegmentSize is the largest segment size for which every offset
+	// still fits into the 32 bits references hold for it.
+	maxSegmentSize = math.MaxUint32
+)
+
+// OversizedChunkPolicy determines how a Writer handles chunks that do not
+// fit into a segment of the configured size on their own, or exceed
+// MaxChunkBytes with OversizedChunkSplit.
+type OversizedChunkPolicy int
+
+const (
+	// OversizedChunkAllow writes oversized chunks into a segment of their own.
+	OversizedChunkAllow OversizedChunkPolicy = iota
+	// OversizedChunkError rejects batches holding an oversized chunk.
+	OversizedChunkError
+	// OversizedChunkWarn writes oversized chunks like OversizedChunkAllow
+	// and logs a warning.
+	OversizedChunkWarn
+	// OversizedChunkSplit makes WriteChunkSplit split chunks whose data
+	// exceeds MaxChunkBytes into several chunks, see SplitChunk. Other write
+	// methods reject such chunks. Chunks not exceeding MaxChunkBytes whose
+	// frame exceeds SegmentSize are handled like OversizedChunkAllow.
+	OversizedChunkSplit
+)
+
+// CRCPlacement determines where the checksum of a chunk is stored within its
+// frame. The checksum covers the encoding and the data in either case.
+type CRCPlacement int
+
+const (
+	// CRCTrailing stores the checksum after the chunk data.
+	CRCTrailing CRCPlacement = iota
+	// CRCLeading stores the checksum between the encoding and the chunk
+	// data, so that it is available before the data when streaming a chunk.
+	// If the segment is aligned, the padding precedes the checksum.
+	CRCLeading
+)
+
+// WriterOptions of the Writer.
+type WriterOptions struct {
+	// SegmentSize is the size after which a new segment file is cut.
+	SegmentSize int64
+	// FormatVersion of the written segments. It defaults to 1. Version 2
+	// segments end with a footer indexing the offset, length, encoding and
+	// declared time range of every chunk, which allows locating chunks
+	// without scanning the segment. Readers older than version 2 cannot read
+	// such segments.
+	FormatVersion int
+	// EnforceTimeOrder rejects chunks whose MinTime is before the MinTime of
+	// the previously written chunk. It must not be set for writers that
+	// interleave chunks of different series.
+	EnforceTimeOrder bool
+	// Cipher encrypts the data of every chunk if set. Each chunk is sealed
+	// with its own random nonce, which is stored in front of the ciphertext.
+	// Lengths and encodings stay unencrypted for navigation, and checksums
+	// cover the ciphertext so that verification does not require the key.
+	// Requires FormatVersion 2.
+	Cipher cipher.AEAD
+	// Alignment pads chunk frames so that the data of every chunk starts at a
+	// multiple of Alignment bytes within its segment. It must be a power of
+	// two no larger than MaxAlignment. Values of 0 and 1 disable padding.
+	// Requires FormatVersion 2.
+	Alignment int
+	// FixedFrameLength prefixes every chunk frame with its length as a fixed
+	// size field, so that tools can skip chunks without parsing varints.
+	// Requires FormatVersion 2.
+	FixedFrameLength bool
+	// IntraChunkCRCInterval stores an additional checksum for every block of
+	// that many bytes of the data of each chunk. If the checksum of a chunk
+	// does not match, the Reader reports the first corrupted block as a
+	// BlockChecksumErr, which helps to analyze corruptions of large chunks.
+	// It must be a power of two no larger than MaxIntraChunkCRCInterval and
+	// costs 4 bytes per block. Zero disables block checksums. Requires
+	// FormatVersion 2.
+	IntraChunkCRCInterval int
+	// CRCPlacement determines where the checksum of every chunk is stored.
+	// CRCLeading requires FormatVersion 2.
+	CRCPlacement CRCPlacement
+	// DictCompression compresses the data of chunks with DEFLATE against a
+	// dictionary built from the first 32KiB of chunk data of every segment,
+	// which is stored in the segment footer. This pays off for many small
+	// chunks of similar series, which compress poorly on their own. Chunks
+	// are only stored compressed if this makes them smaller. Compressed
+	// chunks of a segment cannot be read before the segment is finalized
+	// and cannot be streamed with ChunkDataReader. It cannot be combined
+	// with Cipher. Requires FormatVersion 2.
+	DictCompression bool
+	// Provenance is recorded in a sidecar file when the Writer is closed if set.
+	Provenance *Provenance
+	// RetryPolicy is applied to writes, syncs and segment creation if set.
+	RetryPolicy *RetryPolicy
+	// Flock takes an exclusive advisory lock on every segment file while it
+	// is written, so that Readers using Flock detect concurrent modification.
+	// Cutting a segment fails with fileutil.ErrLockUnsupported on platforms
+	// without file locks, i.e. Plan 9. See fileutil.LockFile for the
+	// semantics of the locks on other platforms.
+	Flock bool
+	// OversizedChunkPolicy is applied to chunks whose frame alone exceeds
+	// SegmentSize.
+	OversizedChunkPolicy OversizedChunkPolicy
+	// MaxChunkBytes is the largest chunk data size written with
+	// OversizedChunkSplit. It must be at least MinSplitChunkBytes.
+	MaxChunkBytes int64
+	// Logger is used to log warnings. Defaults to a no-op logger.
+	Logger log.Logger
+	// MaxTotalBytes limits the number of bytes written to all segments, so
+	// that a runaway writer cannot fill a disk. A batch of chunks that could
+	// exceed the limit is rejected as a whole with ErrQuotaExceeded before
+	// any of its chunks is written, with every chunk accounted for with its
+	// maximum frame size. Data written before remains consistent. For V2
+	// segments the space needed for the footer entries of all chunks is
+	// accounted for. Zero means no limit.
+	MaxTotalBytes int64
+	// WriteSampleCountIndex records the number of samples of every written
+	// chunk in a sidecar file when the Writer is closed. It can be read with
+	// LoadSampleCounts. If the directory already holds segments, the Writer
+	// extends their sample count index, which has to exist. The chunks of
+	// the Writer are recorded with the references a Reader of the whole
+	// directory uses, i.e. with their segment index increased by the number
+	// of existing segments.
+	WriteSampleCountIndex bool
+	// VerifyRawCRC recomputes the checksums passed to WriteRawChunkWithCRC
+	// and rejects chunks whose checksum does not match.
+	VerifyRawCRC bool
+	// NameByTimeRange renames every finalized segment to its sequence number
+	// and the time range of the chunks it holds, formatted as
+	// "<seq>-<mint>-<maxt>". As references hold the index of a segment, the
+	// order of the segments is recorded in a sidecar file, which Readers use
+	// to map indices to files.
+	NameByTimeRange bool
+	// BindTimeRanges records a checksum over the checksum and the time range
+	// of every chunk in the segment footer. VerifyFrom then also detects
+	// chunks whose recorded time range does not match their data, e.g. if
+	// the data of another chunk was written for a Meta. It requires format
+	// version 2.
+	BindTimeRanges bool
+	// WriteManifest records the size and a checksum over the whole file of
+	// every segment in a manifest sidecar when the Writer is closed. It
+	// allows checking the integrity of a directory in a single pass with
+	// VerifyManifest. If the directory already holds segments, the Writer
+	// extends their manifest, which has to list all of them.
+	WriteManifest bool
+	// DisablePreallocation lets segments grow as they are written. By
+	// default the full SegmentSize is allocated on disk when a segment is
+	// cut and the unused rest is truncated when it is finalized, which
+	// avoids fragmentation and running out of space in the middle of a
+	// segment. Disabling it helps on filesystems where allocation is slow or
+	// defeats copy-on-write, at the cost of more fragmentation and a segment
+	// only failing once the disk is full.
+	DisablePreallocation bool
+	// Deterministic makes the written files a pure function of the written
+	// chunks and their order, so that writing the same input twice yields
+	// byte-identical files. The provenance sidecar, which records the time
+	// of writing, is not written. Encryption is rejected as it uses random
+	// nonces.
+	Deterministic bool
+	// MinFreeBytes is the disk space that has to remain available after a
+	// new segment was allocated. Cutting a segment that would leave less
+	// space fails with ErrInsufficientSpace before the segment is created,
+	// so that segments are not left incomplete by a full disk. The check is
+	// skipped on platforms where the free space cannot be determined. Zero
+	// disables the check.
+	MinFreeBytes int64
+	// MaxFooterBytes limits the size of the footer of every segment, which
+	// bounds the time and memory needed to open a segment holding many small
+	// chunks. A segment is cut once either the next batch of chunks does not
+	// fit into SegmentSize or its footer entries, accounted for with their
+	// maximum size, do not fit into MaxFooterBytes, whichever comes first.
+	// Batches are not split, so a batch whose footer entries alone exceed
+	// the limit gets a segment of its own. Zero means no limit. It requires
+	// format version 2.
+	MaxFooterBytes int64
+	// Naming determines the file names of new segments. It defaults to
+	// NumericNaming. Readers of the directory must use the same strategy.
+	// It cannot be combined with NameByTimeRange.
+	Naming NamingStrategy
+
+	// segmentRing is a test-only option. If set, only the given number of
+	// segment files is created and pre-allocated. Once exhausted, cutting a
+	// new segment renames the oldest file of the ring to the next sequence
+	// name and truncates it, discarding the segment it held.
+	segmentRing int
+}
+
+// DefaultWriterOptions used for the Writer.
+var DefaultWriterOptions = &WriterOptions{
+	SegmentSize: defaultChunkSegmentSize,
+}
+
+// RecommendSegmentSize returns a SegmentSize for which totalBytes of chunk
+// data are split into about targetSegments segments. It is clamped between
+// 1 MiB and the largest size references can address. As chunks do not fill
+// segments exactly, one more segment may be needed. The default segment size
+// is returned if either argument is not positive.
+func RecommendSegmentSize(totalBytes int64, targetSegments int) int64 {
+	if totalBytes <= 0 || targetSegments <= 0 {
+		return defaultChunkSegmentSize
+	}
+	n := int64(targetSegments)
+	size := (totalBytes+n-1)/n + SegmentHeaderSize
+
+	if size < minRecommendedSegmentSize {
+		return minRecommendedSegmentSize
+	}
+	if size > maxSegmentSize {
+		return maxSegmentSize
+	}
+	return size
+}
+
+// NewWriter returns a new writer against the given directory.
+func NewWriter(dir string) (*Writer, error) {
+	return NewWriterWithOptions(dir, DefaultWriterOptions)
+}
+
+// NewWriterWithOptions returns a new writer against the given directory
+// using the given options.
+func NewWriterWithOptions(dir string, opts *WriterOptions) (*Writer, error) {
+	if opts == nil {
+		opts = DefaultWriterOptions
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+	dirFile, err := fileutil.OpenDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	segmentSize := opts.SegmentSize
+	if segmentSize <= 0 {
+		segmentSize = defaultChunkSegmentSize
+	}
+	var version byte
+	switch opts.FormatVersion {
+	case 0, chunksFormatV1:
+		version = chunksFormatV1
+	case chunksFormatV2:
+		version = chunksFormatV2
+	default:
+		dirFile.Close()
+		return nil, errors.Errorf("unknown format version %d", opts.FormatVersion)
+	}
+	var flags uint32
+	if opts.Cipher != nil {
+		flags |= SegmentFlagEncrypted
+	}
+	if a := opts.Alignment; a > 1 {
+		if a > MaxAlignment || a&(a-1) != 0 {
+			dirFile.Close()
+			return nil, errors.Errorf("invalid alignment %d", a)
+		}
+		flags |= alignmentFlags(a)
+	}
+	if opts.FixedFrameLength {
+		flags |= SegmentFlagFixedFrameLength
+	}
+	if opts.DictCompression {
+		if opts.Cipher != nil {
+			dirFile.Close()
+			return nil, errors.New("dictionary compression cannot be combined with encryption")
+		}
+		flags |= SegmentFlagDictCompressed
+	}
+	if n := opts.IntraChunkCRCInterval; n != 0 {
+		if n < 2 || n > MaxIntraChunkCRCInterval || n&(n-1) != 0 {
+			dirFile.Close()
+			return nil, errors.Errorf("invalid intra-chunk checksum interval %d", n)
+		}
+		flags |= crcIntervalFlags(n)
+	}
+	switch opts.CRCPlacement {
+	case CRCTrailing:
+	case CRCLeading:
+		flags |= SegmentFlagLeadingCRC
+	default:
+		dirFile.Close()
+		return nil, errors.Errorf("unknown checksum placement %d", opts.CRCPlacement)
+	}
+	if (flags != 0 || opts.BindTimeRanges || opts.MaxFooterBytes > 0) && version != chunksFormatV2 {
+		dirFile.Close()
+		return nil, errors.Errorf("options require format version %d", chunksFormatV2)
+	}
+	if opts.OversizedChunkPolicy == OversizedChunkSplit && opts.MaxChunkBytes < MinSplitChunkBytes {
+		dirFile.Close()
+		return nil, errors.Errorf("MaxChunkBytes %d is below minimum of %d bytes", opts.MaxChunkBytes, MinSplitChunkBytes)
+	}
+	if opts.NameByTimeRange && opts.Naming != nil && opts.Naming != NumericNaming {
+		dirFile.Close()
+		return nil, errors.New("NameByTimeRange cannot be combined with a custom naming strategy")
+	}
+	if opts.Deterministic && opts.Cipher != nil {
+		dirFile.Close()
+		return nil, errors.New("encrypted output cannot be deterministic")
+	}
+	cw := &Writer{
+		dirFile:     dirFile,
+		n:           0,
+		crc32:       newCRC32(),
+		segmentSize: segmentSize,
+		opts:        *opts,
+		version:     version,
+		flags:       flags,
+		minTime:     math.MaxInt64,
+		maxTime:     math.MinInt64,
+	}
+	cw.footer.hasDict = opts.DictCompression
+	if cw.opts.Deterministic {
+		cw.opts.Provenance = nil
+	}
+	if cw.opts.Logger == nil {
+		cw.opts.Logger = log.NewNopLogger()
+	}
+	if cw.opts.Naming == nil {
+		cw.opts.Naming = NumericNaming
+	}
+	if err := cw.loadSidecars(); err != nil {
+		dirFile.Close()
+		return nil, err
+	}
+	return cw, nil
+}
+
+func (w *Writer) tail() *os.File {
+	if len(w.files) == 0 {
+		return nil
+	}
+	return w.files[len(w.files)-1]
+}
+
+// finalizeTail writes all pending data to the current tail file,
+// truncates its size, and closes it.
+func (w *Writer) finalizeTail() error {
+	tf := w.tail()
+	if tf == nil {
+		return nil
+	}
+
+	if w.version == chunksFormatV2 {
+		if err := w.write(w.footer.encode()); err != nil {
+			return err
+		}
+	}
+	if err := w.wbuf.Flush(); err != nil {
+		return err
+	}
+	if err := w.retry(func() error { return fileutil.Fsync(tf) }); err != nil {
+		return err
+	}
+	// If the file was pre-allocated, we truncate any superfluous zero bytes.
+	if w.preallocated > 0 {
+		off, err := tf.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		if err := w.retry(func() error { return tf.Truncate(off) }); err != nil {
+			return err
+		}
+		w.preallocated = 0
+	}
+
+	if err := tf.Close(); err != nil {
+		return err
+	}
+	// Placeholders of finalized segments cannot be filled anymore.
+	w.placeholders = nil
+	w.utilization = append(w.utilization, float64(w.n)/float64(w.segmentSize))
+
+	name := filepath.Base(tf.Name())
+	if w.opts.NameByTimeRange {
+		if err := w.renameTail(tf.Name()); err != nil {
+			return err
+		}
+		name = w.segmentNames[len(w.segmentNames)-1]
+	}
+	if w.opts.WriteManifest {
+		w.manifest = append(w.manifest, manifestSegment{
+			Index: len(w.manifest),
+			File:  name,
+			Size:  w.n,
+			CRC32: w.segmentCRC.Sum32(),
+		})
+	}
+	return nil
+}
+
+func (w *Writer) cut() error {
+	if err := w.checkFreeSpace(); err != nil {
+		return err
+	}
+	// Sync current tail to disk and close.
+	if err := w.finalizeTail(); err != nil {
+		return err
+	}
+
+	p, _, err := nextSequenceFile(w.dirFile.Name(), w.opts.Naming)
+	if err != nil {
+		return err
+	}
+	f, err := w.openSegmentFile(p)
+	if err != nil {
+		return err
+	}
+	if err := w.lockSegment(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err = w.retry(w.dirFile.Sync); err != nil {
+		return err
+	}
+
+	// Write header metadata for new file.
+
+	metab := make([]byte, SegmentHeaderSize)
+	binary.BigEndian.PutUint32(metab[:MagicChunksSize], MagicChunks)
+	metab[MagicChunksSize] = w.version
+	putSegmentFlags(metab[MagicChunksSize+ChunksFormatVersionSize:], w.flags)
+
+	sw := w.segmentWriter(f)
+
+	if _, err := sw.Write(metab); err != nil {
+		return err
+	}
+	w.written += SegmentHeaderSize
+
+	if w.opts.WriteManifest {
+		if w.segmentCRC == nil {
+			w.segmentCRC = newCRC32()
+		}
+		w.segmentCRC.Reset()
+		w.segmentCRC.Write(metab)
+	}
+
+	w.files = append(w.files, f)
+	if w.wbuf != nil {
+		w.wbuf.Reset(sw)
+	} else {
+		w.wbuf = bufio.NewWriterSize(sw, 8*1024*1024)
+	}
+	w.n = SegmentHeaderSize
+	w.footer.reset()
+	w.compressor = nil
+	w.tailMinTime, w.tailMaxTime = math.MaxInt64, math.MinInt64
+
+	return nil
+}
+
+// checkFreeSpace returns ErrInsufficientSpace if cutting a new segment would
+// leave less than MinFreeBytes available on disk.
+func (w *Writer) checkFreeSpace() error {
+	min := w.opts.MinFreeBytes
+	if min <= 0 {
+		return nil
+	}
+	free, ok, err := freeSpace(w.dirFile)
+	if err != nil {
+		return errors.Wrap(err, "determine free space")
+	}
+	if !ok {
+		return nil
+	}
+	// Truncating the tail releases the rest of its pre-allocated space.
+	if w.preallocated > w.n {
+		free += w.preallocated - w.n
+	}
+	need := min
+	if !w.opts.DisablePreallocation {
+		need += w.segmentSize
+	}
+	if free < need {
+		return errors.Wrapf(ErrInsufficientSpace, "%d bytes available, %d bytes required", free, need)
+	}
+	return nil
+}
+
+// openSegmentFile creates and pre-allocates the segment file at path p
+// unless DisablePreallocation is set.
+func (w *Writer) openSegmentFile(p string) (*os.File, error) {
+	if n := w.opts.segmentRing; n > 0 && len(w.files) >= n {
+		if err := os.Rename(w.files[len(w.files)-n].Name(), p); err != nil {
+			return nil, err
+		}
+		w.preallocated = 0
+		return os.OpenFile(p, os.O_WRONLY|os.O_TRUNC, 0666)
+	}
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	if w.opts.DisablePreallocation {
+		w.preallocated = 0
+		return f, nil
+	}
+	err = w.retry(func() error {
+		return fileutil.Preallocate(f, w.segmentSize, true)
+	})
+	if err != nil {
+		return nil, err
+	}
+	w.preallocated = w.segmentSize
+	return f, nil
+}
+
+// lockSegment locks the segment file f if enabled.
+func (w *Writer) lockSegment(f *os.File) error {
+	if !w.opts.Flock {
+		return nil
+	}
+	if err := fileutil.LockFile(f, true); err != nil {
+		return errors.Wrapf(err, "lock segment file %s", f.Name())
+	}
+	return nil
+}
+
+// lockSegmentFile opens the segment file fn and takes a shared lock on it.
+// The lock is held until the returned file is closed.
+func lockSegmentFile(fn string) (*os.File, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	if err := fileutil.LockFile(f, false); err != nil {
+		f.Close()
+		return nil, errors.Wrapf(err, "lock segment file %s", fn)
+	}
+	return f, nil
+}
+
+// WastedSpace returns the number of pre-allocated bytes of the current tail
+// segment that are not used yet. They are released when the tail is
+// finalized. It returns 0 if there is no open tail segment.
+func (w *Writer) WastedSpace() int64 {
+	if w.n >= w.preallocated {
+		return 0
+	}
+	return w.preallocated - w.n
+}
+
+// SegmentUtilization returns the size of every finalized segment, including
+// its header and footer, relative to the configured segment size. Segments
+// holding an oversized chunk exceed 1. Low values suggest that the segment
+// size is larger than needed or that segments are cut early, e.g. by
+// MaxFooterBytes.
+func (w *Writer) SegmentUtilization() []float64 {
+	return append([]float64(nil), w.utilization...)
+}
+
+// AverageUtilization returns the mean of SegmentUtilization. It returns 0 if
+// no segment was finalized yet.
+func (w *Writer) AverageUtilization() float64 {
+	if len(w.utilization) == 0 {
+		return 0
+	}
+	var sum float64
+	for _, u := range w.utilization {
+		sum += u
+	}
+	return sum / float64(len(w.utilization))
+}
+
+func (w *Writer) write(b []byte) error {
+	n, err := w.wbuf.Write(b)
+	w.n += int64(n)
+	w.written += int64(n)
+	if w.segmentCRC != nil {
+		w.segmentCRC.Write(b[:n])
+	}
+	return err
+}
+
+func (w *Writer) WriteChunks(chks ...Meta) error {
+	return w.writeChunks(chks, nil)
+}
+
+// WriteChunkSplit writes m like WriteChunks. If OversizedChunkPolicy is
+// OversizedChunkSplit and the data of m exceeds MaxChunkBytes, m is split
+// into several chunks with SplitChunk first. It returns the written chunks in
+// sample order with their references and time ranges set, so that the index
+// can refer to all of them in place of m. If m is open, the last of them is.
+func (w *Writer) WriteChunkSplit(m Meta) ([]Meta, error) {
+	chks := []Meta{m}
+
+	if w.opts.OversizedChunkPolicy == OversizedChunkSplit && int64(len(m.Chunk.Bytes())) > w.opts.MaxChunkBytes {
+		split, err := SplitChunk(m.Chunk, int(w.opts.MaxChunkBytes))
+		if err != nil {
+			return nil, errors.Wrap(err, "split chunk")
+		}
+		if m.IsOpen() && len(split) > 0 {
+			split[len(split)-1].MaxTime = m.MaxTime
+		}
+		chks = split
+	}
+	if err := w.writeChunks(chks, nil); err != nil {
+		return nil, err
+	}
+	return chks, nil
+}
+
+// WriteSamples appends the samples of it to XOR chunks of at most
+// maxSamples samples each and writes them. A chunk is written as soon as it
+// is full, so the samples do not have to fit into memory at once. It returns
+// the written chunks in sample order with their references and time ranges
+// set. Chunks are written with WriteChunkSplit, so one of them may become
+// several. On error, the chunks written before it are returned.
+func (w *Writer) WriteSamples(it chunkenc.Iterator, maxSamples int) ([]Meta, error) {
+	if maxSamples <= 0 || maxSamples > math.MaxUint16 {
+		return nil, errors.Errorf("invalid maximum of %d samples per chunk", maxSamples)
+	}
+	var (
+		res []Meta
+		cur Meta
+		app chunkenc.Appender
+		err error
+	)
+	flush := func() error {
+		if cur.Chunk == nil {
+			return nil
+		}
+		chks, err := w.WriteChunkSplit(cur)
+		res = append(res, chks...)
+		cur = Meta{}
+		return err
+	}
+	for it.Next() {
+		t, v := it.At()
+		if cur.Chunk != nil && cur.Chunk.NumSamples() >= maxSamples {
+			if err := flush(); err != nil {
+				return res, err
+			}
+		}
+		if cur.Chunk == nil {
+			c := chunkenc.NewXORChunk()
+			if app, err = c.Appender(); err != nil {
+				return res, err
+			}
+			cur = Meta{Chunk: c, MinTime: t}
+		}
+		app.Append(t, v)
+		cur.MaxTime = t
+	}
+	if err := it.Err(); err != nil {
+		return res, errors.Wrap(err, "iterate samples")
+	}
+	if err := flush(); err != nil {
+		return res, err
+	}
+	return res, nil
+}
+
+// writeChunks writes chks and records the encoded tags for each of them in
+// the segment footer.
+func (w *Writer) writeChunks(chks []Meta, tags []byte) error {
+	if w.aborted {
+		return errWriterAborted
+	}
+	// Calculate maximum space we need and cut a new segment in case
+	// we don't fit into the current one.
+	maxLen := int64(MaxChunkLengthFieldSize) // The number of chunks.
+	lastMinTime, hasLastMinTime := w.lastMinTime, w.hasLastMinTime
+
+	for i, c := range chks {
+		l := int64(len(c.Chunk.Bytes()))
+		if w.opts.OversizedChunkPolicy == OversizedChunkSplit && l > w.opts.MaxChunkBytes {
+			return errors.Errorf("chunk %d: data length %d exceeds MaxChunkBytes %d", i, l, w.opts.MaxChunkBytes)
+		}
+		if w.opts.Cipher != nil {
+			l += int64(w.opts.Cipher.NonceSize() + w.opts.Cipher.Overhead())
+		}
+		// Reject the whole batch before writing anything, so the segment
+		// never holds a chunk with a truncated length field.
+		frameLen, err := w.frameSize(i, l)
+		if err != nil {
+			return err
+		}
+		if w.opts.EnforceTimeOrder {
+			if hasLastMinTime && c.MinTime < lastMinTime {
+				return errors.Errorf("chunk %d: MinTime %d is before MinTime %d of the previous chunk", i, c.MinTime, lastMinTime)
+			}
+			lastMinTime, hasLastMinTime = c.MinTime, true
+		}
+		maxLen += frameLen + int64(len(tags))
+	}
+	footerLen := int64(len(chks)) * (maxFooterEntrySize + int64(len(tags)))
+
+	if err := w.reserve(maxLen, footerLen); err != nil {
+		return err
+	}
+
+	seq := uint64(w.seq()) << 32
+
+	for i := range chks {
+		chk := &chks[i]
+
+		chk.Ref = seq | uint64(w.n)
+
+		enc, data, err := w.chunkData(chk.Chunk.Encoding(), chk.Chunk.Bytes())
+		if err != nil {
+			return errors.Wrapf(err, "chunk %d", i)
+		}
+		w.crc32.Reset()
+		if err := writeHash(w.crc32, w.buf[:], enc, data); err != nil {
+			return err
+		}
+		if err := w.writeFrame(enc, data, w.crc32.Sum(w.sum[:0]), chk.MinTime, chk.MaxTime, tags); err != nil {
+			return err
+		}
+		w.trackTimeRange(chk.MinTime, chk.MaxTime)
+		w.addSampleCount(chk.Ref, chk.Chunk)
+	}
+	w.lastMinTime, w.hasLastMinTime = lastMinTime, hasLastMinTime
+
+	return nil
+}
+
+// WriteRawChunkWithCRC writes a single chunk with the given encoding, data
+// and checksum over both and returns its reference. The checksum is written
+// verbatim, which avoids recomputing it for chunks that were verified before,
+// e.g. when copying chunks between blocks. If VerifyRawCRC is set, the
+// checksum is recomputed and a mismatch is returned as an error.
+//
+// It cannot be used by encrypting Writers as the checksum covers the
+// encrypted data.
+func (w *Writer) WriteRawChunkWithCRC(enc chunkenc.Encoding, data []byte, crc uint32, mint, maxt int64) (uint64, error) {
+	if w.aborted {
+		return 0, errWriterAborted
+	}
+	if w.opts.Cipher != nil {
+		return 0, errors.New("raw chunks cannot be written with encryption enabled")
+	}
+	if w.opts.DictCompression && enc&encDictCompressed != 0 {
+		return 0, errors.Errorf("encoding %d cannot be stored with dictionary compression", enc)
+	}
+	if w.opts.VerifyRawCRC {
+		w.crc32.Reset()
+		if err := writeHash(w.crc32, w.buf[:], enc, data); err != nil {
+			return 0, err
+		}
+		if exp := binary.BigEndian.Uint32(w.crc32.Sum(w.sum[:0])); exp != crc {
+			return 0, errors.Wrapf(errInvalidChecksum, "given: %x, expected: %x", crc, exp)
+		}
+	}
+	var c chunkenc.Chunk
+	if w.opts.WriteSampleCountIndex {
+		var err error
+		if c, err = chunkenc.FromData(enc, data); err != nil {
+			return 0, errors.Wrap(err, "decode chunk for sample count")
+		}
+	}
+	frameLen, err := w.frameSize(0, int64(len(data)))
+	if err != nil {
+		return 0, err
+	}
+	if w.opts.EnforceTimeOrder && w.hasLastMinTime && mint < w.lastMinTime {
+		return 0, errors.Errorf("MinTime %d is before MinTime %d of the previous chunk", mint, w.lastMinTime)
+	}
+	if err := w.reserve(MaxChunkLengthFieldSize+frameLen, maxFooterEntrySize); err != nil {
+		return 0, err
+	}
+	ref := uint64(w.seq())<<32 | uint64(w.n)
+
+	binary.BigEndian.PutUint32(w.sum[:], crc)
+	if err := w.writeFrame(enc, data, w.sum[:], mint, maxt, nil); err != nil {
+		return 0, err
+	}
+	w.trackTimeRange(mint, maxt)
+	if c != nil {
+		w.addSampleCount(ref, c)
+	}
+	if w.opts.EnforceTimeOrder {
+		w.lastMinTime, w.hasLastMinTime = mint, true
+	}
+	return ref, nil
+}
+
+// frameSize returns the maximum number of bytes chunk i with a stored data
+// length of l occupies in a segment, including its footer entry.
+func (w *Writer) frameSize(i int, l int64) (int64, error) {
+	if l > MaxChunkLength {
+		return 0, errors.Errorf("chunk %d: data length %d exceeds maximum chunk length %d", i, l, int64(MaxChunkLength))
+	}
+	// The number of bytes in the chunk frame, i.e. length, encoding, data and checksums.
+	frameLen := MaxChunkLengthFieldSize + ChunkEncodingSize + l + w.blockSumsSize(l) + crc32Size
+	if w.opts.FixedFrameLength {
+		frameLen += frameLengthSize
+	}
+	if w.opts.Alignment > 1 {
+		frameLen += int64(w.opts.Alignment - 1)
+	}
+	if frameLen > w.segmentSize {
+		if err := w.checkOversized(i, l); err != nil {
+			return 0, err
+		}
+	}
+	if w.version == chunksFormatV2 {
+		frameLen += maxFooterEntrySize
+	}
+	return frameLen, nil
+}
+
+// reserve cuts a new segment if the current one cannot hold another maxLen
+// bytes, or if its footer cannot grow by another footerLen bytes within
+// MaxFooterBytes. maxLen already includes footerLen. It returns
+// ErrQuotaExceeded without cutting if writing maxLen bytes, and the header
+// and previous footer written by a cut, could exceed MaxTotalBytes.
+func (w *Writer) reserve(maxLen, footerLen int64) error {
+	newsz := w.n + maxLen
+	if w.version == chunksFormatV2 {
+		newsz += w.footer.size()
+	}
+	cut := w.wbuf == nil || w.n > w.segmentSize || newsz > w.segmentSize && maxLen <= w.segmentSize
+
+	if max := w.opts.MaxFooterBytes; max > 0 && w.footer.n > 0 && w.footer.size()+footerLen > max {
+		cut = true
+	}
+	need := maxLen
+	if cut {
+		// Cutting writes the header of the new segment and the footer of
+		// the previous one, which count towards the quota.
+		need += SegmentHeaderSize
+		if w.version == chunksFormatV2 && w.tail() != nil {
+			need += w.footer.size()
+		}
+	}
+	if max := w.opts.MaxTotalBytes; max > 0 && w.written+need > max {
+		return errors.Wrapf(ErrQuotaExceeded, "writing up to %d bytes after %d of %d bytes", need, w.written, max)
+	}
+	if cut {
+		return w.cut()
+	}
+	return nil
+}
+
+// writeFrame writes a chunk frame with the given stored data and checksum
+// at the current position of the tail segment. Encoded tags are recorded in
+// the footer entry of V2 segments.
+func (w *Writer) writeFrame(enc chunkenc.Encoding, data, sum []byte, mint, maxt int64, tags []byte) error {
+	b := w.buf[:]
+	n := binary.PutUvarint(b, uint64(len(data)))
+
+	var pad int
+	if w.opts.Alignment > 1 {
+		dataStart := int(w.n) + n + ChunkEncodingSize
+		if w.opts.FixedFrameLength {
+			dataStart += frameLengthSize
+		}
+		if w.opts.CRCPlacement == CRCLeading {
+			dataStart += crc32Size
+		}
+		pad = alignPadding(dataStart, w.opts.Alignment)
+	}
+	if w.opts.IntraChunkCRCInterval > 0 {
+		w.sumsBuf = appendBlockSums(w.sumsBuf[:0], data, w.opts.IntraChunkCRCInterval)
+	}
+	sums := w.sumsBuf[:w.blockSumsSize(int64(len(data)))]
+	frameLen := n + ChunkEncodingSize + pad + len(data) + len(sums) + crc32Size
+
+	if w.version == chunksFormatV2 {
+		e := footerEntry{
+			off:    int(w.n),
+			length: len(data),
+			enc:    enc,
+			mint:   mint,
+			maxt:   maxt,
+		}
+		if w.opts.BindTimeRanges {
+			e.flags |= footerFlagTimeRangeSum
+			e.sum = timeRangeSum(sum, mint, maxt)
+		}
+		if len(tags) > 0 {
+			e.flags |= footerFlagTags
+			e.tags = tags
+		}
+		w.footer.add(e)
+	}
+	if w.opts.FixedFrameLength {
+		binary.BigEndian.PutUint32(w.flen[:], uint32(frameLen))
+		if err := w.write(w.flen[:]); err != nil {
+			return err
+		}
+	}
+	if err := w.write(b[:n]); err != nil {
+		return err
+	}
+	b[0] = byte(enc)
+	if err := w.write(b[:1]); err != nil {
+		return err
+	}
+	if err := w.write(zeroPadding[:pad]); err != nil {
+		return err
+	}
+	leading := w.opts.CRCPlacement == CRCLeading
+	if leading {
+		if err := w.write(sum); err != nil {
+			return err
+		}
+	}
+	if err := w.write(data); err != nil {
+		return err
+	}
+	if err := w.write(sums); err != nil {
+		return err
+	}
+	if leading {
+		return nil
+	}
+	return w.write(sum)
+}
+
+// blockSumsSize returns the size of the block checksums of chunk data of
+// length l.
+func (w *Writer) blockSumsSize(l int64) int64 {
+	if w.opts.IntraChunkCRCInterval == 0 {
+		return 0
+	}
+	n := int64(w.opts.IntraChunkCRCInterval)
+	return (l + n - 1) / n * crc32Size
+}
+
+// trackTimeRange accounts for a chunk covering [mint, maxt] written to the
+// tail segment in the time bounds of the Writer and the tail segment.
+func (w *Writer) trackTimeRange(mint, maxt int64) {
+	if mint < w.minTime {
+		w.minTime = mint
+	}
+	if maxt == math.MaxInt64 {
+		w.hasOpenChunk = true
+	} else if maxt > w.maxTime {
+		w.maxTime = maxt
+	}
+	if w.opts.NameByTimeRange {
+		if mint < w.tailMinTime {
+			w.tailMinTime = mint
+		}
+		if maxt > w.tailMaxTime {
+			w.tailMaxTime = maxt
+		}
+	}
+}
+
+// checkOversized applies the OversizedChunkPolicy to chunk i with a stored
+// data length of l if its frame does not fit into a segment.
+func (w *Writer) checkOversized(i int, l int64) error {
+	size := int64(binary.PutUvarint(w.buf[:], uint64(l))) + ChunkEncodingSize + l + w.blockSumsSize(l) + crc32Size
+	if size <= w.segmentSize {
+		return nil
+	}
+	switch w.opts.OversizedChunkPolicy {
+	case OversizedChunkError:
+		return errors.Errorf("chunk %d: frame size %d exceeds segment size %d", i, size, w.segmentSize)
+	case OversizedChunkWarn:
+		level.Warn(w.opts.Logger).Log("msg", "chunk exceeds segment size", "size", size, "segment_size", w.segmentSize)
+	}
+	return nil
+}
+
+// chunkData returns the encoding and bytes stored for a chunk with the given
+// encoding and data. It only allocates if the data has to be transformed.
+func (w *Writer) chunkData(enc chunkenc.Encoding, data []byte) (chunkenc.Encoding, []byte, error) {
+	if w.opts.DictCompression {
+		return w.compressChunk(enc, data)
+	}
+	if w.opts.Cipher == nil {
+		return enc, data, nil
+	}
+	ns := w.opts.Cipher.NonceSize()
+
+	w.sealBuf = append(w.sealBuf[:0], make([]byte, ns)...)
+	if _, err := io.ReadFull(rand.Reader, w.sealBuf[:ns]); err != nil {
+		return 0, nil, errors.Wrap(err, "generate nonce")
+	}
+	// The encoding is authenticated along with the data.
+	w.sealBuf = w.opts.Cipher.Seal(w.sealBuf, w.sealBuf[:ns], data, []byte{byte(enc)})
+	return enc, w.sealBuf, nil
+}
+
+func (w *Writer) seq() int {
+	return len(w.files) - 1
+}
+
+func (w *Writer) Close() error {
+	if w.aborted {
+		return errWriterAborted
+	}
+	if err := w.finalizeTail(); err != nil {
+		return err
+	}
+	if w.opts.Provenance != nil {
+		if err := w.writeProvenance(); err != nil {
+			return errors.Wrap(err, "write provenance")
+		}
+	}
+	if w.opts.WriteSampleCountIndex {
+		if err := w.writeSampleCounts(); err != nil {
+			return errors.Wrap(err, "write sample count index")
+		}
+	}
+	if w.opts.WriteManifest {
+		if err := w.writeManifest(); err != nil {
+			return errors.Wrap(err, "write manifest")
+		}
+	}
+
+	// close dir file (if not windows platform will fail on rename)
+	return w.dirFile.Close()
+}
+
+// TimeBounds returns the lowest MinTime and the highest MaxTime of all chunks
+// written so far, which are the bounds of the block once the Writer is
+// closed. The MaxTime of open chunks is not taken into account, see
+// HasOpenChunk. If no chunk was written, mint is greater than maxt.
+func (w *Writer) TimeBounds() (mint, maxt int64) {
+	return w.minTime, w.maxTime
+}
+
+// HasOpenChunk reports whether an open chunk, i.e. one with a MaxTime of
+// math.MaxInt64, was written.
+func (w *Writer) HasOpenChunk() bool {
+	return w.hasOpenChunk
+}
+
+// Abort discards everything written by the Writer. Pending data is not
+// flushed, the tail segment is closed and all segment and sidecar files
+// created by the Writer are removed. Sidecars extended by the Writer are
+// restored to describe the existing segments. It may also be called after
+// Close to discard the written output. All errors encountered are combined
+// into the returned error. The Writer cannot be used after Abort.
+func (w *Writer) Abort() error {
+	if w.aborted {
+		return errWriterAborted
+	}
+	w.aborted = true
+
+	var errs []string
+	addErr := func(err error) {
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if tf := w.tail(); tf != nil {
+		// The tail is already closed if it was finalized.
+		if err := tf.Close(); err != nil && !isClosedErr(err) {
+			addErr(err)
+		}
+	}
+	w.wbuf = nil
+
+	dir := w.dirFile.Name()
+	for i, f := range w.files {
+		fn := f.Name()
+		if i < len(w.segmentNames) {
+			fn = filepath.Join(dir, w.segmentNames[i])
+		}
+		if err := os.Remove(fn); err != nil && !os.IsNotExist(err) {
+			addErr(err)
+		}
+	}
+	var sidecars []string
+	if len(w.segmentNames) > 0 {
+		sidecars = append(sidecars, segmentNamesFilename)
+	}
+	if w.opts.Provenance != nil {
+		sidecars = append(sidecars, provenanceFilename)
+	}
+	// Extended sidecars are restored to describe the existing segments only.
+	if w.baseSegments > 0 {
+		addErr(truncateSidecars(dir, w.baseSegments))
+	} else {
+		if w.opts.WriteSampleCountIndex {
+			sidecars = append(sidecars, sampleCountsFilename)
+		}
+		if w.opts.WriteManifest {
+			sidecars = append(sidecars, manifestFilename)
+		}
+	}
+	for _, n := range sidecars {
+		if err := os.Remove(filepath.Join(dir, n)); err != nil && !os.IsNotExist(err) {
+			addErr(err)
+		}
+	}
+	w.files = nil
+
+	// The directory is already closed if Abort is called after Close.
+	if err := w.dirFile.Close(); err != nil && !isClosedErr(err) {
+		addErr(err)
+	}
+
+	if len(errs) > 0 {
+		return errors.Errorf("abort writer: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// isClosedErr reports whether err was returned for closing a closed file.
+func isClosedErr(err error) bool {
+	if pe, ok := err.(*os.PathError); ok {
+		err = pe.Err
+	}
+	return err == os.ErrClosed
+}
+
+// ByteSlice abstracts a byte slice.
+type ByteSlice interface {
+	Len() int
+	Range(start, end int) []byte
+}
+
+type realByteSlice []byte
+
+func (b realByteSlice) Len() int {
+	return len(b)
+}
+
+func (b realByteSlice) Range(start, end int) []byte {
+	return b[start:end]
+}
+
+func (b realByteSlice) Sub(start, end int) ByteSlice {
+	return b[start:end]
+}
+
+// Reader implements a SeriesReader for a serialized byte stream
+// of series data.
+type Reader struct {
+	// Guards the segments against concurrent refreshes.
+	mtx sync.RWMutex
+
+	// The underlying bytes holding the encoded series data.
+	bs []ByteSlice
+
+	// Closers for resources behind the byte slices.
+	cs []io.Closer
+	// Directory and files backing the byte slices, if read from a directory.
+	dir   string
+	files []string
+	// Set if the byte slices were allocated by the Reader.
+	ownsBuffers bool
+
+	// Parsed headers and footers of the segments.
+	segs []segmentMeta
+
+	size int64 // The total size of bytes in the reader.
+	pool chunkenc.Pool
+	opts ReaderOptions
+
+	// Decoded chunks if enabled by the options.
+	cache *chunkCache
+	// Set once the Reader is closed, as prefetches may still be running.
+	closed bool
+	// Index of the segment the Writer was appending to if created by
+	// Writer.Snapshot, -1 otherwise.
+	openSeq int
+	// References redirected to patch segments if created by
+	// NewOverlayReader.
+	override map[uint64]uint64
+	// Segment indices built to check references if StrictOffsets is set.
+	strictMtx sync.Mutex
+	strict    map[int]strictIndex
+}
+
+// segmentMeta holds the parsed header and footer of a segment.
+type segmentMeta struct {
+	version byte
+	flags   uint32
+	// Alignment of chunk data within the segment.
+	align int
+	// Intra-chunk checksum interval, or 0 if chunks have no block checksums.
+	crcInterval int
+	// End of the chunk frames, i.e. the start of the footer if there is one.
+	dataEnd int
+	footer  []footerEntry
+	// hasFooter is set if the segment has a footer, even an empty one.
+	hasFooter bool
+	// Offsets of the chunks marked as deleted in the footer.
+	tombstones map[int]struct{}
+	// Compression dictionary stored in the footer, if any.
+	dict []byte
+	// err is set if the segment is unavailable.
+	err error
+}
+
+// parseSegmentMeta parses the header and, for V2 segments, the footer of
+// segment b. The magic number must have been verified.
+func parseSegmentMeta(b ByteSlice) (segmentMeta, error) {
+	m := segmentMeta{dataEnd: b.Len()}
+	if b.Len() < SegmentHeaderSize {
+		return m, nil
+	}
+	h := b.Range(0, SegmentHeaderSize)
+	m.version = h[MagicChunksSize]
+
+	if m.version != chunksFormatV2 {
+		return m, nil
+	}
+	f := h[MagicChunksSize+ChunksFormatVersionSize:]
+	m.flags = uint32(f[0])<<16 | uint32(f[1])<<8 | uint32(f[2])
+	m.align = SegmentAlignment(m.flags)
+	m.crcInterval = segmentCRCInterval(m.flags)
+
+	footer, dict, start, ok, err := readFooter(b, m.flags)
+	if err != nil {
+		return m, errors.Wrap(err, "read footer")
+	}
+	if ok {
+		m.footer, m.dict, m.dataEnd, m.hasFooter = footer, dict, start, true
+	}
+	for _, e := range m.footer {
+		if e.flags&footerFlagTombstone == 0 {
+			continue
+		}
+		if m.tombstones == nil {
+			m.tombstones = map[int]struct{}{}
+		}
+		m.tombstones[e.off] = struct{}{}
+	}
+	return m, nil
+}
+
+// tombstoned reports whether the chunk at offset off is marked as deleted.
+func (m *segmentMeta) tombstoned(off int) bool {
+	_, ok := m.tombstones[off]
+	return ok
+}
+
+// ReaderOptions of the Reader.
+type ReaderOptions struct {
+	// CopyData copies chunk data out of the underlying byte slices before
+	// passing it to the pool. Returned chunks then own their bytes and remain
+	// valid after the Reader is closed.
+	CopyData bool
+	// Alloc returns the buffer of length n that chunk data is copied into if
+	// CopyData is set. It defaults to allocating a new byte slice.
+	Alloc func(n int) []byte
+	// Cipher decrypts the chunk data of encrypted segments. It must match the
+	// cipher the segments were written with.
+	Cipher cipher.AEAD
+	// Flock takes a shared advisory lock on every segment file while the
+	// Reader is open. Opening fails if a segment is locked by a Writer, and
+	// with fileutil.ErrLockUnsupported on platforms without file locks.
+	Flock bool
+	// DecodeTransforms maps custom chunk encodings to a transform that turns
+	// the stored data of such chunks into XOR chunk data, e.g. to decompress
+	// it. The checksum of transformed chunks is verified before the transform
+	// is applied. The transformed data is owned by the returned chunk.
+	DecodeTransforms map[chunkenc.Encoding]func([]byte) ([]byte, error)
+	// Progress is called periodically while scanning segments, e.g. in Stats
+	// or VerifyFrom, with the number of bytes processed out of the total size
+	// of all segments. It is called at the end of every segment and once per
+	// 64MiB scanned within a segment. It is called while the Reader is locked
+	// and must not call methods of the Reader.
+	Progress func(segmentIndex int, bytesProcessed, totalBytes int64)
+	// DecodedCacheSize is the maximum size in bytes of the cache of decoded
+	// chunks. Chunks are cached by Chunk and PrefetchDecoded. The cache is
+	// disabled if it is zero. Chunks returned while the cache is enabled are
+	// shared and must not be returned to the pool.
+	DecodedCacheSize int64
+	// DecodeLimiter throttles the decoding of chunks by operations scanning
+	// or iterating over many chunks, e.g. Stats, IterateOverlapping or
+	// LatestChunks, so that they do not starve other work. One token is taken
+	// per decoded chunk, or one token per byte of chunk data if
+	// DecodeLimitBytes is set. Chunk and ChunkIterator are not throttled.
+	DecodeLimiter DecodeLimiter
+	// DecodeLimitBytes makes DecodeLimiter limit bytes instead of chunks.
+	// The burst of the limiter must then be at least the largest chunk size.
+	DecodeLimitBytes bool
+	// Readahead makes operations scanning segments sequentially, e.g.
+	// IterateOverlapping or VerifyFrom, hint the kernel to read the chunks
+	// following the current one in the background while it is processed,
+	// so that their page faults do not add to the latency of the scan. It
+	// only helps for memory-mapped segments that are not in the page cache
+	// yet. The kernel already reads ahead on sequential page faults, which
+	// hides most of the latency where it is enabled, so the gain is largest
+	// where it is small or disabled: scanning 150MB of cold segments took
+	// 0.2s instead of 1.1s with kernel readahead disabled, but about 0.1s in
+	// both cases with the default settings. It is ignored on platforms other
+	// than Linux.
+	Readahead bool
+	// MmapWithFallback makes Chunk recover from faults accessing the memory
+	// mapping of a segment opened from a directory, e.g. a SIGBUS after the
+	// file was truncated or its storage became unavailable. The failed read
+	// is retried and the segment is read with ReadAt from then on, see
+	// SegmentReadViaFile. It implies CopyData, as chunks aliasing the
+	// mapping could fault after Chunk returned.
+	//
+	// Faults are recovered with runtime/debug.SetPanicOnFault, which only
+	// covers the goroutine calling Chunk and requires the Go runtime to
+	// handle the fault signal, i.e. it does not apply if a signal handler
+	// installed by non-Go code takes SIGBUS or SIGSEGV first. Other methods
+	// of the Reader are not protected until a fault switched the segment.
+	MmapWithFallback bool
+	// DecodeMetaFallback makes AllMeta decode the chunks of segments without
+	// a footer to determine their time ranges instead of failing.
+	DecodeMetaFallback bool
+	// StrictOffsets makes Chunk return ErrUnalignedRef for references whose
+	// offset is not the start of a chunk, e.g. references corrupted to point
+	// into the data of a chunk, instead of decoding whatever bytes are found
+	// there. The chunks of a segment are indexed with BuildSegmentIndex when
+	// it is first accessed, which scans the whole segment once and keeps an
+	// entry per chunk in memory.
+	StrictOffsets bool
+	// Naming determines which files of a directory are segments and their
+	// order for NewDirReaderWithOptions and Refresh. It defaults to
+	// NumericNaming.
+	Naming NamingStrategy
+}
+
+// DecodeLimiter limits the rate of chunk decoding. It is implemented by
+// *rate.Limiter of golang.org/x/time/rate.
+type DecodeLimiter interface {
+	// WaitN blocks until n tokens are available.
+	WaitN(ctx context.Context, n int) error
+}
+
+// DefaultReaderOptions used for the Reader.
+var DefaultReaderOptions = &ReaderOptions{}
+
+// newReader returns a Reader against the segments bs. Segments listed in
+// unavailable are not accessed and are reported as failed on access instead.
+func newReader(bs []ByteSlice, cs []io.Closer, unavailable map[int]error, pool chunkenc.Pool, opts *ReaderOptions) (*Reader, error) {
+	if opts == nil {
+		opts = DefaultReaderOptions
+	}
+	cr := Reader{pool: pool, bs: bs, cs: cs, opts: *opts, openSeq: -1}
+	if cr.opts.MmapWithFallback {
+		cr.opts.CopyData = true
+	}
+	if cr.opts.Naming == nil {
+		cr.opts.Naming = NumericNaming
+	}
+	if cr.opts.Alloc == nil {
+		cr.opts.Alloc = func(n int) []byte { return make([]byte, n) }
+	}
+	if cr.opts.DecodedCacheSize > 0 {
+		cr.cache = newChunkCache(cr.opts.DecodedCacheSize)
+	}
+
+	for i, b := range cr.bs {
+		if err, ok := unavailable[i]; ok {
+			cr.segs = append(cr.segs, segmentMeta{err: err})
+			continue
+		}
+		m, err := openSegment(b)
+		if err != nil {
+			return nil, errors.Wrapf(err, "segment %d", i)
+		}
+		cr.segs = append(cr.segs, m)
+		cr.size += int64(b.Len())
+	}
+	return &cr, nil
+}
+
+// openSegment validates the magic number of segment b and parses its meta data.
+func openSegment(b ByteSlice) (segmentMeta, error) {
+	if b.Len() < MagicChunksSize {
+		return segmentMeta{}, errors.Wrap(errInvalidSize, "validate magic")
+	}
+	// Verify magic number.
+	if m := binary.BigEndian.Uint32(b.Range(0, MagicChunksSize)); m != MagicChunks {
+		return segmentMeta{}, errors.Errorf("invalid magic number %x", m)
+	}
+	return parseSegmentMeta(b)
+}
+
+// NewReader returns a new chunk reader against the given byte slices.
+func NewReader(bs []ByteSlice, pool chunkenc.Pool) (*Reader, error) {
+	return NewReaderWithOptions(bs, pool, DefaultReaderOptions)
+}
+
+// NewReaderWithOptions returns a new chunk reader against the given byte
+// slices using the given options.
+func NewReaderWithOptions(bs []ByteSlice, pool chunkenc.Pool, opts *ReaderOptions) (*Reader, error) {
+	if pool == nil {
+		pool = chunkenc.NewPool()
+	}
+	return newReader(bs, nil, nil, pool, opts)
+}
+
+// NewDirReader returns a new Reader against sequentially numbered files in the
+// given directory.
+func NewDirReader(dir string, pool chunkenc.Pool) (*Reader, error) {
+	return NewDirReaderWithOptions(dir, pool, DefaultReaderOptions)
+}
+
+// NewDirReaderWithOptions returns a new Reader against the sequence files in
+// the given directory using the given options. Sequence files are matched by
+// the Naming option.
+func NewDirReaderWithOptions(dir string, pool chunkenc.Pool, opts *ReaderOptions) (*Reader, error) {
+	files, err := sequenceFilesNamed(dir, readerNaming(opts))
+	if err != nil {
+		return nil, err
+	}
+	r, err := newFilesReader(files, pool, opts)
+	if err != nil {
+		return nil, err
+	}
+	r.dir = dir
+	return r, nil
+}
+
+// NewMultiDirReader returns a Reader against the sequence files of all given
+// directories as if they formed a single directory, e.g. a block whose
+// chunks were left split across directories by a failed merge. Segment
+// indices are assigned to the files of each directory in sequence order,
+// continuing with the next directory where the previous one ends. References
+// are thus stable as long as the directories, their order and the files in
+// them do not change. The Reader cannot be refreshed.
+func NewMultiDirReader(dirs []string, pool chunkenc.Pool) (*Reader, error) {
+	return NewMultiDirReaderWithOptions(dirs, pool, DefaultReaderOptions)
+}
+
+// NewMultiDirReaderWithOptions is like NewMultiDirReader but uses the given
+// options. The segments of all directories are matched by the Naming option.
+func NewMultiDirReaderWithOptions(dirs []string, pool chunkenc.Pool, opts *ReaderOptions) (*Reader, error) {
+	var files []string
+
+	for _, dir := range dirs {
+		fs, err := sequenceFilesNamed(dir, readerNaming(opts))
+		if err != nil {
+			return nil, errors.Wrapf(err, "list directory %s", dir)
+		}
+		files = append(files, fs...)
+	}
+	return newFilesReader(files, pool, opts)
+}
+
+// readerNaming returns the naming strategy set in opts or NumericNaming.
+func readerNaming(opts *ReaderOptions) NamingStrategy {
+	if opts != nil && opts.Naming != nil {
+		return opts.Naming
+	}
+	return NumericNaming
+}
+
+// newFilesReader returns a Reader against the memory-mapped files.
+func newFilesReader(files []string, pool chunkenc.Pool, opts *ReaderOptions) (*Reader, error) {
+	if pool == nil {
+		pool = chunkenc.NewPool()
+	}
+
+	var bs []ByteSlice
+	var cs []io.Closer
+
+	for _, fn := range files {
+		if opts != nil && opts.Flock {
+			lf, err := lockSegmentFile(fn)
+			if err != nil {
+				closeAll(cs...)
+				return nil, err
+			}
+			cs = append(cs, lf)
+		}
+		f, err := fileutil.OpenMmapFile(fn)
+		if err != nil {
+			closeAll(cs...)
+			return nil, errors.Wrapf(err, "mmap files")
+		}
+		cs = append(cs, f)
+		if opts != nil && opts.MmapWithFallback {
+			bs = append(bs, &fallbackByteSlice{b: f.Bytes(), f: f.File()})
+			continue
+		}
+		bs = append(bs, realByteSlice(f.Bytes()))
+	}
+	r, err := newReader(bs, cs, nil, pool, opts)
+	if err != nil {
+		closeAll(cs...)
+		return nil, err
+	}
+	r.files = files
+	return r, nil
+}
+
+// SegmentError describes a segment that could not be opened.
+type SegmentError struct {
+	Segment int
+	File    string
+	Err     error
+}
+
+func (e SegmentError) Error() string {
+	return fmt.Sprintf("segment %d (%s): %s", e.Segment, e.File, e.Err)
+}
+
+// NewDirReaderBestEffort is like NewDirReader but tolerates segments that
+// cannot be opened or have an invalid header. Such segments are returned as
+// SegmentErrors and keep their position, so references into all other
+// segments remain valid. Accessing chunks of a failed segment returns its
+// SegmentError.
+func NewDirReaderBestEffort(dir string, pool chunkenc.Pool) (*Reader, []SegmentError, error) {
+	return NewDirReaderBestEffortWithOptions(dir, pool, DefaultReaderOptions)
+}
+
+// NewDirReaderBestEffortWithOptions is like NewDirReaderBestEffort but uses
+// the given options. Segments that cannot be locked with Flock set are
+// reported as SegmentErrors as well.
+func NewDirReaderBestEffortWithOptions(dir string, pool chunkenc.Pool, opts *ReaderOptions) (*Reader, []SegmentError, error) {
+	files, err := sequenceFilesNamed(dir, readerNaming(opts))
+	if err != nil {
+		return nil, nil, err
+	}
+	if pool == nil {
+		pool = chunkenc.NewPool()
+	}
+
+	var (
+		bs          []ByteSlice
+		cs          []io.Closer
+		serrs       []SegmentError
+		unavailable = map[int]error{}
+	)
+	for i, fn := range files {
+		var (
+			lf  *os.File
+			f   *fileutil.MmapFile
+			err error
+		)
+		if opts != nil && opts.Flock {
+			lf, err = lockSegmentFile(fn)
+		}
+		if err == nil {
+			f, err = fileutil.OpenMmapFile(fn)
+			if err == nil {
+				if _, err = openSegment(realByteSlice(f.Bytes())); err != nil {
+					f.Close()
+				}
+			}
+			if err != nil && lf != nil {
+				lf.Close()
+			}
+		}
+		if err != nil {
+			serr := SegmentError{Segment: i, File: fn, Err: err}
+			serrs = append(serrs, serr)
+			unavailable[i] = serr
+			bs = append(bs, realByteSlice(nil))
+			continue
+		}
+		if lf != nil {
+			cs = append(cs, lf)
+		}
+		cs = append(cs, f)
+		if opts != nil && opts.MmapWithFallback {
+			bs = append(bs, &fallbackByteSlice{b: f.Bytes(), f: f.File()})
+			continue
+		}
+		bs = append(bs, realByteSlice(f.Bytes()))
+	}
+	r, err := newReader(bs, cs, unavailable, pool, opts)
+	if err != nil {
+		closeAll(cs...)
+		return nil, nil, err
+	}
+	r.dir, r.files = dir, files
+	return r, serrs, nil
+}
+
+func (s *Reader) Close() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.closed = true
+	if s.cache != nil {
+		s.cache.reset()
+	}
+	return closeAll(s.cs...)
+}
+
+// Size returns the size of the chunks.
+func (s *Reader) Size() int64 {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	return s.size
+}
+
+// SegmentFlags returns the format version and the header flags of segment
+// index. V1 segments have no flags. The flags can be tested against the
+// SegmentFlag constants and decoded with SegmentAlignment.
+func (s *Reader) SegmentFlags(index int) (version int, flags uint32, err error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	if index < 0 || index >= len(s.bs) {
+		return 0, 0, errors.Errorf("segment %d out of range", index)
+	}
+	m := s.segs[index]
+	if m.err != nil {
+		return 0, 0, m.err
+	}
+	return int(m.version), m.flags, nil
+}
+
+// SingleSegment returns the bytes of the only segment of the Reader, e.g. to
+// scan a small block without resolving references. It returns ok=false if
+// the Reader has no or more than one segment or the segment failed to open.
+// The bytes include the segment header and must not be used after the Reader
+// is closed.
+func (s *Reader) SingleSegment() (ByteSlice, bool) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	if len(s.bs) != 1 || s.segs[0].err != nil {
+		return nil, false
+	}
+	return s.bs[0], true
+}
+
+// Refresh opens all sequence files that were added to the Reader's directory
+// since it was created or last refreshed and returns the number of added
+// segments. New segments get the next segment indices, so existing
+// references stay valid. Segments that were already opened are not re-read,
+// i.e. data appended to them later is not picked up.
+func (s *Reader) Refresh() (added int, err error) {
+	if s.dir == "" {
+		return 0, errors.New("reader is not backed by a directory")
+	}
+	files, err := sequenceFilesNamed(s.dir, s.opts.Naming)
+	if err != nil {
+		return 0, err
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if len(files) < len(s.files) {
+		return 0, errors.Errorf("%d sequence files found but %d are open", len(files), len(s.files))
+	}
+	for i, fn := range s.files {
+		if files[i] != fn {
+			return 0, errors.Errorf("sequence file %s of segment %d was replaced by %s", fn, i, files[i])
+		}
+	}
+	var (
+		bs   []ByteSlice
+		cs   []io.Closer
+		segs []segmentMeta
+		size int64
+	)
+	for _, fn := range files[len(s.files):] {
+		if s.opts.Flock {
+			lf, err := lockSegmentFile(fn)
+			if err != nil {
+				closeAll(cs...)
+				return 0, err
+			}
+			cs = append(cs, lf)
+		}
+		f, err := fileutil.OpenMmapFile(fn)
+		if err != nil {
+			closeAll(cs...)
+			return 0, errors.Wrapf(err, "mmap files")
+		}
+		cs = append(cs, f)
+		b := realByteSlice(f.Bytes())
+
+		m, err := openSegment(b)
+		if err != nil {
+			closeAll(cs...)
+			return 0, errors.Wrapf(err, "segment %d", len(s.bs)+len(bs))
+		}
+		bs = append(bs, b)
+		segs = append(segs, m)
+		size += int64(b.Len())
+	}
+	s.bs = append(s.bs, bs...)
+	s.cs = append(s.cs, cs...)
+	s.segs = append(s.segs, segs...)
+	s.files = files
+	s.size += size
+
+	return len(bs), nil
+}
+
+// packRef returns the reference of the chunk at offset off of segment seq.
+func packRef(seq, off int) uint64 {
+	return uint64(seq)<<32 | uint64(off)
+}
+
+// unpackRef returns the segment and offset a chunk reference points to.
+func unpackRef(ref uint64) (seq, off int) {
+	return int(ref >> 32), int((ref << 32) >> 32)
+}
+
+func (s *Reader) Chunk(ref uint64) (chunkenc.Chunk, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	if s.closed {
+		return nil, errReaderClosed
+	}
+	return s.chunk(ref)
+}
+
+// chunk returns the chunk for ref like Chunk. The caller must hold the read
+// lock.
+func (s *Reader) chunk(ref uint64) (chunkenc.Chunk, error) {
+	if o, ok := s.override[ref]; ok {
+		ref = o
+	}
+	load := s.loadChunk
+	if s.opts.MmapWithFallback {
+		load = s.loadChunkWithFallback
+	}
+	if s.cache != nil {
+		return s.cache.get(ref, load)
+	}
+	return load(ref)
+}
+
+// ChunkSamples decodes the chunk ref and appends its timestamps and values
+// to ts and vs, which are returned grown like by append. Passing the slices
+// of a previous call truncated to zero length reuses their backing arrays.
+// On error the slices hold the samples decoded before it.
+func (s *Reader) ChunkSamples(ref uint64, ts []int64, vs []float64) (outTs []int64, outVs []float64, err error) {
+	c, err := s.Chunk(ref)
+	if err != nil {
+		return ts, vs, err
+	}
+	it := c.Iterator()
+	for it.Next() {
+		t, v := it.At()
+		ts = append(ts, t)
+		vs = append(vs, v)
+	}
+	if err := it.Err(); err != nil {
+		return ts, vs, errors.Wrapf(err, "iterate chunk %d", ref)
+	}
+	// Cached chunks are shared and must not be returned to the pool.
+	if s.cache == nil {
+		s.putChunk(c)
+	}
+	return ts, vs, nil
+}
+
+// loadChunk reads and decodes the chunk for ref. The caller must hold the
+// read lock.
+func (s *Reader) loadChunk(ref uint64) (chunkenc.Chunk, error) {
+	seq, f, err := s.lookupFrame(ref)
+	if err != nil {
+		return nil, err
+	}
+	return s.decodeFrame(seq, f)
+}
+
+// lookupFrame returns the segment and frame of the chunk ref. The caller
+// must hold the read lock.
+func (s *Reader) lookupFrame(ref uint64) (int, chunkFrame, error) {
+	seq, off := unpackRef(ref)
+	if seq >= len(s.bs) {
+		return 0, chunkFrame{}, errors.Errorf("reference sequence %d out of range", seq)
+	}
+	if err := s.segs[seq].err; err != nil {
+		return 0, chunkFrame{}, err
+	}
+	if s.segs[seq].tombstoned(off) {
+		return 0, chunkFrame{}, errors.Wrapf(ErrTombstoned, "chunk %d", ref)
+	}
+	if s.opts.StrictOffsets {
+		if err := s.checkAligned(seq, off); err != nil {
+			return 0, chunkFrame{}, err
+		}
+	}
+	b := s.bs[seq]
+
+	// Frames are parsed with bounds checks against the segment, so that
+	// corrupted or malicious bytes cause errors rather than panics.
+	if off < SegmentHeaderSize || off >= b.Len() {
+		return 0, chunkFrame{}, &CorruptionErr{Segment: seq, Offset: int64(off), Err: errors.Errorf("offset %d outside of data of size %d", off, b.Len())}
+	}
+	f, ok, err := s.readFrame(seq, off)
+	if err != nil {
+		return 0, chunkFrame{}, &CorruptionErr{Segment: seq, Offset: int64(off), Err: err}
+	}
+	if !ok {
+		return 0, chunkFrame{}, &CorruptionErr{Segment: seq, Offset: int64(off), Err: errors.New("no chunk at offset")}
+	}
+	return seq, f, nil
+}
+
+// decodeFrame returns the chunk held by frame f of segment seq.
+func (s *Reader) decodeFrame(seq int, f chunkFrame) (chunkenc.Chunk, error) {
+	enc, data, compressed, err := s.decompressChunk(seq, f.enc, f.data)
+	if err != nil {
+		return nil, errors.Wrapf(err, "chunk %d", f.ref)
+	}
+	transform, hasTransform := s.opts.DecodeTransforms[enc]
+	if hasTransform {
+		if err := verifyFrame(newCRC32(), make([]byte, crc32Size), f); err != nil {
+			return nil, errors.Wrapf(err, "chunk %d", f.ref)
+		}
+	}
+
+	if s.segs[seq].flags&SegmentFlagEncrypted != 0 {
+		if s.opts.Cipher == nil {
+			return nil, errors.Errorf("segment %d is encrypted but no cipher is configured", seq)
+		}
+		ns := s.opts.Cipher.NonceSize()
+		if len(data) < ns {
+			return nil, errors.Wrapf(errInvalidSize, "encrypted chunk of length %d", len(data))
+		}
+		buf := s.opts.Alloc(len(data) - ns)
+		d, err := s.opts.Cipher.Open(buf[:0], data[:ns], data[ns:], []byte{byte(f.enc)})
+		if err != nil {
+			return nil, errors.Wrapf(err, "decrypt chunk %d", f.ref)
+		}
+		data = d
+	} else if s.opts.CopyData && !hasTransform && !compressed {
+		buf := s.opts.Alloc(len(data))
+		copy(buf, data)
+		data = buf
+	}
+	if hasTransform {
+		d, err := transform(data)
+		if err != nil {
+			return nil, errors.Wrapf(err, "transform chunk %d", f.ref)
+		}
+		return s.getChunk(chunkenc.EncXOR, d)
+	}
+	return s.getChunk(enc, data)
+}
+
+// scanDecode returns the chunk held by frame f of segment seq while
+// respecting the DecodeLimiter. It is used by bulk operations.
+func (s *Reader) scanDecode(seq int, f chunkFrame) (chunkenc.Chunk, error) {
+	if err := s.waitDecode(len(f.data)); err != nil {
+		return nil, err
+	}
+	return s.decodeFrame(seq, f)
+}
+
+// waitDecode waits for the DecodeLimiter to allow decoding a chunk with l
+// bytes of data.
+func (s *Reader) waitDecode(l int) error {
+	if s.opts.DecodeLimiter == nil {
+		return nil
+	}
+	n := 1
+	if s.opts.DecodeLimitBytes {
+		n = l
+	}
+	return errors.Wrap(s.opts.DecodeLimiter.WaitN(context.Background(), n), "wait for decode limiter")
+}
+
+// getChunk returns a chunk of encoding enc holding data from the pool. It
+// fails if the pool returns a chunk of another encoding.
+func (s *Reader) getChunk(enc chunkenc.Encoding, data []byte) (chunkenc.Chunk, error) {
+	c, err := s.pool.Get(enc, data)
+	if err != nil {
+		return nil, err
+	}
+	if c.Encoding() != enc {
+		return nil, errors.Errorf("pool returned chunk of encoding %s for encoding %s", c.Encoding(), enc)
+	}
+	return c, nil
+}
+
+// iteratorReuser is implemented by chunks that can reset a previously
+// returned iterator instead of allocating a new one.
+type iteratorReuser interface {
+	ReuseIterator(it chunkenc.Iterator) chunkenc.Iterator
+}
+
+// ChunkIterator decodes the chunk for ref and returns an iterator over its
+// samples. If the chunk's encoding supports it, reuse is reset and returned
+// instead of allocating a new iterator, so a single iterator can be recycled
+// across many calls. reuse may be nil.
+func (s *Reader) ChunkIterator(ref uint64, reuse chunkenc.Iterator) (chunkenc.Iterator, error) {
+	c, err := s.Chunk(ref)
+	if err != nil {
+		return nil, err
+	}
+	if r, ok := c.(iteratorReuser); ok && reuse != nil {
+		return r.ReuseIterator(reuse), nil
+	}
+	return c.Iterator(), nil
+}
+
+// unlocked calls fn with the read lock released, so that fn may call other
+// methods of the Reader, e.g. a callback passed by the user. The read lock is
+// held again once unlocked returns, and errReaderClosed is returned if the
+// Reader was closed in the meantime.
+func (s *Reader) unlocked(fn func() error) (err error) {
+	s.mtx.RUnlock()
+	defer func() {
+		s.mtx.RLock()
+		if err == nil && s.closed {
+			err = errReaderClosed
+		}
+	}()
+	return fn()
+}
+
+// IterateSegmentsReverse calls fn for every segment, starting with the
+// segment with the highest index. Iteration stops at the first error. The
+// segments are those of the Reader when the call starts, and fn may call
+// other methods of the Reader.
+//
+// Only the order of segments is reversed. Chunks of V1 segments can only be
+// walked front to back as their format does not record where each chunk
+// starts. The footer of finalized V2 segments lists the offsets of all
+// chunks, which allows walking them in any order.
+func (s *Reader) IterateSegmentsReverse(fn func(index int, data ByteSlice) error) error {
+	s.mtx.RLock()
+	bs := s.bs
+	s.mtx.RUnlock()
+
+	for i := len(bs) - 1; i >= 0; i-- {
+		if err := fn(i, bs[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// chunkFrame describes a single chunk as it is laid out within a segment.
+type chunkFrame struct {
+	ref  uint64
+	enc  chunkenc.Encoding
+	data []byte // Aliases the segment bytes.
+	crc  []byte // Stored checksum over encoding and data.
+	next int    // Offset of the frame following this one.
+	// Block checksums of the data and the interval they were computed with,
+	// if the segment has them.
+	sums     []byte
+	interval int
+}
+
+// readFrame parses the chunk frame starting at offset off of segment seq.
+// It returns ok=false if off is at the end of the segment's chunk data or
+// points at the zero padding left behind by pre-allocation, i.e. no more
+// chunks follow.
+func (s *Reader) readFrame(seq, off int) (chunkFrame, bool, error) {
+	return readFrame(s.bs[seq], &s.segs[seq], seq, off)
+}
+
+// readFrame parses the chunk frame starting at offset off of b, whose
+// layout is described by m.
+func readFrame(b ByteSlice, m *segmentMeta, seq, off int) (f chunkFrame, ok bool, err error) {
+	enc, dataStart, l, ok, err := readFrameHeader(b, m, off)
+	if !ok || err != nil {
+		return f, ok, err
+	}
+	dataEnd := dataStart + l
+	sumsEnd := dataEnd + blockSumsSize(l, m.crcInterval)
+
+	f.ref = packRef(seq, off)
+	f.enc = enc
+	f.data = b.Range(dataStart, dataEnd)
+	if m.crcInterval > 0 {
+		f.sums, f.interval = b.Range(dataEnd, sumsEnd), m.crcInterval
+	}
+	if m.flags&SegmentFlagLeadingCRC != 0 {
+		f.crc = b.Range(dataStart-crc32Size, dataStart)
+		f.next = sumsEnd
+	} else {
+		f.crc = b.Range(sumsEnd, sumsEnd+crc32Size)
+		f.next = sumsEnd + crc32Size
+	}
+	return f, true, nil
+}
+
+// readFrameHeader parses the length and encoding of the chunk frame starting
+// at offset off of b like readFrame, without accessing the chunk data. It
+// returns the offset and length of the chunk data.
+//
+// Chunk frames end at m.dataEnd. If the segment has fixed frame lengths, the
+// frame starts with its length. If the segment is aligned, the chunk data is
+// preceded by padding up to the next multiple of m.align. If the segment has
+// leading checksums, the checksum directly precedes the chunk data. If the
+// segment has block checksums, they follow the chunk data.
+func readFrameHeader(b ByteSlice, m *segmentMeta, off int) (enc chunkenc.Encoding, dataStart, dataLen int, ok bool, err error) {
+	size := m.dataEnd
+	if off >= size {
+		return 0, 0, 0, false, nil
+	}
+	start := off
+	var frameLen uint32
+	if m.flags&SegmentFlagFixedFrameLength != 0 {
+		if size-off < frameLengthSize {
+			return 0, 0, 0, false, errors.Wrapf(errInvalidSize, "frame length at offset %d exceeds segment size %d", off, size)
+		}
+		frameLen = binary.BigEndian.Uint32(b.Range(off, off+frameLengthSize))
+		if frameLen == 0 {
+			return 0, 0, 0, false, nil
+		}
+		off += frameLengthSize
+	}
+	end := off + MaxChunkLengthFieldSize
+	if end > size {
+		end = size
+	}
+	l, n := binary.Uvarint(b.Range(off, end))
+	if n <= 0 {
+		return 0, 0, 0, false, errors.Errorf("reading chunk length failed with %d", n)
+	}
+	if l == 0 {
+		return 0, 0, 0, false, nil
+	}
+	encStart := off + n
+	dataStart = encStart + ChunkEncodingSize
+	leading := m.flags&SegmentFlagLeadingCRC != 0
+	if leading {
+		dataStart += crc32Size
+	}
+	if m.align > 1 {
+		dataStart += alignPadding(dataStart, m.align)
+	}
+	if dataStart > size || l > uint64(size-dataStart) {
+		return 0, 0, 0, false, errors.Wrapf(errInvalidSize, "chunk of length %d at offset %d exceeds segment size %d", l, start, size)
+	}
+	trailer := uint64(blockSumsSize(int(l), m.crcInterval))
+	if !leading {
+		trailer += crc32Size
+	}
+	if uint64(size-dataStart)-l < trailer {
+		return 0, 0, 0, false, errors.Wrapf(errInvalidSize, "chunk of length %d at offset %d exceeds segment size %d", l, start, size)
+	}
+	if frameLen > 0 && uint64(frameLen) != uint64(dataStart-off)+l+trailer {
+		return 0, 0, 0, false, errors.Wrapf(errInvalidSize, "frame length %d at offset %d does not match chunk length %d", frameLen, start, l)
+	}
+	enc = chunkenc.Encoding(b.Range(encStart, encStart+ChunkEncodingSize)[0])
+	return enc, dataStart, int(l), true, nil
+}
+
+// progressInterval is the number of scanned bytes after which the progress
+// callback is invoked again within a segment.
+const progressInterval = 64 * 1024 * 1024
+
+// scanSegment calls fn for every chunk frame of segment seq in the order
+// the chunks were written.
+func (s *Reader) scanSegment(seq int, fn func(f chunkFrame) error) error {
+	return s.scanSegmentFrom(seq, SegmentHeaderSize, fn)
+}
+
+// scanSegmentFrom is like scanSegment but starts at the frame at offset off.
+// Frames that cannot be parsed are reported as a CorruptionErr.
+func (s *Reader) scanSegmentFrom(seq, off int, fn func(f chunkFrame) error) error {
+	var (
+		b        = s.bs[seq]
+		progress = s.segmentProgress(seq)
+		reported = off
+		// End of the range a readahead was issued for.
+		hinted = off
+	)
+	for {
+		f, ok, err := s.readFrame(seq, off)
+		if err != nil {
+			return &CorruptionErr{Segment: seq, Offset: int64(off), Err: err}
+		}
+		if !ok {
+			progress(b.Len())
+			return nil
+		}
+		// Issue the next readahead before the hinted range is used up.
+		if s.opts.Readahead && f.next+readaheadSize/2 > hinted {
+			if hinted < f.next {
+				hinted = f.next
+			}
+			hinted = readahead(b, hinted)
+		}
+		if err := fn(f); err != nil {
+			return err
+		}
+		off = f.next
+
+		if off-reported >= progressInterval {
+			progress(off)
+			reported = off
+		}
+	}
+}
+
+// readaheadSize is the number of bytes a readahead hint covers.
+const readaheadSize = 256 * 1024
+
+// readahead hints that readaheadSize bytes of b starting at offset off are
+// needed soon and returns the end of the hinted range.
+func readahead(b ByteSlice, off int) int {
+	end := off + readaheadSize
+	if end > b.Len() {
+		end = b.Len()
+	}
+	if fb, ok := b.(*fallbackByteSlice); ok && fb.viaFile() {
+		return end
+	}
+	// Mappings start at a page boundary, so does every page-aligned offset.
+	start := off - off%os.Getpagesize()
+	if start < end {
+		adviseWillNeed(b.Range(start, end))
+	}
+	return end
+}
+
+// segmentProgress returns a function reporting that segment seq was scanned
+// up to the given offset to the configured progress callback.
+func (s *Reader) segmentProgress(seq int) func(off int) {
+	if s.opts.Progress == nil {
+		return func(int) {}
+	}
+	var before, total int64
+	for i, b := range s.bs {
+		if i < seq {
+			before += int64(b.Len())
+		}
+		total += int64(b.Len())
+	}
+	return func(off int) {
+		s.opts.Progress(seq, before+int64(off), total)
+	}
+}
+
+func nextSequenceFile(dir string, naming NamingStrategy) (string, int, error) {
+	names, err := fileutil.ReadDir(dir)
+	if err != nil {
+		return "", 0, err
+	}
+
+	i := 0
+	for _, n := range names {
+		j, ok := naming.Match(n)
+		if !ok || j < i {
+			continue
+		}
+		i = j
+	}
+	return filepath.Join(dir, naming.Format(i+1)), i + 1, nil
+}
+
+// sequenceFiles returns the segment files in dir in order of their index.
+// Segments listed in the segment names sidecar come first, followed by
+// sequentially numbered files that are not listed.
+func sequenceFiles(dir string) ([]string, error) {
+	return sequenceFilesNamed(dir, NumericNaming)
+}
+
+// sequenceFilesNamed is like sequenceFiles but matches the sequence files
+// with the given naming strategy and orders them by their sequence number.
+// A nil strategy is NumericNaming.
+func sequenceFilesNamed(dir string, naming NamingStrategy) ([]string, error) {
+	if naming == nil {
+		naming = NumericNaming
+	}
+	names, err := readSegmentNames(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "read segment names")
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	type seqFile struct {
+		name string
+		seq  int
+	}
+	var (
+		res    []string
+		seqs   []seqFile
+		listed = make(map[string]struct{}, len(names))
+	)
+	for _, n := range names {
+		res = append(res, filepath.Join(dir, n))
+		listed[n] = struct{}{}
+	}
+	for _, fi := range files {
+		seq, ok := naming.Match(fi.Name())
+		if !ok {
+			continue
+		}
+		if _, ok := listed[fi.Name()]; ok {
+			continue
+		}
+		seqs = append(seqs, seqFile{name: fi.Name(), seq: seq})
+	}
+	sort.SliceStable(seqs, func(i, j int) bool {
+		return seqs[i].seq < seqs[j].seq
+	})
+	for _, f := range seqs {
+		res = append(res, filepath.Join(dir, f.name))
+	}
+	return res, nil
+}
+
+// SegmentFormatVersions returns the format version of every sequence file in
+// the given directory. Only the segment headers are read.
+func SegmentFormatVersions(dir string) ([]int, error) {
+	return SegmentFormatVersionsWithNaming(dir, nil)
+}
+
+// SegmentFormatVersionsWithNaming is like SegmentFormatVersions but matches
+// the segments by naming, or NumericNaming if it is nil.
+func SegmentFormatVersionsWithNaming(dir string, naming NamingStrategy) ([]int, error) {
+	files, err := sequenceFilesNamed(dir, naming)
+	if err != nil {
+		return nil, err
+	}
+	versions := make([]int, 0, len(files))
+
+	for i, fn := range files {
+		v, err := readSegmentVersion(fn)
+		if err != nil {
+			return nil, errors.Wrapf(err, "segment %d", i)
+		}
+		versions = append(versions, v)
+	}
+	return versions, nil
+}
+
+// readSegmentVersion reads the header of the segment file fn and returns its
+// format version.
+func readSegmentVersion(fn string) (int, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var h [SegmentHeaderSize]byte
+	if _, err := io.ReadFull(f, h[:]); err != nil {
+		return 0, errors.Wrap(err, "read header")
+	}
+	if m := binary.BigEndian.Uint32(h[:MagicChunksSize]); m != MagicChunks {
+		return 0, errors.Errorf("invalid magic number %x", m)
+	}
+	return int(h[MagicChunksSize]), nil
+}
+
+func closeAll(cs ...io.Closer) (err error) {
+	for _, c := range cs {
+		if e := c.Close(); e != nil {
+			err = e
+		}
+	}
+	return err
+}
@@ -0,0 +1,2643 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunks
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/tsdb/chunkenc"
+)
+
+func TestMetaOverlapsClosedInterval(t *testing.T) {
+	cases := []struct {
+		meta       Meta
+		mint, maxt int64
+		exp        bool
+	}{
+		{meta: Meta{MinTime: 10, MaxTime: 20}, mint: 0, maxt: 5, exp: false},
+		{meta: Meta{MinTime: 10, MaxTime: 20}, mint: 0, maxt: 10, exp: true},
+		{meta: Meta{MinTime: 10, MaxTime: 20}, mint: 15, maxt: 17, exp: true},
+		{meta: Meta{MinTime: 10, MaxTime: 20}, mint: 20, maxt: 30, exp: true},
+		{meta: Meta{MinTime: 10, MaxTime: 20}, mint: 21, maxt: 30, exp: false},
+		// Open chunks overlap every interval ending at or after their first sample.
+		{meta: Meta{MinTime: 10, MaxTime: math.MaxInt64}, mint: 0, maxt: 5, exp: false},
+		{meta: Meta{MinTime: 10, MaxTime: math.MaxInt64}, mint: 0, maxt: 10, exp: true},
+		{meta: Meta{MinTime: 10, MaxTime: math.MaxInt64}, mint: 100, maxt: 200, exp: true},
+		{meta: Meta{MinTime: 10, MaxTime: math.MaxInt64}, mint: math.MaxInt64, maxt: math.MaxInt64, exp: true},
+	}
+	for i, c := range cases {
+		if got := c.meta.OverlapsClosedInterval(c.mint, c.maxt); got != c.exp {
+			t.Errorf("case %d: [%d, %d] overlapping [%d, %d]: expected %v, got %v",
+				i, c.meta.MinTime, c.meta.MaxTime, c.mint, c.maxt, c.exp, got)
+		}
+	}
+}
+
+func TestMetaIsOpen(t *testing.T) {
+	if (&Meta{MinTime: 0, MaxTime: 100}).IsOpen() {
+		t.Fatal("closed chunk reported as open")
+	}
+	if !(&Meta{MinTime: 0, MaxTime: math.MaxInt64}).IsOpen() {
+		t.Fatal("open chunk reported as closed")
+	}
+}
+
+func TestMergeChunksStaleAware(t *testing.T) {
+	type sample struct {
+		t int64
+		v float64
+	}
+	stale := math.Float64frombits(staleNaN)
+
+	newChunk := func(samples ...sample) chunkenc.Chunk {
+		c := chunkenc.NewXORChunk()
+		app, err := c.Appender()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range samples {
+			app.Append(s.t, s.v)
+		}
+		return c
+	}
+	cases := []struct {
+		a, b []sample
+		exp  []sample
+	}{
+		// Staleness marker in the later chunk at an overlapping timestamp.
+		{
+			a:   []sample{{1, 1}, {2, 2}, {3, 3}},
+			b:   []sample{{2, stale}, {4, 4}},
+			exp: []sample{{1, 1}, {2, stale}, {3, 3}, {4, 4}},
+		},
+		// Staleness markers at the same timestamp in both chunks are kept.
+		{
+			a:   []sample{{1, stale}},
+			b:   []sample{{1, stale}},
+			exp: []sample{{1, stale}},
+		},
+		// Staleness marker in the earlier chunk is replaced by the later sample.
+		{
+			a:   []sample{{1, 1}, {2, stale}},
+			b:   []sample{{2, 5}},
+			exp: []sample{{1, 1}, {2, 5}},
+		},
+		// Ordinary NaN in the later chunk must not become a staleness marker.
+		{
+			a:   []sample{{1, stale}},
+			b:   []sample{{1, math.NaN()}},
+			exp: []sample{{1, math.NaN()}},
+		},
+		// Non-overlapping staleness markers are retained.
+		{
+			a:   []sample{{1, stale}},
+			b:   []sample{{2, stale}},
+			exp: []sample{{1, stale}, {2, stale}},
+		},
+	}
+	for i, c := range cases {
+		res, err := MergeChunksStaleAware(newChunk(c.a...), newChunk(c.b...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []sample
+		it := res.Iterator()
+		for it.Next() {
+			ts, v := it.At()
+			got = append(got, sample{ts, v})
+		}
+		if it.Err() != nil {
+			t.Fatal(it.Err())
+		}
+		if len(got) != len(c.exp) {
+			t.Fatalf("case %d: expected %d samples, got %d", i, len(c.exp), len(got))
+		}
+		for j, s := range c.exp {
+			if got[j].t != s.t {
+				t.Fatalf("case %d, sample %d: expected timestamp %d, got %d", i, j, s.t, got[j].t)
+			}
+			if isStaleNaN(got[j].v) != isStaleNaN(s.v) {
+				t.Fatalf("case %d, sample %d: expected staleness marker %t", i, j, isStaleNaN(s.v))
+			}
+			if math.IsNaN(s.v) {
+				if !math.IsNaN(got[j].v) {
+					t.Fatalf("case %d, sample %d: expected NaN, got %v", i, j, got[j].v)
+				}
+			} else if got[j].v != s.v {
+				t.Fatalf("case %d, sample %d: expected value %v, got %v", i, j, s.v, got[j].v)
+			}
+		}
+	}
+}
+
+func TestWriterSegmentRing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_segment_ring")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	w, err := NewWriterWithOptions(dir, &WriterOptions{SegmentSize: 1, segmentRing: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every batch exceeds the segment size and thus gets its own segment.
+	for i := 0; i < 10; i++ {
+		chks := []Meta{{Chunk: chunkenc.NewXORChunk()}}
+		if err := w.WriteChunks(chks...); err != nil {
+			t.Fatal(err)
+		}
+		if exp := uint64(i)<<32 | SegmentHeaderSize; chks[0].Ref != exp {
+			t.Fatalf("unexpected ref %x, expected %x", chks[0].Ref, exp)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	files, err := sequenceFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("expected 2 segment files, got %d", len(files))
+	}
+	for _, fn := range files {
+		b, err := ioutil.ReadFile(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := NewReader([]ByteSlice{realByteSlice(b)}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.Chunk(SegmentHeaderSize); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// wrongEncodingChunk reports an encoding other than the one of its data.
+type wrongEncodingChunk struct {
+	chunkenc.Chunk
+}
+
+func (wrongEncodingChunk) Encoding() chunkenc.Encoding { return chunkenc.EncNone }
+
+// wrongEncodingPool returns chunks reporting the wrong encoding.
+type wrongEncodingPool struct {
+	chunkenc.Pool
+}
+
+func (p wrongEncodingPool) Get(e chunkenc.Encoding, b []byte) (chunkenc.Chunk, error) {
+	c, err := p.Pool.Get(e, b)
+	if err != nil {
+		return nil, err
+	}
+	return wrongEncodingChunk{c}, nil
+}
+
+func TestReaderChunkPoolEncodingMismatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_pool_encoding")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	w, err := NewWriter(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chks := []Meta{{Chunk: chunkenc.NewXORChunk()}}
+	if err := w.WriteChunks(chks...); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewDirReader(dir, wrongEncodingPool{chunkenc.NewPool()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	if _, err := r.Chunk(chks[0].Ref); err == nil {
+		t.Fatal("expected error for chunk of mismatching encoding")
+	}
+}
+
+func benchChunks(b *testing.B, n, samples int) []Meta {
+	chks := make([]Meta, 0, n)
+	for i := 0; i < n; i++ {
+		c := chunkenc.NewXORChunk()
+		app, err := c.Appender()
+		if err != nil {
+			b.Fatal(err)
+		}
+		for j := 0; j < samples; j++ {
+			app.Append(int64(j)*15000, float64(i*j))
+		}
+		chks = append(chks, Meta{Chunk: c, MinTime: 0, MaxTime: int64(samples-1) * 15000})
+	}
+	return chks
+}
+
+func BenchmarkWriteChunks(b *testing.B) {
+	cases := []struct {
+		name            string
+		chunks, samples int
+	}{
+		{name: "small-many", chunks: 1000, samples: 10},
+		{name: "large-few", chunks: 10, samples: 10000},
+	}
+	for _, c := range cases {
+		b.Run(c.name, func(b *testing.B) {
+			dir, err := ioutil.TempDir("", "bench_write_chunks")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			chks := benchChunks(b, c.chunks, c.samples)
+			var size int64
+			for _, chk := range chks {
+				size += int64(len(chk.Chunk.Bytes()))
+			}
+			w, err := NewWriter(dir)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.SetBytes(size)
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				if err := w.WriteChunks(chks...); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+
+			if err := w.Close(); err != nil {
+				b.Fatal(err)
+			}
+		})
+	}
+}
+
+func BenchmarkReaderChunk(b *testing.B) {
+	dir, err := ioutil.TempDir("", "bench_reader_chunk")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	chks := benchChunks(b, 10000, 120)
+	w, err := NewWriter(dir)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := w.WriteChunks(chks...); err != nil {
+		b.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		b.Fatal(err)
+	}
+	r, err := NewDirReader(dir, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer r.Close()
+
+	// Visit refs in a fixed pseudo-random order.
+	rnd := rand.New(rand.NewSource(1))
+	refs := make([]uint64, len(chks))
+	for i, j := range rnd.Perm(len(chks)) {
+		refs[i] = chks[j].Ref
+	}
+	b.SetBytes(int64(len(chks[0].Chunk.Bytes())))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		c, err := r.Chunk(refs[i%len(refs)])
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := r.pool.Put(c); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestWriterDeterministic(t *testing.T) {
+	write := func() map[string][]byte {
+		dir, err := ioutil.TempDir("", "test_deterministic")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		w, err := NewWriterWithOptions(dir, &WriterOptions{
+			SegmentSize:           1024,
+			FormatVersion:         chunksFormatV2,
+			Provenance:            &Provenance{},
+			WriteSampleCountIndex: true,
+			WriteManifest:         true,
+			Deterministic:         true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 20; i++ {
+			c := chunkenc.NewXORChunk()
+			app, err := c.Appender()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for j := 0; j < 10; j++ {
+				app.Append(int64(i*100+j), float64(j))
+			}
+			if err := w.WriteChunks(Meta{Chunk: c, MinTime: int64(i * 100), MaxTime: int64(i*100 + 9)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		fis, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files := map[string][]byte{}
+		for _, fi := range fis {
+			b, err := ioutil.ReadFile(filepath.Join(dir, fi.Name()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			files[fi.Name()] = b
+		}
+		return files
+	}
+	a, b := write(), write()
+
+	if _, ok := a[provenanceFilename]; ok {
+		t.Fatal("unexpected provenance sidecar")
+	}
+	if len(a) != len(b) {
+		t.Fatalf("got %d and %d files", len(a), len(b))
+	}
+	for name, ba := range a {
+		if !bytes.Equal(ba, b[name]) {
+			t.Fatalf("file %s differs", name)
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "test_deterministic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	blk, err := aes.NewCipher(make([]byte, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(blk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewWriterWithOptions(dir, &WriterOptions{
+		FormatVersion: chunksFormatV2,
+		Cipher:        aead,
+		Deterministic: true,
+	})
+	if err == nil {
+		t.Fatal("expected error for deterministic encrypted writer")
+	}
+}
+
+func FuzzReaderChunk(f *testing.F) {
+	for _, opts := range []*WriterOptions{
+		{FormatVersion: chunksFormatV1},
+		{FormatVersion: chunksFormatV2, FixedFrameLength: true, Alignment: 8},
+	} {
+		dir, err := ioutil.TempDir("", "fuzz_reader_chunk")
+		if err != nil {
+			f.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		w, err := NewWriterWithOptions(dir, opts)
+		if err != nil {
+			f.Fatal(err)
+		}
+		chks := []Meta{{Chunk: chunkenc.NewXORChunk()}, {Chunk: chunkenc.NewXORChunk()}}
+		if err := w.WriteChunks(chks...); err != nil {
+			f.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			f.Fatal(err)
+		}
+		b, err := ioutil.ReadFile(filepath.Join(dir, "000001"))
+		if err != nil {
+			f.Fatal(err)
+		}
+		for _, c := range chks {
+			f.Add(b, c.Ref)
+		}
+	}
+
+	f.Fuzz(func(t *testing.T, b []byte, ref uint64) {
+		r, err := NewReader([]ByteSlice{realByteSlice(b)}, nil)
+		if err != nil {
+			return
+		}
+		// Errors are expected, panics are not.
+		r.Chunk(ref)
+	})
+}
+
+func TestTombstoneSkippedByFooterReads(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_tombstone_footer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	w, err := NewWriterWithOptions(dir, &WriterOptions{FormatVersion: chunksFormatV2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	chks := testChunks(t, 5, 10)
+	if err := w.WriteChunks(chks...); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// The last chunk has the highest MaxTime.
+	if err := Tombstone(dir, chks[4].Ref); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewDirReader(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	latest, err := r.LatestChunks(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(latest) != 2 || latest[0].Ref != chks[3].Ref || latest[1].Ref != chks[2].Ref {
+		t.Fatalf("unexpected latest chunks %v", latest)
+	}
+	if latest[0].Chunk == nil || latest[0].MaxTime != chks[3].MaxTime {
+		t.Fatalf("latest chunk not decoded: %v", latest[0])
+	}
+
+	st, err := r.SampleStats(1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Chunks != 4 {
+		t.Fatalf("expected 4 sampled chunks, got %d", st.Chunks)
+	}
+	if st.MaxTime != chks[3].MaxTime {
+		t.Fatalf("expected max time %d, got %d", chks[3].MaxTime, st.MaxTime)
+	}
+}
+
+// testChunks returns n XOR chunks of the given number of samples each,
+// covering consecutive time ranges.
+func testChunks(t *testing.T, n, samples int) []Meta {
+	chks := make([]Meta, 0, n)
+	for i := 0; i < n; i++ {
+		c := chunkenc.NewXORChunk()
+		app, err := c.Appender()
+		if err != nil {
+			t.Fatal(err)
+		}
+		mint := int64(i * samples * 10)
+		for j := 0; j < samples; j++ {
+			app.Append(mint+int64(j*10), float64(i*j))
+		}
+		chks = append(chks, Meta{Chunk: c, MinTime: mint, MaxTime: mint + int64((samples-1)*10)})
+	}
+	return chks
+}
+
+func TestNameByTimeRangeOverlapping(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_name_by_time_range")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	w, err := NewWriterWithOptions(dir, &WriterOptions{SegmentSize: 1, NameByTimeRange: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every batch gets its own segment. The first two segments cover the same
+	// time range and the third one overlaps with both.
+	chks := testChunks(t, 2, 10)
+	batches := [][]Meta{
+		{chks[0]},
+		{{Chunk: chks[0].Chunk, MinTime: chks[0].MinTime, MaxTime: chks[0].MaxTime}},
+		{{Chunk: chks[1].Chunk, MinTime: chks[0].MinTime, MaxTime: chks[1].MaxTime}},
+	}
+	for _, b := range batches {
+		if err := w.WriteChunks(b...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewDirReader(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	for i, b := range batches {
+		seq, _ := unpackRef(b[0].Ref)
+		if seq != i {
+			t.Fatalf("batch %d: unexpected segment %d", i, seq)
+		}
+		mint, maxt, ok := r.SegmentTimeRange(seq)
+		if !ok || mint != b[0].MinTime || maxt != b[0].MaxTime {
+			t.Fatalf("batch %d: unexpected segment time range %d-%d (%v)", i, mint, maxt, ok)
+		}
+		c, err := r.Chunk(b[0].Ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(c.Bytes(), b[0].Chunk.Bytes()) {
+			t.Fatalf("batch %d: chunk data mismatch", i)
+		}
+	}
+}
+
+// prefixNaming names segments "chunk-<seq>.seg".
+type prefixNaming struct{}
+
+func (prefixNaming) Match(name string) (int, bool) {
+	var seq int
+	if _, err := fmt.Sscanf(name, "chunk-%06d.seg", &seq); err != nil || (prefixNaming{}).Format(seq) != name {
+		return 0, false
+	}
+	return seq, true
+}
+
+func (prefixNaming) Format(seq int) string { return fmt.Sprintf("chunk-%06d.seg", seq) }
+
+func TestDirHelpersNaming(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_dir_helpers_naming")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A file matching the default naming that is not a segment.
+	if err := ioutil.WriteFile(filepath.Join(dir, "000001"), []byte("foo"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	w, err := NewWriterWithOptions(dir, &WriterOptions{SegmentSize: 1, FormatVersion: chunksFormatV2, Naming: prefixNaming{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	chks := testChunks(t, 3, 10)
+	for i := range chks {
+		if err := w.WriteChunks(chks[i : i+1]...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := SegmentFormatVersions(dir); err == nil {
+		t.Fatal("expected error for non-segment file with default naming")
+	}
+	versions, err := SegmentFormatVersionsWithNaming(dir, prefixNaming{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 3 {
+		t.Fatalf("expected 3 segments, got %d", len(versions))
+	}
+	if err := TombstoneWithNaming(dir, chks[1].Ref, prefixNaming{}); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := &ReaderOptions{Naming: prefixNaming{}}
+	mr, err := NewMultiDirReaderWithOptions([]string{dir}, nil, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Close()
+
+	br, serrs, err := NewDirReaderBestEffortWithOptions(dir, nil, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer br.Close()
+	if len(serrs) != 0 {
+		t.Fatalf("unexpected segment errors %v", serrs)
+	}
+
+	for _, r := range []*Reader{mr, br} {
+		for i, c := range chks {
+			_, err := r.Chunk(c.Ref)
+			if i == 1 {
+				if errors.Cause(err) != ErrTombstoned {
+					t.Fatalf("expected tombstoned chunk, got %v", err)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+// seriesChunks returns n XOR chunks of the given number of samples each,
+// resembling scraped series. Timestamps are 15s apart with jitter and every
+// other series is a counter, the others gauges.
+func seriesChunks(tb testing.TB, n, samples int) []Meta {
+	rnd := rand.New(rand.NewSource(1))
+	chks := make([]Meta, 0, n)
+
+	for i := 0; i < n; i++ {
+		c := chunkenc.NewXORChunk()
+		app, err := c.Appender()
+		if err != nil {
+			tb.Fatal(err)
+		}
+		var (
+			t = int64(rnd.Intn(15000))
+			v = float64(rnd.Intn(1000))
+		)
+		for j := 0; j < samples; j++ {
+			app.Append(t, v)
+			if j < samples-1 {
+				t += 15000 + int64(rnd.Intn(20)) - 10
+			}
+			if i%2 == 0 {
+				v += float64(rnd.Intn(10))
+			} else {
+				v = math.Round((v+rnd.NormFloat64())*100) / 100
+			}
+		}
+		chks = append(chks, Meta{Chunk: c, MinTime: t - int64(samples-1)*15000, MaxTime: t})
+	}
+	return chks
+}
+
+// writeTestDir writes chks one by one to a new directory with the given
+// options and returns the directory and the size of all its files.
+func writeTestDir(tb testing.TB, opts *WriterOptions, chks []Meta) (string, int64) {
+	dir, err := ioutil.TempDir("", "test_write_dir")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	w, err := NewWriterWithOptions(dir, opts)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	for i := range chks {
+		if err := w.WriteChunks(chks[i : i+1]...); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		tb.Fatal(err)
+	}
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	var size int64
+	for _, fi := range fis {
+		size += fi.Size()
+	}
+	return dir, size
+}
+
+func TestDictCompressionRoundTrip(t *testing.T) {
+	chks := seriesChunks(t, 1000, 120)
+
+	plainDir, plainSize := writeTestDir(t, &WriterOptions{FormatVersion: chunksFormatV2, SegmentSize: 256 * 1024}, chks)
+	defer os.RemoveAll(plainDir)
+
+	// Several segments, so that chunks are decompressed against different
+	// dictionaries.
+	dir, size := writeTestDir(t, &WriterOptions{FormatVersion: chunksFormatV2, SegmentSize: 256 * 1024, DictCompression: true}, chks)
+	defer os.RemoveAll(dir)
+
+	if size >= plainSize {
+		t.Fatalf("compressed size %d not below uncompressed size %d", size, plainSize)
+	}
+	r, err := NewDirReader(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	if len(r.bs) < 2 {
+		t.Fatalf("expected several segments, got %d", len(r.bs))
+	}
+	for i, c := range chks {
+		got, err := r.Chunk(c.Ref)
+		if err != nil {
+			t.Fatalf("chunk %d: %s", i, err)
+		}
+		if !bytes.Equal(got.Bytes(), c.Chunk.Bytes()) {
+			t.Fatalf("chunk %d: data mismatch", i)
+		}
+	}
+	if err := r.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Compressed chunks are reported with the encoding of their data.
+	st, err := r.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(st.Encodings) != 1 || st.Encodings[chunkenc.EncXOR] != len(chks) {
+		t.Fatalf("unexpected encodings %v", st.Encodings)
+	}
+	runs := 0
+	err = r.IterateRuns(func(enc chunkenc.Encoding, refs []uint64) error {
+		if enc != chunkenc.EncXOR || len(refs) != len(chks) {
+			t.Fatalf("unexpected run of %d chunks of encoding %s", len(refs), enc)
+		}
+		runs++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runs != 1 {
+		t.Fatalf("expected a single run, got %d", runs)
+	}
+	es, err := EncodingStatsSorted(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(es) != 1 || es[0].Encoding != chunkenc.EncXOR || es[0].Count != len(chks) {
+		t.Fatalf("unexpected encoding stats %v", es)
+	}
+}
+
+// BenchmarkDictCompression reports the size of a directory with and without
+// dictionary compression relative to the raw chunk data and the cost of
+// reading chunks from it.
+func BenchmarkDictCompression(b *testing.B) {
+	chks := seriesChunks(b, 2000, 120)
+
+	var raw int64
+	for _, c := range chks {
+		raw += int64(len(c.Chunk.Bytes()))
+	}
+	for _, dict := range []bool{false, true} {
+		b.Run(fmt.Sprintf("dict=%v", dict), func(b *testing.B) {
+			dir, size := writeTestDir(b, &WriterOptions{FormatVersion: chunksFormatV2, DictCompression: dict}, chks)
+			defer os.RemoveAll(dir)
+
+			r, err := NewDirReader(dir, nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer r.Close()
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				c, err := r.Chunk(chks[i%len(chks)].Ref)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if err := r.pool.Put(c); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(size)/float64(raw), "size/raw")
+		})
+	}
+}
+
+func TestWriterMaxTotalBytesBatch(t *testing.T) {
+	for _, version := range []int{chunksFormatV1, chunksFormatV2} {
+		dir, err := ioutil.TempDir("", "test_max_total_bytes")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		w, err := NewWriterWithOptions(dir, &WriterOptions{FormatVersion: version, MaxTotalBytes: 300})
+		if err != nil {
+			t.Fatal(err)
+		}
+		chks := testChunks(t, 30, 10)
+		written := 0
+		for ; written < len(chks); written += 3 {
+			err = w.WriteChunks(chks[written : written+3]...)
+			if err != nil {
+				break
+			}
+		}
+		if errors.Cause(err) != ErrQuotaExceeded {
+			t.Fatalf("version %d: expected quota error, got %v", version, err)
+		}
+		if written == 0 {
+			t.Fatalf("version %d: no batch written", version)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		r, err := NewDirReader(dir, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+
+		// No chunk of the rejected batch is written.
+		st, err := r.Stats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if st.Chunks != written {
+			t.Fatalf("version %d: expected %d chunks, got %d", version, written, st.Chunks)
+		}
+		if st.SegmentBytes > 300 {
+			t.Fatalf("version %d: %d bytes exceed quota", version, st.SegmentBytes)
+		}
+	}
+}
+
+func TestWriterMaxTotalBytesCut(t *testing.T) {
+	for _, version := range []int{chunksFormatV1, chunksFormatV2} {
+		dir, err := ioutil.TempDir("", "test_max_total_bytes_cut")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		// Segments hold few chunks, so that the rejected chunk needs a new
+		// one.
+		w, err := NewWriterWithOptions(dir, &WriterOptions{FormatVersion: version, SegmentSize: 64, MaxTotalBytes: 400})
+		if err != nil {
+			t.Fatal(err)
+		}
+		chks := testChunks(t, 20, 10)
+		written := 0
+		for ; written < len(chks); written++ {
+			if err = w.WriteChunks(chks[written]); err != nil {
+				break
+			}
+		}
+		if errors.Cause(err) != ErrQuotaExceeded {
+			t.Fatalf("version %d: expected quota error, got %v", version, err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		r, err := NewDirReader(dir, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+
+		if err := r.Validate(); err != nil {
+			t.Fatalf("version %d: %s", version, err)
+		}
+		// The quota is checked before cutting, so no segment without chunks
+		// is left behind.
+		n := 0
+		for seq := range r.bs {
+			var segChunks int
+			if err := r.scanSegment(seq, func(chunkFrame) error { segChunks++; return nil }); err != nil {
+				t.Fatalf("version %d: %s", version, err)
+			}
+			if segChunks == 0 {
+				t.Fatalf("version %d: segment %d of %d holds no chunks", version, seq, len(r.bs))
+			}
+			n += segChunks
+		}
+		if n != written {
+			t.Fatalf("version %d: expected %d chunks, got %d", version, written, n)
+		}
+		if r.Size() > 400 {
+			t.Fatalf("version %d: %d bytes exceed quota", version, r.Size())
+		}
+	}
+}
+
+// corruptChunk flips a byte of the data of the chunk ref in dir.
+func corruptChunk(t *testing.T, dir string, ref uint64) {
+	r, err := NewDirReader(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seq, off := unpackRef(ref)
+	f, ok, err := r.readFrame(seq, off)
+	if err != nil || !ok {
+		t.Fatalf("read chunk %d: %v", ref, err)
+	}
+	fo, fn := r.segs[seq].frameOffsets(off, f), r.files[seq]
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[fo.data] ^= 0xff
+	if err := ioutil.WriteFile(fn, b, 0666); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRepairFromReplica(t *testing.T) {
+	chks := testChunks(t, 6, 50)
+	opts := &WriterOptions{
+		FormatVersion:         chunksFormatV2,
+		SegmentSize:           256,
+		CRCPlacement:          CRCLeading,
+		IntraChunkCRCInterval: 16,
+	}
+	target, _ := writeTestDir(t, opts, chks)
+	defer os.RemoveAll(target)
+	source, _ := writeTestDir(t, opts, chks)
+	defer os.RemoveAll(source)
+
+	if seq, _ := unpackRef(chks[5].Ref); seq == 0 {
+		t.Fatal("expected chunks in several segments")
+	}
+	corruptChunk(t, target, chks[1].Ref)
+	corruptChunk(t, target, chks[2].Ref)
+	corruptChunk(t, target, chks[5].Ref)
+	// Corrupted in both directories.
+	corruptChunk(t, target, chks[3].Ref)
+	corruptChunk(t, source, chks[3].Ref)
+
+	repaired, unrepairable, err := RepairFromReplica(target, source, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := []uint64{chks[1].Ref, chks[2].Ref, chks[5].Ref}; fmt.Sprint(repaired) != fmt.Sprint(exp) {
+		t.Fatalf("expected repaired chunks %v, got %v", exp, repaired)
+	}
+	if len(unrepairable) != 1 || unrepairable[0] != chks[3].Ref {
+		t.Fatalf("expected unrepairable chunk %d, got %v", chks[3].Ref, unrepairable)
+	}
+
+	r, err := NewDirReader(target, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	refs := make([]uint64, 0, len(chks))
+	for i, c := range chks {
+		refs = append(refs, c.Ref)
+		if i == 3 {
+			continue
+		}
+		got, err := r.Chunk(c.Ref)
+		if err != nil {
+			t.Fatalf("chunk %d: %s", i, err)
+		}
+		if !bytes.Equal(got.Bytes(), c.Chunk.Bytes()) {
+			t.Fatalf("chunk %d: data mismatch", i)
+		}
+	}
+	bad, err := r.VerifyRefs(refs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bad) != 1 || bad[0] != chks[3].Ref {
+		t.Fatalf("expected only chunk %d to be corrupted, got %v", chks[3].Ref, bad)
+	}
+}
+
+func TestRepairFromReplicaDictCompressed(t *testing.T) {
+	chks := seriesChunks(t, 100, 120)
+	opts := &WriterOptions{FormatVersion: chunksFormatV2, DictCompression: true}
+
+	target, _ := writeTestDir(t, opts, chks)
+	defer os.RemoveAll(target)
+	source, _ := writeTestDir(t, opts, chks)
+	defer os.RemoveAll(source)
+
+	ref := chks[len(chks)-1].Ref
+	corruptChunk(t, target, ref)
+
+	repaired, unrepairable, err := RepairFromReplica(target, source, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(repaired) != 0 || len(unrepairable) != 1 || unrepairable[0] != ref {
+		t.Fatalf("expected unrepairable chunk %d, got repaired %v, unrepairable %v", ref, repaired, unrepairable)
+	}
+}
+
+func TestReaderValidateFileSize(t *testing.T) {
+	dir, _ := writeTestDir(t, &WriterOptions{SegmentSize: 256}, testChunks(t, 10, 50))
+	defer os.RemoveAll(dir)
+
+	r, err := NewDirReader(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	if err := r.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(r.files[1], os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte{0}); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Validate(); errors.Cause(err) != errInvalidSize {
+		t.Fatalf("expected size error, got %v", err)
+	}
+}
+
+func TestReaderValidateSize(t *testing.T) {
+	dir, _ := writeTestDir(t, &WriterOptions{SegmentSize: 256}, testChunks(t, 10, 50))
+	defer os.RemoveAll(dir)
+
+	r, err := NewDirReader(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	if err := r.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	// A Reader whose size does not account for all of its segments.
+	r.size -= int64(r.bs[1].Len())
+
+	if err := r.Validate(); errors.Cause(err) != errInvalidSize {
+		t.Fatalf("expected size error, got %v", err)
+	}
+}
+
+func TestReaderFindCorrupt(t *testing.T) {
+	for _, version := range []int{chunksFormatV1, chunksFormatV2} {
+		chks := testChunks(t, 40, 30)
+		dir, _ := writeTestDir(t, &WriterOptions{FormatVersion: version}, chks)
+		defer os.RemoveAll(dir)
+
+		corruptChunk(t, dir, chks[3].Ref)
+		corruptChunk(t, dir, chks[30].Ref)
+
+		// Corrupt the length of a chunk, which misaligns all following frames.
+		fn := filepath.Join(dir, "000001")
+		b, err := ioutil.ReadFile(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, off := unpackRef(chks[10].Ref)
+		b[off], b[off+1] = 0xff, 0x7f
+		if err := ioutil.WriteFile(fn, b, 0666); err != nil {
+			t.Fatal(err)
+		}
+
+		r, err := NewDirReader(dir, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+
+		cerrs, err := r.FindCorrupt()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var offs []int64
+		for _, c := range cerrs {
+			offs = append(offs, c.Offset)
+		}
+		exp := make([]int64, 0, 3)
+		for _, i := range []int{3, 10, 30} {
+			_, off := unpackRef(chks[i].Ref)
+			exp = append(exp, int64(off))
+		}
+		if fmt.Sprint(offs) != fmt.Sprint(exp) {
+			t.Fatalf("version %d: expected corruptions at %v, got %v", version, exp, offs)
+		}
+		if _, ok := cerrs[1].Err.(*MisalignmentErr); !ok {
+			t.Fatalf("version %d: expected misalignment error, got %v", version, cerrs[1].Err)
+		}
+	}
+}
+
+// testAEAD returns an AES-GCM cipher with a key of all key bytes.
+func testAEAD(t *testing.T, key byte) cipher.AEAD {
+	blk, err := aes.NewCipher(bytes.Repeat([]byte{key}, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(blk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return aead
+}
+
+// overheadAEAD is a cipher.AEAD that reports extra bytes of overhead, which
+// Writers account for before sealing any chunk.
+type overheadAEAD struct {
+	cipher.AEAD
+	extra int
+}
+
+func (a *overheadAEAD) Overhead() int { return a.AEAD.Overhead() + a.extra }
+
+func TestWriterOversizedChunk(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_oversized_chunk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The sealed size of chunks is increased beyond MaxChunkLength without
+	// allocating that much data.
+	aead := &overheadAEAD{AEAD: testAEAD(t, 1)}
+	w, err := NewWriterWithOptions(dir, &WriterOptions{FormatVersion: chunksFormatV2, Cipher: aead})
+	if err != nil {
+		t.Fatal(err)
+	}
+	chks := testChunks(t, 4, 30)
+
+	if err := w.WriteChunks(chks[:1]...); err != nil {
+		t.Fatal(err)
+	}
+	aead.extra = MaxChunkLength
+	err = w.WriteChunks(chks[1:3]...)
+	if err == nil || !strings.Contains(err.Error(), "exceeds maximum chunk length") {
+		t.Fatalf("expected maximum chunk length error, got %v", err)
+	}
+	if chks[1].Ref != 0 || chks[2].Ref != 0 {
+		t.Fatal("references set for rejected chunks")
+	}
+	aead.extra = 0
+	if err := w.WriteChunks(chks[3:]...); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewDirReaderWithOptions(dir, nil, &ReaderOptions{Cipher: aead})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	// No partial frame of the rejected chunks precedes the last chunk.
+	if _, _, err := r.VerifyFrom(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	var refs []uint64
+	if err := r.scanSegment(0, func(f chunkFrame) error { refs = append(refs, f.ref); return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if exp := []uint64{chks[0].Ref, chks[3].Ref}; fmt.Sprint(refs) != fmt.Sprint(exp) {
+		t.Fatalf("expected chunks %v, got %v", exp, refs)
+	}
+	for _, i := range []int{0, 3} {
+		c, err := r.Chunk(chks[i].Ref)
+		if err != nil {
+			t.Fatalf("chunk %d: %s", i, err)
+		}
+		if !bytes.Equal(c.Bytes(), chks[i].Chunk.Bytes()) {
+			t.Fatalf("chunk %d: data mismatch", i)
+		}
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	chks := testChunks(t, 5, 30)
+	dir, _ := writeTestDir(t, &WriterOptions{FormatVersion: chunksFormatV2, Cipher: testAEAD(t, 1)}, chks)
+	defer os.RemoveAll(dir)
+
+	// Chunk data is not stored in plain text.
+	b, err := ioutil.ReadFile(filepath.Join(dir, "000001"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, c := range chks {
+		if bytes.Contains(b, c.Chunk.Bytes()) {
+			t.Fatalf("chunk %d stored in plain text", i)
+		}
+	}
+
+	read := func(opts *ReaderOptions) []error {
+		r, err := NewDirReaderWithOptions(dir, nil, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+
+		errs := make([]error, len(chks))
+		for i, c := range chks {
+			got, err := r.Chunk(c.Ref)
+			if err == nil && !bytes.Equal(got.Bytes(), c.Chunk.Bytes()) {
+				t.Fatalf("chunk %d: data mismatch", i)
+			}
+			errs[i] = err
+		}
+		return errs
+	}
+	for i, err := range read(&ReaderOptions{Cipher: testAEAD(t, 1)}) {
+		if err != nil {
+			t.Fatalf("chunk %d: %s", i, err)
+		}
+	}
+	for i, err := range read(&ReaderOptions{Cipher: testAEAD(t, 2)}) {
+		if err == nil {
+			t.Fatalf("chunk %d: expected error for wrong key", i)
+		}
+	}
+	for i, err := range read(nil) {
+		if err == nil {
+			t.Fatalf("chunk %d: expected error for missing cipher", i)
+		}
+	}
+
+	corruptChunk(t, dir, chks[2].Ref)
+
+	for i, err := range read(&ReaderOptions{Cipher: testAEAD(t, 1)}) {
+		if i == 2 {
+			if err == nil {
+				t.Fatal("expected error for tampered chunk")
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("chunk %d: %s", i, err)
+		}
+	}
+}
+
+func TestOverwriteChunk(t *testing.T) {
+	cases := []struct {
+		name string
+		opts WriterOptions
+	}{
+		{name: "v1", opts: WriterOptions{FormatVersion: chunksFormatV1}},
+		{name: "v2", opts: WriterOptions{FormatVersion: chunksFormatV2}},
+		{name: "fixed-frame-length", opts: WriterOptions{FormatVersion: chunksFormatV2, FixedFrameLength: true}},
+		{name: "leading-crc", opts: WriterOptions{FormatVersion: chunksFormatV2, CRCPlacement: CRCLeading}},
+		{name: "block-sums", opts: WriterOptions{FormatVersion: chunksFormatV2, IntraChunkCRCInterval: 16}},
+		{name: "aligned", opts: WriterOptions{FormatVersion: chunksFormatV2, Alignment: 8}},
+		{name: "bound-time-ranges", opts: WriterOptions{FormatVersion: chunksFormatV2, BindTimeRanges: true}},
+		{name: "all", opts: WriterOptions{
+			FormatVersion:         chunksFormatV2,
+			FixedFrameLength:      true,
+			CRCPlacement:          CRCLeading,
+			IntraChunkCRCInterval: 16,
+			Alignment:             8,
+			BindTimeRanges:        true,
+		}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			chks := testChunks(t, 3, 50)
+			opts := c.opts
+			opts.WriteManifest = true
+			opts.WriteSampleCountIndex = true
+			dir, _ := writeTestDir(t, &opts, chks)
+			defer os.RemoveAll(dir)
+
+			data := append([]byte(nil), chks[1].Chunk.Bytes()...)
+			data[len(data)-1] ^= 0xff
+			// The first two bytes of an XOR chunk hold its number of samples.
+			data[1] = 49
+
+			if err := OverwriteChunk(dir, chks[1].Ref, data, chunkenc.EncXOR); err != nil {
+				t.Fatal(err)
+			}
+			if err := OverwriteChunk(dir, chks[1].Ref, data[1:], chunkenc.EncXOR); err == nil {
+				t.Fatal("expected error for data of different length")
+			}
+
+			r, err := NewDirReader(dir, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+
+			if _, _, err := r.VerifyFrom(0, 0); err != nil {
+				t.Fatal(err)
+			}
+			if err := VerifyManifest(dir); err != nil {
+				t.Fatalf("manifest: %s", err)
+			}
+			counts, err := LoadSampleCounts(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, chk := range chks {
+				exp := 50
+				if i == 1 {
+					exp = 49
+				}
+				if n := counts[chk.Ref]; int(n) != exp {
+					t.Fatalf("chunk %d: expected sample count %d, got %d", i, exp, n)
+				}
+			}
+			for i, chk := range chks {
+				exp := chk.Chunk.Bytes()
+				if i == 1 {
+					exp = data
+				}
+				got, err := r.Chunk(chk.Ref)
+				if err != nil {
+					t.Fatalf("chunk %d: %s", i, err)
+				}
+				if !bytes.Equal(got.Bytes(), exp) {
+					t.Fatalf("chunk %d: data mismatch", i)
+				}
+			}
+		})
+	}
+}
+
+func TestUpgradeV1ToV2(t *testing.T) {
+	chks := testChunks(t, 6, 50)
+	dir, _ := writeTestDir(t, &WriterOptions{FormatVersion: chunksFormatV1, SegmentSize: 256}, chks)
+	defer os.RemoveAll(dir)
+
+	if err := UpgradeV1ToV2(dir, nil); err != nil {
+		t.Fatal(err)
+	}
+	versions, err := SegmentFormatVersions(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) < 2 {
+		t.Fatalf("expected multiple segments, got %d", len(versions))
+	}
+	for i, v := range versions {
+		if v != chunksFormatV2 {
+			t.Fatalf("segment %d: expected version %d, got %d", i, chunksFormatV2, v)
+		}
+	}
+
+	r, err := NewDirReader(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	if _, _, err := r.VerifyFrom(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	// The footers must list every chunk under its original reference with the
+	// time range of its samples.
+	metas, err := r.AllMeta()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(metas) != len(chks) {
+		t.Fatalf("expected %d footer entries, got %d", len(chks), len(metas))
+	}
+	for i, chk := range chks {
+		if metas[i].Ref != chk.Ref || metas[i].MinTime != chk.MinTime || metas[i].MaxTime != chk.MaxTime {
+			t.Fatalf("chunk %d: expected %d [%d, %d], got %d [%d, %d]", i,
+				chk.Ref, chk.MinTime, chk.MaxTime, metas[i].Ref, metas[i].MinTime, metas[i].MaxTime)
+		}
+		c, err := r.Chunk(chk.Ref)
+		if err != nil {
+			t.Fatalf("chunk %d: %s", i, err)
+		}
+		if !bytes.Equal(c.Bytes(), chk.Chunk.Bytes()) {
+			t.Fatalf("chunk %d: data mismatch", i)
+		}
+	}
+
+	// Upgrading again leaves the V2 segments untouched.
+	before, err := ioutil.ReadFile(r.files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := UpgradeV1ToV2(dir, nil); err != nil {
+		t.Fatal(err)
+	}
+	after, err := ioutil.ReadFile(r.files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Fatal("V2 segment changed by repeated upgrade")
+	}
+}
+
+func TestTombstone(t *testing.T) {
+	chks := testChunks(t, 4, 10)
+	dir, _ := writeTestDir(t, &WriterOptions{FormatVersion: chunksFormatV2}, chks)
+	defer os.RemoveAll(dir)
+
+	if err := Tombstone(dir, chks[1].Ref); err != nil {
+		t.Fatal(err)
+	}
+	// Tombstoning a chunk twice is a no-op.
+	if err := Tombstone(dir, chks[1].Ref); err != nil {
+		t.Fatal(err)
+	}
+	if err := Tombstone(dir, chks[1].Ref+1); err == nil {
+		t.Fatal("expected error for reference without footer entry")
+	}
+
+	r, err := NewDirReader(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	if _, _, err := r.VerifyFrom(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Chunk(chks[1].Ref); errors.Cause(err) != ErrTombstoned {
+		t.Fatalf("expected ErrTombstoned, got %v", err)
+	}
+	var refs []uint64
+	err = r.IterateOverlapping(math.MinInt64, math.MaxInt64, func(ref uint64, _ chunkenc.Chunk) error {
+		refs = append(refs, ref)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(refs) != 3 || refs[0] != chks[0].Ref || refs[1] != chks[2].Ref || refs[2] != chks[3].Ref {
+		t.Fatalf("unexpected chunks %v", refs)
+	}
+
+	// V1 segments have no footer to record tombstones in.
+	v1 := testChunks(t, 1, 10)
+	v1Dir, _ := writeTestDir(t, &WriterOptions{FormatVersion: chunksFormatV1}, v1)
+	defer os.RemoveAll(v1Dir)
+
+	if err := Tombstone(v1Dir, v1[0].Ref); err == nil {
+		t.Fatal("expected error for V1 segment")
+	}
+}
+
+func TestReaderRefresh(t *testing.T) {
+	chks := testChunks(t, 3, 10)
+	dir, _ := writeTestDir(t, &WriterOptions{SegmentSize: 1}, chks[:1])
+	defer os.RemoveAll(dir)
+
+	r, err := NewDirReader(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	if n, err := r.Refresh(); err != nil || n != 0 {
+		t.Fatalf("expected no added segments, got %d (%v)", n, err)
+	}
+
+	// A second Writer appends a segment for each chunk after the existing
+	// one. Its references count segments from its first one.
+	w, err := NewWriterWithOptions(dir, &WriterOptions{SegmentSize: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < len(chks); i++ {
+		if err := w.WriteChunks(chks[i : i+1]...); err != nil {
+			t.Fatal(err)
+		}
+		chks[i].Ref += 1 << 32
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Chunk(chks[2].Ref); err == nil {
+		t.Fatal("expected error for segment that was not opened yet")
+	}
+
+	// Refreshing concurrently to reads must not disturb them.
+	done := make(chan error)
+	go func() {
+		for i := 0; i < 100; i++ {
+			if _, err := r.Chunk(chks[0].Ref); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	n, err := r.Refresh()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("expected 2 added segments, got %d", n)
+	}
+	for i, chk := range chks {
+		c, err := r.Chunk(chk.Ref)
+		if err != nil {
+			t.Fatalf("chunk %d: %s", i, err)
+		}
+		if !bytes.Equal(c.Bytes(), chk.Chunk.Bytes()) {
+			t.Fatalf("chunk %d: data mismatch", i)
+		}
+	}
+
+	// Segments replaced underneath the Reader are rejected.
+	if err := os.Remove(r.files[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Refresh(); err == nil {
+		t.Fatal("expected error for removed segment")
+	}
+}
+
+func TestWriterPlaceholder(t *testing.T) {
+	for _, opts := range []WriterOptions{
+		{FormatVersion: chunksFormatV1},
+		{FormatVersion: chunksFormatV2},
+		{FormatVersion: chunksFormatV2, FixedFrameLength: true, CRCPlacement: CRCLeading, Alignment: 16},
+	} {
+		dir, err := ioutil.TempDir("", "test_placeholder")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		opts := opts
+		w, err := NewWriterWithOptions(dir, &opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chks := testChunks(t, 3, 10)
+		if err := w.WriteChunks(chks[:1]...); err != nil {
+			t.Fatal(err)
+		}
+		data := chks[1].Chunk.Bytes()
+		ref, err := w.ReservePlaceholder(len(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := w.WriteChunks(chks[2:]...); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.FillPlaceholder(ref, chunkenc.EncXOR, data[1:]); err == nil {
+			t.Fatal("expected error for data of different size")
+		}
+		if err := w.FillPlaceholder(ref, chunkenc.EncXOR, data); err != nil {
+			t.Fatal(err)
+		}
+		if mint, maxt := w.TimeBounds(); mint != chks[0].MinTime || maxt != chks[2].MaxTime {
+			t.Fatalf("unexpected time bounds [%d, %d]", mint, maxt)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		chks[1].Ref = ref
+
+		r, err := NewDirReader(dir, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := r.VerifyFrom(0, 0); err != nil {
+			t.Fatal(err)
+		}
+		for i, chk := range chks {
+			c, err := r.Chunk(chk.Ref)
+			if err != nil {
+				t.Fatalf("chunk %d: %s", i, err)
+			}
+			if !bytes.Equal(c.Bytes(), chk.Chunk.Bytes()) {
+				t.Fatalf("chunk %d: data mismatch", i)
+			}
+		}
+		if m := r.segs[0]; m.hasFooter && m.footer[1].enc != chunkenc.EncXOR {
+			t.Fatalf("expected footer encoding %s, got %s", chunkenc.EncXOR, m.footer[1].enc)
+		}
+		r.Close()
+	}
+
+	// Options processing the chunk data as it is written do not support
+	// placeholders.
+	dir, err := ioutil.TempDir("", "test_placeholder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	w, err := NewWriterWithOptions(dir, &WriterOptions{FormatVersion: chunksFormatV2, BindTimeRanges: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	if _, err := w.ReservePlaceholder(10); err == nil {
+		t.Fatal("expected error for BindTimeRanges")
+	}
+}
+
+func TestOverlayReader(t *testing.T) {
+	chks := testChunks(t, 3, 10)
+	baseDir, _ := writeTestDir(t, nil, chks)
+	defer os.RemoveAll(baseDir)
+
+	patches := testChunks(t, 1, 20)
+	patchDir, _ := writeTestDir(t, nil, patches)
+	defer os.RemoveAll(patchDir)
+
+	base, err := NewDirReader(baseDir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer base.Close()
+
+	patch, err := NewDirReader(patchDir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer patch.Close()
+
+	if _, err := NewOverlayReader(base, patch, map[uint64]uint64{chks[1].Ref: 5 << 32}, nil); err == nil {
+		t.Fatal("expected error for reference out of range")
+	}
+	ov, err := NewOverlayReader(base, patch, map[uint64]uint64{chks[1].Ref: patches[0].Ref}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, exp := range []Meta{chks[0], patches[0], chks[2]} {
+		c, err := ov.Chunk(chks[i].Ref)
+		if err != nil {
+			t.Fatalf("chunk %d: %s", i, err)
+		}
+		if !bytes.Equal(c.Bytes(), exp.Chunk.Bytes()) {
+			t.Fatalf("chunk %d: data mismatch", i)
+		}
+	}
+	if err := ov.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Closing the overlay leaves base and patch open and unchanged.
+	c, err := base.Chunk(chks[1].Ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(c.Bytes(), chks[1].Chunk.Bytes()) {
+		t.Fatal("base chunk changed by overlay")
+	}
+	if _, err := patch.Chunk(patches[0].Ref); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReaderRefreshConcurrentScan(t *testing.T) {
+	chks := testChunks(t, 20, 10)
+	dir, _ := writeTestDir(t, &WriterOptions{FormatVersion: chunksFormatV2, SegmentSize: 1}, chks[:1])
+	defer os.RemoveAll(dir)
+
+	r, err := NewDirReader(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Scans running concurrently to refreshes and the final Close must either
+	// see a consistent set of segments or fail because the Reader is closed.
+	scans := []func() error{
+		func() error { _, err := r.Stats(); return err },
+		func() error { _, _, err := r.VerifyFrom(0, 0); return err },
+		func() error { _, err := r.VerifyAll(2); return err },
+		func() error { _, err := r.FindCorrupt(); return err },
+		func() error { return r.Validate() },
+		func() error { _, err := r.LatestChunks(3); return err },
+		func() error {
+			return r.IterateOverlapping(math.MinInt64, math.MaxInt64, func(uint64, chunkenc.Chunk) error { return nil })
+		},
+		func() error { return r.IterateByTime(func(uint64, chunkenc.Chunk) error { return nil }) },
+		func() error {
+			// Callbacks may call back into the Reader.
+			return r.IterateRuns(func(_ chunkenc.Encoding, refs []uint64) error {
+				_, err := r.RefsDigest(refs)
+				return err
+			})
+		},
+	}
+	var (
+		stop = make(chan struct{})
+		errc = make(chan error, len(scans))
+	)
+	for _, scan := range scans {
+		go func(scan func() error) {
+			for {
+				select {
+				case <-stop:
+					errc <- nil
+					return
+				default:
+				}
+				if err := scan(); err != nil {
+					if errors.Cause(err) == errReaderClosed {
+						err = nil
+					}
+					errc <- err
+					return
+				}
+			}
+		}(scan)
+	}
+
+	// Every Writer appends a complete segment to the directory.
+	for i := 1; i < len(chks); i++ {
+		w, err := NewWriterWithOptions(dir, &WriterOptions{FormatVersion: chunksFormatV2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := w.WriteChunks(chks[i : i+1]...); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if n, err := r.Refresh(); err != nil || n != 1 {
+			t.Fatalf("expected 1 added segment, got %d (%v)", n, err)
+		}
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	close(stop)
+
+	for range scans {
+		if err := <-errc; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// countingPool counts the chunks it returns.
+type countingPool struct {
+	chunkenc.Pool
+	gets int
+}
+
+func (p *countingPool) Get(e chunkenc.Encoding, b []byte) (chunkenc.Chunk, error) {
+	p.gets++
+	return p.Pool.Get(e, b)
+}
+
+func TestReaderStats(t *testing.T) {
+	chks := testChunks(t, 4, 10)
+
+	v1Dir, _ := writeTestDir(t, &WriterOptions{FormatVersion: chunksFormatV1, SegmentSize: 1}, chks)
+	defer os.RemoveAll(v1Dir)
+	v2Dir, _ := writeTestDir(t, &WriterOptions{FormatVersion: chunksFormatV2, SegmentSize: 1}, chks)
+	defer os.RemoveAll(v2Dir)
+
+	stats := func(dir string) (ChunkStats, int) {
+		pool := &countingPool{Pool: chunkenc.NewPool()}
+		r, err := NewDirReader(dir, pool)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+
+		st, err := r.Stats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sampled, err := r.SampleStats(1, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if st.Chunks != sampled.Chunks || st.ChunkBytes != sampled.ChunkBytes || st.MinTime != sampled.MinTime || st.MaxTime != sampled.MaxTime {
+			t.Fatalf("stats %+v differ from sampled stats %+v", st, sampled)
+		}
+		return st, pool.gets - sampled.Chunks
+	}
+
+	v1, decoded := stats(v1Dir)
+	if decoded != len(chks) {
+		t.Fatalf("expected %d decoded chunks for V1, got %d", len(chks), decoded)
+	}
+	if v1.Segments != len(chks) || v1.Chunks != len(chks) || v1.Encodings[chunkenc.EncXOR] != len(chks) {
+		t.Fatalf("unexpected V1 stats %+v", v1)
+	}
+	if v1.MinTime != chks[0].MinTime || v1.MaxTime != chks[3].MaxTime {
+		t.Fatalf("unexpected V1 time range [%d, %d]", v1.MinTime, v1.MaxTime)
+	}
+
+	// Footers provide the time ranges without decoding any chunk.
+	v2, decoded := stats(v2Dir)
+	if decoded != 0 {
+		t.Fatalf("expected no decoded chunks for V2, got %d", decoded)
+	}
+	if v2.Chunks != v1.Chunks || v2.ChunkBytes != v1.ChunkBytes || v2.MinTime != v1.MinTime || v2.MaxTime != v1.MaxTime {
+		t.Fatalf("V2 stats %+v differ from V1 stats %+v", v2, v1)
+	}
+
+	// Tombstoned chunks are not counted.
+	if err := Tombstone(v2Dir, chks[3].Ref); err != nil {
+		t.Fatal(err)
+	}
+	st, _ := stats(v2Dir)
+	if st.Chunks != 3 || st.Encodings[chunkenc.EncXOR] != 3 || st.MaxTime != chks[2].MaxTime {
+		t.Fatalf("unexpected stats with tombstone %+v", st)
+	}
+}
+
+func TestReaderIter(t *testing.T) {
+	// iterate returns the references of all chunks yielded by a Reader of dir
+	// and their checksum errors.
+	iterate := func(dir string) ([]uint64, []error, error) {
+		r, err := NewDirReader(dir, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+
+		var (
+			refs []uint64
+			errs []error
+		)
+		it := r.Iter()
+		for it.Next() {
+			c, err := it.Chunk()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if it.CRCErr() == nil && !bytes.Equal(c.Bytes(), it.Data()) {
+				t.Fatalf("chunk %d: data mismatch", it.Ref())
+			}
+			refs = append(refs, it.Ref())
+			errs = append(errs, it.CRCErr())
+		}
+		return refs, errs, it.Err()
+	}
+	chks := testChunks(t, 6, 10)
+
+	t.Run("padding", func(t *testing.T) {
+		dir, _ := writeTestDir(t, &WriterOptions{FormatVersion: chunksFormatV1, SegmentSize: 100}, chks)
+		defer os.RemoveAll(dir)
+
+		// Zero padding left behind by pre-allocation ends the last segment.
+		files, err := sequenceFiles(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.OpenFile(files[len(files)-1], os.O_WRONLY|os.O_APPEND, 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write(make([]byte, 100)); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+		refs, errs, err := iterate(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) < 2 || len(refs) != len(chks) {
+			t.Fatalf("expected %d chunks in multiple segments, got %d in %d", len(chks), len(refs), len(files))
+		}
+		for i, chk := range chks {
+			if refs[i] != chk.Ref || errs[i] != nil {
+				t.Fatalf("chunk %d: expected reference %d, got %d (%v)", i, chk.Ref, refs[i], errs[i])
+			}
+		}
+	})
+
+	t.Run("checksum-mismatch", func(t *testing.T) {
+		dir, _ := writeTestDir(t, &WriterOptions{FormatVersion: chunksFormatV2}, chks)
+		defer os.RemoveAll(dir)
+
+		corruptChunk(t, dir, chks[2].Ref)
+
+		// Corrupted chunks are reported without stopping the iteration.
+		refs, errs, err := iterate(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(refs) != len(chks) {
+			t.Fatalf("expected %d chunks, got %d", len(chks), len(refs))
+		}
+		for i := range chks {
+			if i == 2 {
+				if cerr, ok := errs[i].(*CorruptionErr); !ok || errors.Cause(cerr.Err) != errInvalidChecksum {
+					t.Fatalf("chunk %d: expected checksum error, got %v", i, errs[i])
+				}
+				continue
+			}
+			if errs[i] != nil {
+				t.Fatalf("chunk %d: %s", i, errs[i])
+			}
+		}
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		dir, _ := writeTestDir(t, &WriterOptions{FormatVersion: chunksFormatV1}, chks)
+		defer os.RemoveAll(dir)
+
+		files, err := sequenceFiles(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, off := unpackRef(chks[len(chks)-1].Ref)
+		if err := os.Truncate(files[0], int64(off+5)); err != nil {
+			t.Fatal(err)
+		}
+		// The chunks before the truncated one are yielded before the
+		// iteration fails at it.
+		refs, _, err := iterate(dir)
+		if len(refs) != len(chks)-1 {
+			t.Fatalf("expected %d chunks, got %d", len(chks)-1, len(refs))
+		}
+		cerr, ok := err.(*CorruptionErr)
+		if !ok || cerr.Segment != 0 || cerr.Offset != int64(off) {
+			t.Fatalf("expected corruption at offset %d, got %v", off, err)
+		}
+	})
+}
+
+func TestDedupeSegmentsSidecars(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_dedupe_segments")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a, b := testChunks(t, 2, 50), testChunks(t, 3, 20)
+	// Segment 0 and the trailing segments 2 and 3 hold the same chunks.
+	groups := [][]Meta{a, b, append([]Meta(nil), a...), append([]Meta(nil), a...)}
+
+	w, err := NewWriterWithOptions(dir, &WriterOptions{WriteManifest: true, WriteSampleCountIndex: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, g := range groups {
+		if i > 0 {
+			if err := w.cut(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.WriteChunks(g...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	files, err := sequenceFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != len(groups) {
+		t.Fatalf("expected %d segments, got %d", len(groups), len(files))
+	}
+	names := make([]string, 0, len(files))
+	for _, fn := range files {
+		names = append(names, filepath.Base(fn))
+	}
+	if err := writeSegmentNames(dir, names); err != nil {
+		t.Fatal(err)
+	}
+
+	removed, remap, err := DedupeSegments(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(removed) != "[3 2]" {
+		t.Fatalf("expected removed segments [3 2], got %v", removed)
+	}
+	for _, g := range groups[2:] {
+		for i, c := range g {
+			if got, ok := remap[c.Ref]; !ok || got != a[i].Ref {
+				t.Fatalf("expected ref %d to map to %d, got %d (%t)", c.Ref, a[i].Ref, got, ok)
+			}
+		}
+	}
+
+	if err := VerifyManifest(dir); err != nil {
+		t.Fatalf("manifest: %s", err)
+	}
+	counts, err := LoadSampleCounts(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(counts) != len(a)+len(b) {
+		t.Fatalf("expected %d sample counts, got %d", len(a)+len(b), len(counts))
+	}
+	for ref := range counts {
+		if seq, _ := unpackRef(ref); seq >= 2 {
+			t.Fatalf("sample count of ref %d into removed segment %d", ref, seq)
+		}
+	}
+	total, indexed, err := TotalSamples(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := int64(len(a)*50 + len(b)*20); !indexed || total != exp {
+		t.Fatalf("expected %d indexed samples, got %d (indexed %t)", exp, total, indexed)
+	}
+	gotNames, err := readSegmentNames(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(gotNames) != fmt.Sprint(names[:2]) {
+		t.Fatalf("expected segment names %v, got %v", names[:2], gotNames)
+	}
+
+	r, err := NewDirReader(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	for _, g := range groups {
+		for _, c := range g {
+			ref := c.Ref
+			if m, ok := remap[ref]; ok {
+				ref = m
+			}
+			got, err := r.Chunk(ref)
+			if err != nil {
+				t.Fatalf("chunk %d: %s", ref, err)
+			}
+			if !bytes.Equal(got.Bytes(), c.Chunk.Bytes()) {
+				t.Fatalf("chunk %d: data mismatch", ref)
+			}
+		}
+	}
+}
+
+func TestSplitSegment(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_split_segment")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	w, err := NewWriterWithOptions(dir, &WriterOptions{
+		FormatVersion:  chunksFormatV2,
+		Alignment:      8,
+		BindTimeRanges: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	chks := testChunks(t, 6, 30)
+	for i := range chks {
+		var tags map[string]string
+		if i%2 == 0 {
+			tags = map[string]string{"chunk": fmt.Sprint(i)}
+		}
+		if chks[i].Ref, err = w.WriteChunkTagged(chks[i], tags); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := Tombstone(dir, chks[3].Ref); err != nil {
+		t.Fatal(err)
+	}
+
+	dst, err := ioutil.TempDir("", "test_split_segment_dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+
+	remap, err := SplitSegment(dir, 0, 200, dst, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(remap) != len(chks)-1 {
+		t.Fatalf("expected %d remapped chunks, got %d", len(chks)-1, len(remap))
+	}
+	if _, ok := remap[chks[3].Ref]; ok {
+		t.Fatal("tombstoned chunk was copied")
+	}
+
+	src, err := NewDirReader(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	r, err := NewDirReader(dst, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	if len(r.bs) < 2 {
+		t.Fatalf("expected several segments, got %d", len(r.bs))
+	}
+	if _, _, err := r.VerifyFrom(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	for i, c := range chks {
+		if i == 3 {
+			continue
+		}
+		ref := remap[c.Ref]
+
+		exp, err := src.Chunk(c.Ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := r.Chunk(ref)
+		if err != nil {
+			t.Fatalf("chunk %d: %s", i, err)
+		}
+		if !bytes.Equal(got.Bytes(), exp.Bytes()) {
+			t.Fatalf("chunk %d: data mismatch", i)
+		}
+		expTags, err := src.ChunkTags(c.Ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gotTags, err := r.ChunkTags(ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(gotTags) != fmt.Sprint(expTags) {
+			t.Fatalf("chunk %d: expected tags %v, got %v", i, expTags, gotTags)
+		}
+		seq, off := unpackRef(ref)
+		e, ok := r.segs[seq].footerEntry(off)
+		if !ok {
+			t.Fatalf("chunk %d: no footer entry", i)
+		}
+		if e.flags&footerFlagTimeRangeSum == 0 {
+			t.Fatalf("chunk %d: time range checksum not preserved", i)
+		}
+		if e.mint != c.MinTime || e.maxt != c.MaxTime {
+			t.Fatalf("chunk %d: expected time range [%d, %d], got [%d, %d]", i, c.MinTime, c.MaxTime, e.mint, e.maxt)
+		}
+	}
+	if r.segs[0].align != 8 {
+		t.Fatalf("expected alignment 8, got %d", r.segs[0].align)
+	}
+}
+
+func TestCopyChunksFrom(t *testing.T) {
+	chks := testChunks(t, 8, 30)
+	dir, _ := writeTestDir(t, &WriterOptions{FormatVersion: chunksFormatV2, SegmentSize: 300}, chks)
+	defer os.RemoveAll(dir)
+
+	if seq, _ := unpackRef(chks[len(chks)-1].Ref); seq < 2 {
+		t.Fatal("expected chunks in several segments")
+	}
+	if err := Tombstone(dir, chks[2].Ref); err != nil {
+		t.Fatal(err)
+	}
+
+	dstDir, err := ioutil.TempDir("", "test_copy_chunks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dstDir)
+
+	dst, err := NewWriterWithOptions(dstDir, &WriterOptions{SegmentSize: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := NewDirReader(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		calls      int
+		lastDone   int64
+		totalBytes = src.Size()
+	)
+	// Interrupt the copy by closing the Reader after the fourth chunk.
+	remap, seq, off, err := CopyChunksFrom(src, dst, 0, 0, func(done, total int64) {
+		if done < lastDone || total != totalBytes {
+			t.Errorf("unexpected progress %d/%d after %d", done, total, lastDone)
+		}
+		lastDone = done
+		if calls++; calls == 4 {
+			src.Close()
+		}
+	})
+	if errors.Cause(err) != errReaderClosed {
+		t.Fatalf("expected errReaderClosed, got %v", err)
+	}
+	if len(remap) == 0 || len(remap) >= len(chks)-1 {
+		t.Fatalf("expected a partial copy, got %d chunks", len(remap))
+	}
+
+	src, err = NewDirReader(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+
+	rest, seq, off, err := CopyChunksFrom(src, dst, seq, off, func(done, total int64) {
+		if done < lastDone || total != totalBytes {
+			t.Errorf("unexpected progress %d/%d after %d", done, total, lastDone)
+		}
+		lastDone = done
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seq != len(src.bs) || off != 0 {
+		t.Fatalf("expected copy to end at segment %d, got %d:%d", len(src.bs), seq, off)
+	}
+	if lastDone != totalBytes {
+		t.Fatalf("expected final progress %d, got %d", totalBytes, lastDone)
+	}
+	for ref, m := range rest {
+		if _, ok := remap[ref]; ok {
+			t.Fatalf("chunk %d copied twice", ref)
+		}
+		remap[ref] = m
+	}
+	if err := dst.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(remap) != len(chks)-1 {
+		t.Fatalf("expected %d copied chunks, got %d", len(chks)-1, len(remap))
+	}
+	if _, ok := remap[chks[2].Ref]; ok {
+		t.Fatal("tombstoned chunk was copied")
+	}
+
+	r, err := NewDirReader(dstDir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	for i, c := range chks {
+		if i == 2 {
+			continue
+		}
+		got, err := r.Chunk(remap[c.Ref])
+		if err != nil {
+			t.Fatalf("chunk %d: %s", i, err)
+		}
+		if !bytes.Equal(got.Bytes(), c.Chunk.Bytes()) {
+			t.Fatalf("chunk %d: data mismatch", i)
+		}
+	}
+}
+
+func TestReaderRefsDigest(t *testing.T) {
+	chks := testChunks(t, 4, 10)
+	baseDir, _ := writeTestDir(t, &WriterOptions{FormatVersion: chunksFormatV2}, chks)
+	defer os.RemoveAll(baseDir)
+
+	patches := testChunks(t, 1, 20)
+	patchDir, _ := writeTestDir(t, nil, patches)
+	defer os.RemoveAll(patchDir)
+
+	if err := Tombstone(baseDir, chks[3].Ref); err != nil {
+		t.Fatal(err)
+	}
+	base, err := NewDirReader(baseDir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer base.Close()
+	patch, err := NewDirReader(patchDir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer patch.Close()
+
+	refs := []uint64{chks[0].Ref, chks[1].Ref, chks[2].Ref}
+	d1, err := base.RefsDigest(refs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d2, err := base.RefsDigest([]uint64{chks[1].Ref, chks[0].Ref, chks[2].Ref})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d1 == d2 {
+		t.Fatal("expected the digest to depend on the order of refs")
+	}
+
+	if _, err := base.RefsDigest([]uint64{chks[3].Ref}); errors.Cause(err) != ErrTombstoned {
+		t.Fatalf("expected ErrTombstoned, got %v", err)
+	}
+	for _, off := range []uint64{0, SegmentHeaderSize - 1} {
+		if _, err := base.RefsDigest([]uint64{off}); err == nil {
+			t.Fatalf("expected error for offset %d within the segment header", off)
+		} else if _, ok := errors.Cause(err).(*CorruptionErr); !ok {
+			t.Fatalf("expected CorruptionErr for offset %d, got %v", off, err)
+		}
+	}
+
+	// Overridden references are digested like the patched chunks.
+	o, err := NewOverlayReader(base, patch, map[uint64]uint64{chks[1].Ref: patches[0].Ref}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.Close()
+
+	got, err := o.RefsDigest(refs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shifted := patches[0].Ref + uint64(len(base.bs))<<32
+	exp, err := o.RefsDigest([]uint64{chks[0].Ref, shifted, chks[2].Ref})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != exp {
+		t.Fatalf("expected digest %x of the patched chunks, got %x", exp, got)
+	}
+	if got == d1 {
+		t.Fatal("expected the override to change the digest")
+	}
+}
+
+func TestWriterExtendSidecars(t *testing.T) {
+	opts := &WriterOptions{SegmentSize: 256, WriteManifest: true, WriteSampleCountIndex: true}
+	first := testChunks(t, 6, 30)
+	dir, _ := writeTestDir(t, opts, first)
+	defer os.RemoveAll(dir)
+
+	files, err := sequenceFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := uint64(len(files)) << 32
+
+	// References of a Writer on a non-empty directory are relative to its
+	// first segment, while the sidecars use references into the directory.
+	second := testChunks(t, 2, 40)
+	w, err := NewWriterWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteChunks(second...); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func() {
+		t.Helper()
+
+		if err := VerifyManifest(dir); err != nil {
+			t.Fatalf("manifest: %s", err)
+		}
+		counts, err := LoadSampleCounts(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(counts) != len(first)+len(second) {
+			t.Fatalf("expected %d sample counts, got %d", len(first)+len(second), len(counts))
+		}
+		r, err := NewDirReader(dir, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+
+		for ref, n := range counts {
+			c, err := r.Chunk(ref)
+			if err != nil {
+				t.Fatalf("chunk %d: %s", ref, err)
+			}
+			if c.NumSamples() != int(n) {
+				t.Fatalf("chunk %d: expected %d samples, got %d", ref, c.NumSamples(), n)
+			}
+		}
+		for _, c := range second {
+			if n, ok := counts[c.Ref+base]; !ok || n != 40 {
+				t.Fatalf("chunk %d: expected 40 samples, got %d (%t)", c.Ref+base, n, ok)
+			}
+		}
+	}
+	check()
+
+	// An aborted Writer leaves the sidecars of the existing segments.
+	w, err = NewWriterWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteChunks(testChunks(t, 3, 10)...); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Abort(); err != nil {
+		t.Fatal(err)
+	}
+	check()
+
+	// Sidecars that do not cover the existing segments are not extended.
+	if err := os.Remove(filepath.Join(dir, manifestFilename)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewWriterWithOptions(dir, opts); err == nil {
+		t.Fatal("expected error for a directory without manifest")
+	}
+	w, err = NewWriterWithOptions(dir, &WriterOptions{WriteSampleCountIndex: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReaderPrefetchDecoded(t *testing.T) {
+	chks := testChunks(t, 3, 10)
+	baseDir, _ := writeTestDir(t, nil, chks)
+	defer os.RemoveAll(baseDir)
+
+	patches := testChunks(t, 1, 20)
+	patchDir, _ := writeTestDir(t, nil, patches)
+	defer os.RemoveAll(patchDir)
+
+	base, err := NewDirReaderWithOptions(baseDir, nil, &ReaderOptions{DecodedCacheSize: 1 << 20, MmapWithFallback: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer base.Close()
+	patch, err := NewDirReader(patchDir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer patch.Close()
+
+	ov, err := NewOverlayReader(base, patch, map[uint64]uint64{chks[1].Ref: patches[0].Ref}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ov.Close()
+
+	refs := []uint64{chks[0].Ref, chks[1].Ref}
+	// The overridden chunk is cached as the patched chunk it resolves to.
+	exp := []uint64{chks[0].Ref, patches[0].Ref + uint64(len(base.bs))<<32}
+
+	ov.PrefetchDecoded(refs)
+
+	cached := func(ref uint64) bool {
+		ov.cache.mtx.Lock()
+		defer ov.cache.mtx.Unlock()
+		_, ok := ov.cache.items[ref]
+		return ok
+	}
+	for deadline := time.Now().Add(5 * time.Second); !cached(exp[0]) || !cached(exp[1]); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("chunks were not prefetched")
+		}
+	}
+	if cached(chks[1].Ref) {
+		t.Fatal("overridden chunk of the base was prefetched")
+	}
+	for i, m := range []Meta{chks[0], patches[0]} {
+		c, err := ov.Chunk(refs[i])
+		if err != nil {
+			t.Fatalf("chunk %d: %s", i, err)
+		}
+		if !bytes.Equal(c.Bytes(), m.Chunk.Bytes()) {
+			t.Fatalf("chunk %d: data mismatch", i)
+		}
+	}
+}
+
+func TestReaderVerifyFromResume(t *testing.T) {
+	chks := testChunks(t, 12, 20)
+	dir, _ := writeTestDir(t, &WriterOptions{SegmentSize: 256}, chks)
+	defer os.RemoveAll(dir)
+
+	// Pick a chunk in the middle of the second segment.
+	var bad []int
+	for i, c := range chks {
+		if seq, _ := unpackRef(c.Ref); seq == 1 {
+			bad = append(bad, i)
+		}
+	}
+	if len(bad) < 3 {
+		t.Fatalf("expected at least 3 chunks in segment 1, got %d", len(bad))
+	}
+	i := bad[len(bad)/2]
+	_, badOff := unpackRef(chks[i].Ref)
+	_, nextOff := unpackRef(chks[i+1].Ref)
+	corruptChunk(t, dir, chks[i].Ref)
+
+	r, err := NewDirReader(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := len(r.bs)
+	if n < 3 {
+		t.Fatalf("expected at least 3 segments, got %d", n)
+	}
+
+	// A verified segment continues at the start of the next one.
+	seg, off, err := r.VerifyFrom(0, 0)
+	if err != nil || seg != 1 || off != 0 {
+		t.Fatalf("expected 1:0, got %d:%d (%v)", seg, off, err)
+	}
+	// A corrupted chunk stops verification at its offset.
+	seg, off, err = r.VerifyFrom(seg, off)
+	if cerr, ok := err.(*CorruptionErr); !ok || cerr.Segment != 1 || cerr.Offset != int64(badOff) {
+		t.Fatalf("expected corruption of chunk at 1:%d, got %v", badOff, err)
+	}
+	if seg != 1 || off != int64(badOff) {
+		t.Fatalf("expected 1:%d, got %d:%d", badOff, seg, off)
+	}
+	// Resuming at the same position fails again.
+	if seg, off, err = r.VerifyFrom(seg, off); err == nil || seg != 1 || off != int64(badOff) {
+		t.Fatalf("expected corruption at 1:%d again, got %d:%d (%v)", badOff, seg, off, err)
+	}
+	// Resuming after the corrupted chunk verifies the rest of the segment.
+	if seg, off, err = r.VerifyFrom(1, int64(nextOff)); err != nil || seg != 2 || off != 0 {
+		t.Fatalf("expected 2:0, got %d:%d (%v)", seg, off, err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once the chunk is repaired, resuming at the checkpoint completes the
+	// verification of all segments.
+	corruptChunk(t, dir, chks[i].Ref)
+
+	r, err = NewDirReader(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	seg, off = 1, int64(badOff)
+	for steps := 0; seg < n; steps++ {
+		if steps > n {
+			t.Fatal("verification does not advance")
+		}
+		if seg, off, err = r.VerifyFrom(seg, off); err != nil {
+			t.Fatal(err)
+		}
+		if off != 0 {
+			t.Fatalf("expected segment start, got %d:%d", seg, off)
+		}
+	}
+	if seg, off, err = r.VerifyFrom(n, 0); err != nil || seg != n || off != 0 {
+		t.Fatalf("expected completed verification at %d:0, got %d:%d (%v)", n, seg, off, err)
+	}
+	if _, _, err := r.VerifyFrom(n+1, 0); err == nil {
+		t.Fatal("expected error for segment out of range")
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunks
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/tsdb/chunkenc"
+)
+
+// SeriesRefsFunc returns the chunk references of every series of the block
+// whose chunks directory is dir. The references of a series must be ordered
+// by time.
+type SeriesRefsFunc func(dir string) (map[string][]uint64, error)
+
+// ChunksSemanticallyEqual reports whether the chunks directories aDir and
+// bDir hold the same samples for every series, regardless of how the samples
+// are split into chunks. Series are determined by the series callback.
+// Values are compared by their bit pattern, so NaNs compare equal to
+// themselves. If the samples differ, the first divergence is described.
+func ChunksSemanticallyEqual(aDir, bDir string, pool chunkenc.Pool, series SeriesRefsFunc) (bool, string, error) {
+	return ChunksSemanticallyEqualWithNaming(aDir, bDir, pool, series, nil)
+}
+
+// ChunksSemanticallyEqualWithNaming is like ChunksSemanticallyEqual but
+// matches the segments of both directories by naming, or NumericNaming if it
+// is nil.
+func ChunksSemanticallyEqualWithNaming(aDir, bDir string, pool chunkenc.Pool, series SeriesRefsFunc, naming NamingStrategy) (bool, string, error) {
+	aSeries, err := series(aDir)
+	if err != nil {
+		return false, "", errors.Wrapf(err, "series of %s", aDir)
+	}
+	bSeries, err := series(bDir)
+	if err != nil {
+		return false, "", errors.Wrapf(err, "series of %s", bDir)
+	}
+	ropts := &ReaderOptions{Naming: naming}
+
+	ar, err := NewDirReaderWithOptions(aDir, pool, ropts)
+	if err != nil {
+		return false, "", err
+	}
+	defer ar.Close()
+
+	br, err := NewDirReaderWithOptions(bDir, pool, ropts)
+	if err != nil {
+		return false, "", err
+	}
+	defer br.Close()
+
+	names := make([]string, 0, len(aSeries))
+	for s := range aSeries {
+		names = append(names, s)
+	}
+	for s := range bSeries {
+		if _, ok := aSeries[s]; !ok {
+			return false, fmt.Sprintf("series %s only in %s", s, bDir), nil
+		}
+	}
+	sort.Strings(names)
+
+	for _, s := range names {
+		bRefs, ok := bSeries[s]
+		if !ok {
+			return false, fmt.Sprintf("series %s only in %s", s, aDir), nil
+		}
+		ait := &seriesIterator{r: ar, refs: aSeries[s]}
+		bit := &seriesIterator{r: br, refs: bRefs}
+
+		for {
+			aok, bok := ait.Next(), bit.Next()
+			if ait.err != nil {
+				return false, "", errors.Wrapf(ait.err, "series %s of %s", s, aDir)
+			}
+			if bit.err != nil {
+				return false, "", errors.Wrapf(bit.err, "series %s of %s", s, bDir)
+			}
+			if !aok && !bok {
+				break
+			}
+			if !bok {
+				at, _ := ait.At()
+				return false, fmt.Sprintf("series %s: sample at %d only in %s", s, at, aDir), nil
+			}
+			if !aok {
+				bt, _ := bit.At()
+				return false, fmt.Sprintf("series %s: sample at %d only in %s", s, bt, bDir), nil
+			}
+			at, av := ait.At()
+			bt, bv := bit.At()
+			if at != bt {
+				return false, fmt.Sprintf("series %s: timestamp %d differs from %d", s, at, bt), nil
+			}
+			if math.Float64bits(av) != math.Float64bits(bv) {
+				return false, fmt.Sprintf("series %s at %d: value %v differs from %v", s, at, av, bv), nil
+			}
+		}
+	}
+	return true, "", nil
+}
+
+// seriesIterator iterates over the samples of a sequence of chunks.
+type seriesIterator struct {
+	r    *Reader
+	refs []uint64
+	cur  chunkenc.Iterator
+	err  error
+}
+
+func (it *seriesIterator) Next() bool {
+	for {
+		if it.cur != nil {
+			if it.cur.Next() {
+				return true
+			}
+			if it.err = it.cur.Err(); it.err != nil {
+				return false
+			}
+		}
+		if len(it.refs) == 0 {
+			return false
+		}
+		it.cur, it.err = it.r.ChunkIterator(it.refs[0], it.cur)
+		if it.err != nil {
+			it.err = errors.Wrapf(it.err, "chunk %d", it.refs[0])
+			return false
+		}
+		it.refs = it.refs[1:]
+	}
+}
+
+func (it *seriesIterator) At() (int64, float64) {
+	return it.cur.At()
+}
@@ -0,0 +1,123 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunks
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/csv"
+	"io"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/tsdb/chunkenc"
+)
+
+// ExportSegmentV1 writes segment index in the V1 format to w. For V2
+// segments the header is rewritten and the footer is dropped. The chunk
+// frames are copied unchanged, so references into the exported segment
+// resolve to the same chunks.
+//
+// V2 segments with header flags, e.g. encrypted or aligned segments, cannot
+// be represented in the V1 format and are rejected.
+func (s *Reader) ExportSegmentV1(index int, w io.Writer) error {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	if s.closed {
+		return errReaderClosed
+	}
+	if index < 0 || index >= len(s.bs) {
+		return errors.Errorf("segment %d out of range", index)
+	}
+	m := s.segs[index]
+	if m.err != nil {
+		return m.err
+	}
+	if m.flags != 0 {
+		return errors.Errorf("segment %d has header flags %x that V1 does not support", index, m.flags)
+	}
+	b := s.bs[index]
+	if b.Len() < SegmentHeaderSize {
+		return errors.Wrapf(errInvalidSize, "header of segment %d", index)
+	}
+
+	var h [SegmentHeaderSize]byte
+	binary.BigEndian.PutUint32(h[:MagicChunksSize], MagicChunks)
+	h[MagicChunksSize] = chunksFormatV1
+
+	if _, err := w.Write(h[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(b.Range(SegmentHeaderSize, m.dataEnd))
+	return err
+}
+
+// SampleFormat is a text format for samples written by WriteChunkSamples.
+type SampleFormat int
+
+const (
+	// SampleFormatLines writes a "<timestamp> <value>" line per sample.
+	SampleFormatLines SampleFormat = iota
+	// SampleFormatCSV writes a "timestamp,value" header followed by a
+	// record per sample.
+	SampleFormatCSV
+)
+
+// WriteChunkSamples writes the samples of c to w in the given format.
+// Timestamps are written as integers and values in the shortest
+// representation that parses back to the same value.
+func WriteChunkSamples(w io.Writer, c chunkenc.Chunk, format SampleFormat) error {
+	var (
+		bw  = bufio.NewWriter(w)
+		it  = c.Iterator()
+		buf []byte
+	)
+	switch format {
+	case SampleFormatLines:
+		for it.Next() {
+			t, v := it.At()
+			buf = strconv.AppendInt(buf[:0], t, 10)
+			buf = append(buf, ' ')
+			buf = strconv.AppendFloat(buf, v, 'g', -1, 64)
+			buf = append(buf, '\n')
+			if _, err := bw.Write(buf); err != nil {
+				return err
+			}
+		}
+	case SampleFormatCSV:
+		cw := csv.NewWriter(bw)
+		if err := cw.Write([]string{"timestamp", "value"}); err != nil {
+			return err
+		}
+		for it.Next() {
+			t, v := it.At()
+			if err := cw.Write([]string{strconv.FormatInt(t, 10), strconv.FormatFloat(v, 'g', -1, 64)}); err != nil {
+				return err
+			}
+		}
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			return err
+		}
+	default:
+		return errors.Errorf("unknown sample format %d", format)
+	}
+	// Samples read before an iterator error are still written.
+	ferr := bw.Flush()
+	if err := it.Err(); err != nil {
+		return errors.Wrap(err, "iterate chunk")
+	}
+	return ferr
+}
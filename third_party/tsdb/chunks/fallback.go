@@ -0,0 +1,104 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunks
+
+import (
+	"os"
+	"runtime/debug"
+	"sync/atomic"
+
+	"github.com/prometheus/tsdb/chunkenc"
+)
+
+// fallbackByteSlice is a memory-mapped segment that is read from its file
+// with ReadAt once accessing the mapping faulted.
+type fallbackByteSlice struct {
+	b []byte
+	f *os.File
+	// Non-zero once reads go to the file. Accessed atomically.
+	file int32
+}
+
+func (b *fallbackByteSlice) Len() int {
+	return len(b.b)
+}
+
+// Range returns the bytes [start, end) of the segment. Bytes that cannot be
+// read from the file, e.g. as it was truncated, are returned as zeros, which
+// surface as invalid frames or checksum mismatches.
+func (b *fallbackByteSlice) Range(start, end int) []byte {
+	if !b.viaFile() {
+		return b.b[start:end]
+	}
+	buf := make([]byte, end-start)
+	b.f.ReadAt(buf, int64(start))
+	return buf
+}
+
+func (b *fallbackByteSlice) viaFile() bool {
+	return atomic.LoadInt32(&b.file) != 0
+}
+
+// SegmentReadViaFile reports whether segment index is read with ReadAt as
+// accessing its memory mapping faulted. It is always false unless
+// MmapWithFallback is set.
+func (s *Reader) SegmentReadViaFile(index int) bool {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	if index < 0 || index >= len(s.bs) {
+		return false
+	}
+	fb, ok := s.bs[index].(*fallbackByteSlice)
+	return ok && fb.viaFile()
+}
+
+// loadChunkWithFallback is like loadChunk but switches the segment of ref to
+// reading from its file and retries if accessing the mapping faults. The
+// caller must hold the read lock.
+func (s *Reader) loadChunkWithFallback(ref uint64) (chunkenc.Chunk, error) {
+	seq, _ := unpackRef(ref)
+	if seq >= len(s.bs) {
+		return s.loadChunk(ref)
+	}
+	fb, ok := s.bs[seq].(*fallbackByteSlice)
+	if !ok || fb.viaFile() {
+		return s.loadChunk(ref)
+	}
+	c, faulted, err := s.loadChunkRecover(ref)
+	if !faulted {
+		return c, err
+	}
+	atomic.StoreInt32(&fb.file, 1)
+	return s.loadChunk(ref)
+}
+
+// loadChunkRecover calls loadChunk and reports whether it was aborted by a
+// memory fault. Other panics are propagated.
+func (s *Reader) loadChunkRecover(ref uint64) (c chunkenc.Chunk, faulted bool, err error) {
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		// Memory faults are reported as runtime errors with the faulting address.
+		if _, ok := r.(interface{ Addr() uintptr }); !ok {
+			panic(r)
+		}
+		faulted = true
+	}()
+	c, err = s.loadChunk(ref)
+	return c, false, err
+}
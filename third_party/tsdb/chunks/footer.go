@@ -0,0 +1,449 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunks
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/tsdb/chunkenc"
+)
+
+// Segments of format version 2 carry header flags in the bytes following the
+// version and end with a footer that indexes all chunks of the segment:
+//
+//   ┌─────────────────────┬──────────────────┬────────────┐
+//   │ magic <4b>          │ version(2) <1b>  │ flags <3b> │
+//   ├─────────────────────┴──────────────────┴────────────┤
+//   │                    chunk frames                     │
+//   ├─────────────────────────────────────────────────────┤
+//   │ #entries <uvarint>                                  │
+//   ├─────────────────────────────────────────────────────┤
+//   │ ┌─────────────────────────────────────────────────┐ │
+//   │ │ offset delta <uvarint>                          │ │
+//   │ ├─────────────────────────────────────────────────┤ │
+//   │ │ data length <uvarint>                           │ │
+//   │ ├─────────────────────────────────────────────────┤ │
+//   │ │ encoding <1b>                                   │ │
+//   │ ├─────────────────────────────────────────────────┤ │
+//   │ │ mint <varint>                                   │ │
+//   │ ├─────────────────────────────────────────────────┤ │
+//   │ │ maxt - mint <uvarint>                           │ │
+//   │ ├─────────────────────────────────────────────────┤ │
+//   │ │ entry flags <1b>                                │ │
+//   │ ├─────────────────────────────────────────────────┤ │
+//   │ │ time range CRC32 <4b> (optional)                │ │
+//   │ ├─────────────────────────────────────────────────┤ │
+//   │ │ tags <uvarint len + data> (optional)            │ │
+//   │ └─────────────────────────────────────────────────┘ │
+//   │                        . . .                        │
+//   ├─────────────────┬─────────────────┬─────────────────┤
+//   │ body len <4b>   │ body CRC32 <4b> │ magic <4b>      │
+//   └─────────────────┴─────────────────┴─────────────────┘
+//
+// The footer is written when the segment is finalized. A V2 segment without
+// a footer, e.g. one that is still being written, is read like a V1 segment.
+// The time range of an entry is the one declared by the chunk's Meta. Entries
+// with the footerFlagTimeRangeSum flag end with a checksum over the chunk's
+// frame checksum and its time range, see timeRangeSum. Entries with the
+// footerFlagTags flag end with the chunk's tags, see encodeChunkTags. Entries
+// with the footerFlagTombstone flag describe deleted chunks, see Tombstone.
+// The footer body of segments with the SegmentFlagDictCompressed flag starts
+// with the compression dictionary prefixed with its uvarint length, followed
+// by the number of entries.
+const (
+	chunksFormatV2 = 2
+
+	// MagicFooter is 4 bytes at the end of a V2 segment footer.
+	MagicFooter = 0x2F9C0D1E
+
+	footerTrailerSize = 12
+	// knownSegmentFlags holds all header flags defined for V2 segments.
+	knownSegmentFlags = SegmentFlagEncrypted | SegmentFlagFixedFrameLength | SegmentFlagLeadingCRC | SegmentFlagDictCompressed | segmentAlignmentMask | segmentCRCIntervalMask
+
+	// maxFooterEntrySize is the maximum encoded size of a footer entry.
+	maxFooterEntrySize = 3*binary.MaxVarintLen64 + MaxChunkLengthFieldSize + ChunkEncodingSize + 1 + crc32Size
+)
+
+// Flags of footer entries.
+const (
+	// footerFlagTimeRangeSum is set if the entry has a time range checksum.
+	footerFlagTimeRangeSum byte = 1 << iota
+	// footerFlagTags is set if the entry has tags.
+	footerFlagTags
+	// footerFlagTombstone is set if the chunk was deleted.
+	footerFlagTombstone
+)
+
+// Header flags of V2 segments.
+const (
+	// SegmentFlagEncrypted is set if the chunk data of a segment is encrypted.
+	SegmentFlagEncrypted uint32 = 1 << iota
+	// SegmentFlagFixedFrameLength is set if every chunk frame of a segment
+	// starts with a 4 byte big-endian length of the remainder of the frame.
+	SegmentFlagFixedFrameLength
+	// SegmentFlagLeadingCRC is set if the checksum of every chunk frame of a
+	// segment precedes the chunk data instead of following it.
+	SegmentFlagLeadingCRC
+	// SegmentFlagDictCompressed is set if chunks of a segment may be
+	// compressed with a dictionary stored in the segment footer.
+	SegmentFlagDictCompressed
+)
+
+// frameLengthSize is the size of the frame length field of segments with
+// fixed frame lengths.
+const frameLengthSize = 4
+
+const (
+	// The log2 of the chunk data alignment of a segment is stored in 4 bits
+	// of the header flags. Zero means chunk data is not aligned.
+	segmentAlignmentShift = 16
+	segmentAlignmentMask  = 0xf << segmentAlignmentShift
+
+	// MaxAlignment is the largest supported chunk data alignment.
+	MaxAlignment = 4096
+)
+
+// zeroPadding is written to align chunk data.
+var zeroPadding [MaxAlignment]byte
+
+// SegmentAlignment returns the chunk data alignment encoded in the header
+// flags of a segment. It is 1 for segments without alignment.
+func SegmentAlignment(flags uint32) int {
+	return 1 << ((flags & segmentAlignmentMask) >> segmentAlignmentShift)
+}
+
+// alignmentFlags returns the header flags encoding alignment a,
+// which must be a power of two.
+func alignmentFlags(a int) uint32 {
+	var log2 uint32
+	for ; 1<<log2 < a; log2++ {
+	}
+	return log2 << segmentAlignmentShift
+}
+
+// alignPadding returns the number of bytes needed to advance off to the
+// next multiple of a.
+func alignPadding(off, a int) int {
+	return (a - off%a) % a
+}
+
+// putSegmentFlags writes the 3 byte header flags field.
+func putSegmentFlags(b []byte, flags uint32) {
+	b[0], b[1], b[2] = byte(flags>>16), byte(flags>>8), byte(flags)
+}
+
+// footerEntry describes a single chunk of a segment as recorded in its footer.
+type footerEntry struct {
+	off        int // Offset of the chunk frame.
+	length     int // Length of the chunk data.
+	enc        chunkenc.Encoding
+	mint, maxt int64
+	flags      byte
+	// Time range checksum if footerFlagTimeRangeSum is set.
+	sum uint32
+	// Encoded tags including their length if footerFlagTags is set.
+	tags []byte
+}
+
+// footerBuilder accumulates the footer of the segment being written.
+type footerBuilder struct {
+	buf     []byte
+	n       int
+	lastOff int
+	// Position of the encoding of the last added entry in buf.
+	lastEncPos int
+	// The compression dictionary is encoded if hasDict is set.
+	hasDict bool
+	dict    []byte
+}
+
+// footerEntry returns the footer entry of the chunk at offset off of the
+// segment. ok is false if the segment has no footer or no chunk at off.
+func (m *segmentMeta) footerEntry(off int) (e footerEntry, ok bool) {
+	i := sort.Search(len(m.footer), func(i int) bool {
+		return m.footer[i].off >= off
+	})
+	if i == len(m.footer) || m.footer[i].off != off {
+		return footerEntry{}, false
+	}
+	return m.footer[i], true
+}
+
+func (fb *footerBuilder) reset() {
+	fb.buf = fb.buf[:0]
+	fb.n = 0
+	fb.lastOff = 0
+	fb.lastEncPos = 0
+	fb.dict = fb.dict[:0]
+}
+
+func (fb *footerBuilder) add(e footerEntry) {
+	var b [binary.MaxVarintLen64]byte
+
+	fb.buf = append(fb.buf, b[:binary.PutUvarint(b[:], uint64(e.off-fb.lastOff))]...)
+	fb.buf = append(fb.buf, b[:binary.PutUvarint(b[:], uint64(e.length))]...)
+	fb.lastEncPos = len(fb.buf)
+	fb.buf = append(fb.buf, byte(e.enc))
+	fb.buf = append(fb.buf, b[:binary.PutVarint(b[:], e.mint)]...)
+	// Deltas wrap around for open chunks, which is reversed when decoding.
+	fb.buf = append(fb.buf, b[:binary.PutUvarint(b[:], uint64(e.maxt-e.mint))]...)
+	fb.buf = append(fb.buf, e.flags)
+	if e.flags&footerFlagTimeRangeSum != 0 {
+		binary.BigEndian.PutUint32(b[:], e.sum)
+		fb.buf = append(fb.buf, b[:crc32Size]...)
+	}
+	fb.buf = append(fb.buf, e.tags...)
+
+	fb.n++
+	fb.lastOff = e.off
+}
+
+// size returns the encoded size of the footer including its trailer.
+func (fb *footerBuilder) size() int64 {
+	size := int64(binary.MaxVarintLen32 + len(fb.buf) + footerTrailerSize)
+	if fb.hasDict {
+		size += int64(binary.MaxVarintLen32 + len(fb.dict))
+	}
+	return size
+}
+
+// encode returns the encoded footer.
+func (fb *footerBuilder) encode() []byte {
+	var b [binary.MaxVarintLen64]byte
+
+	body := make([]byte, 0, fb.size())
+	if fb.hasDict {
+		body = append(body, b[:binary.PutUvarint(b[:], uint64(len(fb.dict)))]...)
+		body = append(body, fb.dict...)
+	}
+	body = append(body, b[:binary.PutUvarint(b[:], uint64(fb.n))]...)
+	body = append(body, fb.buf...)
+
+	l := len(body)
+	body = body[:l+footerTrailerSize]
+	binary.BigEndian.PutUint32(body[l:], uint32(l))
+	binary.BigEndian.PutUint32(body[l+4:], crc32Checksum(body[:l]))
+	binary.BigEndian.PutUint32(body[l+8:], MagicFooter)
+	return body
+}
+
+// timeRangeSum returns the checksum binding the time range declared for a
+// chunk to its frame checksum sum.
+func timeRangeSum(sum []byte, mint, maxt int64) uint32 {
+	var b [crc32Size + 16]byte
+	copy(b[:], sum)
+	binary.BigEndian.PutUint64(b[crc32Size:], uint64(mint))
+	binary.BigEndian.PutUint64(b[crc32Size+8:], uint64(maxt))
+	return crc32.Checksum(b[:], castagnoliTable)
+}
+
+// crc32Checksum returns the checksum of b using the package's polynomial.
+func crc32Checksum(b []byte) uint32 {
+	h := newCRC32()
+	h.Write(b)
+	return h.Sum32()
+}
+
+// readFooter reads the footer at the end of segment b with the given header
+// flags. It returns the start of the footer and ok=false if the segment has
+// none. The returned dictionary aliases b.
+//
+// Trailing zero bytes after the footer are skipped. They remain if the file
+// was not truncated to its written size after pre-allocation, e.g. because
+// the Writer crashed in between, and in segments stored as sparse files the
+// apparent file size includes such never written holes. The chunk frames
+// themselves always end at the first zero length, independent of the size.
+func readFooter(b ByteSlice, flags uint32) (entries []footerEntry, dict []byte, start int, ok bool, err error) {
+	end := b.Len()
+	if end < SegmentHeaderSize+footerTrailerSize {
+		return nil, nil, 0, false, nil
+	}
+	t := b.Range(end-footerTrailerSize, end)
+	if binary.BigEndian.Uint32(t[8:]) != MagicFooter {
+		if t[footerTrailerSize-1] != 0 {
+			return nil, nil, 0, false, nil
+		}
+		end = trimTrailingZeros(b, SegmentHeaderSize)
+		if end < SegmentHeaderSize+footerTrailerSize {
+			return nil, nil, 0, false, nil
+		}
+		t = b.Range(end-footerTrailerSize, end)
+		if binary.BigEndian.Uint32(t[8:]) != MagicFooter {
+			return nil, nil, 0, false, nil
+		}
+	}
+	l := int(binary.BigEndian.Uint32(t[:4]))
+	if l > end-SegmentHeaderSize-footerTrailerSize {
+		return nil, nil, 0, false, errors.Wrapf(errInvalidSize, "footer length %d", l)
+	}
+	start = end - footerTrailerSize - l
+	body := b.Range(start, start+l)
+
+	if crc := crc32Checksum(body); crc != binary.BigEndian.Uint32(t[4:8]) {
+		return nil, nil, 0, false, errors.Wrap(errInvalidChecksum, "footer")
+	}
+	if flags&SegmentFlagDictCompressed != 0 {
+		d := footerDecbuf{b: body}
+		dict = d.uvarintBytes()
+		if d.err != nil {
+			return nil, nil, 0, false, errors.Wrap(d.err, "read compression dictionary")
+		}
+		body = d.b
+	}
+	entries, err = decodeFooterEntries(body)
+	if err != nil {
+		return nil, nil, 0, false, err
+	}
+	return entries, dict, start, true, nil
+}
+
+// trimTrailingZeros returns the length of b without its trailing zero bytes,
+// but at least min.
+func trimTrailingZeros(b ByteSlice, min int) int {
+	end := b.Len()
+	for end > min {
+		start := end - len(zeroPadding)
+		if start < min {
+			start = min
+		}
+		r := b.Range(start, end)
+		if !bytes.Equal(r, zeroPadding[:len(r)]) {
+			i := len(r) - 1
+			for r[i] == 0 {
+				i--
+			}
+			return start + i + 1
+		}
+		end = start
+	}
+	return min
+}
+
+// decodeFooterEntries decodes the entries of the footer body b.
+func decodeFooterEntries(b []byte) ([]footerEntry, error) {
+	d := footerDecbuf{b: b}
+
+	n := d.uvarint()
+	if d.err != nil {
+		return nil, d.err
+	}
+	if n > uint64(len(b)) {
+		return nil, errors.Wrapf(errInvalidSize, "%d footer entries", n)
+	}
+	entries := make([]footerEntry, 0, n)
+	off := 0
+
+	for i := uint64(0); i < n; i++ {
+		var e footerEntry
+
+		off += int(d.uvarint())
+		e.off = off
+		e.length = int(d.uvarint())
+		e.enc = chunkenc.Encoding(d.byte())
+		e.mint = d.varint()
+		e.maxt = e.mint + int64(d.uvarint())
+		e.flags = d.byte()
+		if e.flags&footerFlagTimeRangeSum != 0 {
+			e.sum = d.uint32()
+		}
+		if e.flags&footerFlagTags != 0 {
+			start := d.b
+			d.uvarintBytes()
+			e.tags = start[:len(start)-len(d.b)]
+		}
+
+		if d.err != nil {
+			return nil, errors.Wrapf(d.err, "footer entry %d", i)
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// footerDecbuf decodes footer fields and records the first error.
+type footerDecbuf struct {
+	b   []byte
+	err error
+}
+
+func (d *footerDecbuf) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	x, n := binary.Uvarint(d.b)
+	if n <= 0 {
+		d.err = errors.Wrap(errInvalidSize, "read uvarint")
+		return 0
+	}
+	d.b = d.b[n:]
+	return x
+}
+
+func (d *footerDecbuf) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	x, n := binary.Varint(d.b)
+	if n <= 0 {
+		d.err = errors.Wrap(errInvalidSize, "read varint")
+		return 0
+	}
+	d.b = d.b[n:]
+	return x
+}
+
+func (d *footerDecbuf) byte() byte {
+	if d.err != nil {
+		return 0
+	}
+	if len(d.b) < 1 {
+		d.err = errors.Wrap(errInvalidSize, "read byte")
+		return 0
+	}
+	x := d.b[0]
+	d.b = d.b[1:]
+	return x
+}
+
+func (d *footerDecbuf) uint32() uint32 {
+	if d.err != nil {
+		return 0
+	}
+	if len(d.b) < 4 {
+		d.err = errors.Wrap(errInvalidSize, "read uint32")
+		return 0
+	}
+	x := binary.BigEndian.Uint32(d.b)
+	d.b = d.b[4:]
+	return x
+}
+
+// uvarintBytes returns the next field prefixed with its uvarint length.
+func (d *footerDecbuf) uvarintBytes() []byte {
+	l := d.uvarint()
+	if d.err != nil {
+		return nil
+	}
+	if l > uint64(len(d.b)) {
+		d.err = errors.Wrap(errInvalidSize, "read length prefixed field")
+		return nil
+	}
+	x := d.b[:l]
+	d.b = d.b[l:]
+	return x
+}
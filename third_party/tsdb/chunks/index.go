@@ -0,0 +1,145 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunks
+
+import (
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/tsdb/chunkenc"
+)
+
+// ErrUnalignedRef is returned with StrictOffsets set for references whose
+// offset is not the start of a chunk. Use errors.Cause to match it.
+var ErrUnalignedRef = errors.New("reference is not aligned to a chunk")
+
+// SegmentIndexEntry describes the position of a single chunk in a segment.
+type SegmentIndexEntry struct {
+	// Offset of the chunk within the segment.
+	Offset int64
+	// Length of the stored chunk data.
+	Length int
+	// Encoding of the chunk.
+	Encoding chunkenc.Encoding
+}
+
+// SegmentIndex holds the chunk boundaries of a segment, so that they do not
+// have to be determined again by scanning the segment.
+type SegmentIndex struct {
+	segment int
+	entries []SegmentIndexEntry // Sorted by offset.
+}
+
+// BuildSegmentIndex scans the given segment once and returns an in-memory
+// index of its chunks.
+func (s *Reader) BuildSegmentIndex(segment int) (*SegmentIndex, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	if s.closed {
+		return nil, errReaderClosed
+	}
+	return s.buildSegmentIndex(segment)
+}
+
+// buildSegmentIndex is like BuildSegmentIndex. The caller must hold the read
+// lock.
+func (s *Reader) buildSegmentIndex(segment int) (*SegmentIndex, error) {
+	if segment < 0 || segment >= len(s.bs) {
+		return nil, errors.Errorf("segment %d out of range", segment)
+	}
+	if err := s.segs[segment].err; err != nil {
+		return nil, err
+	}
+	idx := &SegmentIndex{segment: segment}
+
+	err := s.scanSegment(segment, func(f chunkFrame) error {
+		_, off := unpackRef(f.ref)
+		idx.entries = append(idx.entries, SegmentIndexEntry{
+			Offset:   int64(off),
+			Length:   len(f.data),
+			Encoding: s.segs[segment].chunkEncoding(f.enc),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// Segment returns the index of the segment described by the SegmentIndex.
+func (i *SegmentIndex) Segment() int {
+	return i.segment
+}
+
+// Entries returns all chunks of the segment ordered by offset. The returned
+// slice must not be modified.
+func (i *SegmentIndex) Entries() []SegmentIndexEntry {
+	return i.entries
+}
+
+// Refs returns the references of all chunks of the segment in order.
+func (i *SegmentIndex) Refs() []uint64 {
+	refs := make([]uint64, 0, len(i.entries))
+	for _, e := range i.entries {
+		refs = append(refs, packRef(i.segment, int(e.Offset)))
+	}
+	return refs
+}
+
+// Lookup returns the reference of the chunk starting at the given offset.
+// It returns ok=false if no chunk starts at offset.
+func (i *SegmentIndex) Lookup(offset int64) (ref uint64, ok bool) {
+	j := sort.Search(len(i.entries), func(j int) bool {
+		return i.entries[j].Offset >= offset
+	})
+	if j == len(i.entries) || i.entries[j].Offset != offset {
+		return 0, false
+	}
+	return packRef(i.segment, int(offset)), true
+}
+
+// strictIndex is the lazily built index of a segment used to check
+// references with StrictOffsets set.
+type strictIndex struct {
+	idx *SegmentIndex
+	err error
+}
+
+// checkAligned returns ErrUnalignedRef if no chunk starts at offset off of
+// segment seq. The index of the segment is built on first use. The caller
+// must hold the read lock.
+func (s *Reader) checkAligned(seq, off int) error {
+	s.strictMtx.Lock()
+	defer s.strictMtx.Unlock()
+
+	si, ok := s.strict[seq]
+	if !ok {
+		idx, err := s.buildSegmentIndex(seq)
+		si = strictIndex{idx: idx, err: errors.Wrapf(err, "build index of segment %d", seq)}
+
+		if s.strict == nil {
+			s.strict = map[int]strictIndex{}
+		}
+		s.strict[seq] = si
+	}
+	if si.err != nil {
+		return si.err
+	}
+	if _, ok := si.idx.Lookup(int64(off)); !ok {
+		return errors.Wrapf(ErrUnalignedRef, "chunk %d", packRef(seq, off))
+	}
+	return nil
+}
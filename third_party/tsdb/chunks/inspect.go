@@ -0,0 +1,137 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunks
+
+import (
+	"github.com/pkg/errors"
+)
+
+// InspectOptions control the level of detail of Inspect.
+type InspectOptions struct {
+	// Chunks lists every chunk of every segment.
+	Chunks bool
+	// TimeRanges decodes every listed chunk to determine its time range.
+	TimeRanges bool
+	// Naming determines which files of the directory are segments. It
+	// defaults to NumericNaming.
+	Naming NamingStrategy
+}
+
+// InspectResult describes a chunk directory. It can be marshalled to JSON
+// directly.
+type InspectResult struct {
+	Dir      string           `json:"dir"`
+	Size     int64            `json:"size"`
+	Segments []InspectSegment `json:"segments"`
+	// Valid is set if the structural validation of all segments passed.
+	Valid bool `json:"valid"`
+	// Error describes the first structural problem found if not valid.
+	Error string `json:"error,omitempty"`
+}
+
+// InspectSegment describes a single segment of a chunk directory.
+type InspectSegment struct {
+	Index         int    `json:"index"`
+	File          string `json:"file"`
+	Size          int64  `json:"size"`
+	FormatVersion int    `json:"formatVersion"`
+	Flags         uint32 `json:"flags,omitempty"`
+	HasFooter     bool   `json:"hasFooter,omitempty"`
+	NumChunks     int    `json:"numChunks"`
+	// Chunks of the segment if requested.
+	Chunks []InspectChunk `json:"chunks,omitempty"`
+	// Error describes why the segment could not be read completely.
+	Error string `json:"error,omitempty"`
+}
+
+// InspectChunk describes a single chunk of a segment.
+type InspectChunk struct {
+	Ref      uint64 `json:"ref"`
+	Offset   int64  `json:"offset"`
+	Length   int    `json:"length"`
+	Encoding string `json:"encoding"`
+	// Time range of the chunk's samples if requested and the chunk is not empty.
+	MinTime *int64 `json:"minTime,omitempty"`
+	MaxTime *int64 `json:"maxTime,omitempty"`
+}
+
+// Inspect describes the segments of the chunk directory dir. Segments that
+// cannot be opened or scanned are reported in the result rather than
+// failing the inspection. An error is only returned if dir cannot be read.
+func Inspect(dir string, opts InspectOptions) (InspectResult, error) {
+	r, serrs, err := NewDirReaderBestEffortWithOptions(dir, nil, &ReaderOptions{Naming: opts.Naming})
+	if err != nil {
+		return InspectResult{}, errors.Wrap(err, "open chunk directory")
+	}
+	defer r.Close()
+
+	res := InspectResult{
+		Dir:      dir,
+		Size:     r.Size(),
+		Segments: make([]InspectSegment, 0, len(r.bs)),
+	}
+	for seq, b := range r.bs {
+		m := r.segs[seq]
+		is := InspectSegment{
+			Index:         seq,
+			File:          r.files[seq],
+			Size:          int64(b.Len()),
+			FormatVersion: int(m.version),
+			Flags:         m.flags,
+			HasFooter:     m.hasFooter,
+		}
+		if m.err != nil {
+			is.Error = m.err.Error()
+			res.Segments = append(res.Segments, is)
+			continue
+		}
+		err := r.scanSegment(seq, func(f chunkFrame) error {
+			is.NumChunks++
+			if !opts.Chunks {
+				return nil
+			}
+			_, off := unpackRef(f.ref)
+			ic := InspectChunk{
+				Ref:      f.ref,
+				Offset:   int64(off),
+				Length:   len(f.data),
+				Encoding: m.chunkEncoding(f.enc).String(),
+			}
+			if opts.TimeRanges {
+				mint, maxt, ok, err := r.frameTimeRange(seq, f)
+				if err != nil {
+					return err
+				}
+				if ok {
+					ic.MinTime, ic.MaxTime = &mint, &maxt
+				}
+			}
+			is.Chunks = append(is.Chunks, ic)
+			return nil
+		})
+		if err != nil {
+			is.Error = err.Error()
+		}
+		res.Segments = append(res.Segments, is)
+	}
+
+	if len(serrs) > 0 {
+		res.Error = serrs[0].Error()
+	} else if err := r.Validate(); err != nil {
+		res.Error = err.Error()
+	}
+	res.Valid = res.Error == ""
+
+	return res, nil
+}
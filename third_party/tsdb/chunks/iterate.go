@@ -0,0 +1,535 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunks
+
+import (
+	"container/heap"
+	"hash"
+	"math"
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/tsdb/chunkenc"
+)
+
+// IterateOverlapping calls fn for every chunk whose time range overlaps the
+// closed interval [mint, maxt], in segment order.
+//
+// For segments with a footer the stored time ranges are used and only
+// overlapping chunks are decoded. Chunks of all other segments have to be
+// decoded to determine their time range.
+func (s *Reader) IterateOverlapping(mint, maxt int64, fn func(ref uint64, c chunkenc.Chunk) error) error {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	if s.closed {
+		return errReaderClosed
+	}
+	for seq := range s.bs {
+		if s.segs[seq].hasFooter {
+			if err := s.iterateOverlappingFooter(seq, mint, maxt, fn); err != nil {
+				return err
+			}
+			continue
+		}
+		err := s.scanSegment(seq, func(f chunkFrame) error {
+			c, err := s.scanDecode(seq, f)
+			if err != nil {
+				return errors.Wrapf(err, "decode chunk %d", f.ref)
+			}
+			cmint, cmaxt, ok, err := chunkTimeRange(c)
+			if err != nil {
+				return errors.Wrapf(err, "iterate chunk %d", f.ref)
+			}
+			if !ok || !(&Meta{MinTime: cmint, MaxTime: cmaxt}).OverlapsClosedInterval(mint, maxt) {
+				return s.pool.Put(c)
+			}
+			return s.unlocked(func() error { return fn(f.ref, c) })
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Reader) iterateOverlappingFooter(seq int, mint, maxt int64, fn func(ref uint64, c chunkenc.Chunk) error) error {
+	for _, e := range s.segs[seq].footer {
+		if e.flags&footerFlagTombstone != 0 {
+			continue
+		}
+		if !(&Meta{MinTime: e.mint, MaxTime: e.maxt}).OverlapsClosedInterval(mint, maxt) {
+			continue
+		}
+		ref := packRef(seq, e.off)
+
+		if err := s.waitDecode(e.length); err != nil {
+			return err
+		}
+		c, err := s.chunk(ref)
+		if err != nil {
+			return errors.Wrapf(err, "read chunk %d", ref)
+		}
+		if err := s.unlocked(func() error { return fn(ref, c) }); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LatestChunks returns the n chunks with the highest MaxTime across all
+// segments, ordered by descending MaxTime.
+//
+// For segments with a footer the stored time ranges are used, so that only
+// the returned chunks are decoded. For all other segments every chunk has to
+// be decoded to determine its time range, which makes the call as expensive
+// as a full scan of those segments. Tombstoned chunks are skipped.
+func (s *Reader) LatestChunks(n int) ([]Meta, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	if s.closed {
+		return nil, errReaderClosed
+	}
+	h := make(latestHeap, 0, n)
+
+	// push adds m to the heap if it is among the n latest chunks seen so far.
+	push := func(m Meta) {
+		if len(h) < n {
+			heap.Push(&h, m)
+			return
+		}
+		if !h.after(m, h[0]) {
+			s.putChunk(m.Chunk)
+			return
+		}
+		s.putChunk(h[0].Chunk)
+		h[0] = m
+		heap.Fix(&h, 0)
+	}
+	for seq := range s.bs {
+		if s.segs[seq].hasFooter {
+			for _, e := range s.segs[seq].footer {
+				if e.flags&footerFlagTombstone != 0 {
+					continue
+				}
+				push(Meta{Ref: packRef(seq, e.off), MinTime: e.mint, MaxTime: e.maxt})
+			}
+			continue
+		}
+		err := s.scanSegment(seq, func(f chunkFrame) error {
+			c, err := s.scanDecode(seq, f)
+			if err != nil {
+				return errors.Wrapf(err, "decode chunk %d", f.ref)
+			}
+			mint, maxt, ok, err := chunkTimeRange(c)
+			if err != nil {
+				return errors.Wrapf(err, "iterate chunk %d", f.ref)
+			}
+			if !ok {
+				return s.pool.Put(c)
+			}
+			push(Meta{Ref: f.ref, Chunk: c, MinTime: mint, MaxTime: maxt})
+			return nil
+		})
+		if err != nil {
+			for _, m := range h {
+				s.putChunk(m.Chunk)
+			}
+			return nil, err
+		}
+	}
+
+	res := []Meta(h)
+	sort.Slice(res, func(i, j int) bool { return h.after(res[i], res[j]) })
+
+	for i := range res {
+		if res[i].Chunk != nil {
+			continue
+		}
+		seq, f, err := s.lookupFrame(res[i].Ref)
+		if err != nil {
+			return nil, errors.Wrapf(err, "read chunk %d", res[i].Ref)
+		}
+		c, err := s.scanDecode(seq, f)
+		if err != nil {
+			return nil, errors.Wrapf(err, "decode chunk %d", res[i].Ref)
+		}
+		res[i].Chunk = c
+	}
+	return res, nil
+}
+
+// AllMeta returns the reference and time range of every chunk in segment
+// order, without their data. For segments with a footer the stored time
+// ranges are used and no chunk is read. Segments without a footer, i.e. V1
+// segments and V2 segments that were not finalized, cause an error unless
+// DecodeMetaFallback is set, in which case their chunks are decoded. Chunks
+// without samples are then recorded as covering all time. Tombstoned chunks
+// are skipped.
+func (s *Reader) AllMeta() ([]Meta, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	if s.closed {
+		return nil, errReaderClosed
+	}
+	var metas []Meta
+
+	for seq := range s.bs {
+		m := &s.segs[seq]
+		if m.err != nil {
+			return nil, m.err
+		}
+		if m.hasFooter {
+			for _, e := range m.footer {
+				if e.flags&footerFlagTombstone != 0 {
+					continue
+				}
+				metas = append(metas, Meta{Ref: packRef(seq, e.off), MinTime: e.mint, MaxTime: e.maxt})
+			}
+			continue
+		}
+		if !s.opts.DecodeMetaFallback {
+			return nil, errors.Errorf("segment %d has no footer", seq)
+		}
+		err := s.scanSegment(seq, func(f chunkFrame) error {
+			mint, maxt, ok, err := s.frameTimeRange(seq, f)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				mint, maxt = math.MinInt64, math.MaxInt64
+			}
+			metas = append(metas, Meta{Ref: f.ref, MinTime: mint, MaxTime: maxt})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return metas, nil
+}
+
+// IterateByTime calls fn for every chunk in ascending order of MinTime
+// across all segments. Chunks with the same MinTime are passed in reference
+// order. Tombstoned chunks are skipped.
+//
+// The chunks of every segment are ordered by the time ranges stored in its
+// footer and the segments are merged with a heap, so that chunks are only
+// decoded right before they are passed to fn. Segments without a footer have
+// all their chunks decoded up front to determine their time ranges, i.e.
+// they are decoded twice and their entries are held in memory until the
+// iteration ends. Chunks without samples are then treated as starting at
+// math.MinInt64.
+func (s *Reader) IterateByTime(fn func(ref uint64, c chunkenc.Chunk) error) error {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	if s.closed {
+		return errReaderClosed
+	}
+	var (
+		h        timeHeap
+		fallback []timeEntry
+	)
+	for seq := range s.bs {
+		m := &s.segs[seq]
+		if m.err != nil {
+			return m.err
+		}
+		if !m.hasFooter {
+			err := s.scanSegment(seq, func(f chunkFrame) error {
+				mint, _, ok, err := s.frameTimeRange(seq, f)
+				if err != nil {
+					return err
+				}
+				if !ok {
+					mint = math.MinInt64
+				}
+				fallback = append(fallback, timeEntry{ref: f.ref, mint: mint, length: len(f.data)})
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		var es []timeEntry
+		for _, e := range m.footer {
+			if e.flags&footerFlagTombstone != 0 {
+				continue
+			}
+			es = append(es, timeEntry{ref: packRef(seq, e.off), mint: e.mint, length: e.length})
+		}
+		h.add(es)
+	}
+	h.add(fallback)
+	heap.Init(&h)
+
+	for len(h) > 0 {
+		e := h[0][0]
+
+		if len(h[0]) > 1 {
+			h[0] = h[0][1:]
+			heap.Fix(&h, 0)
+		} else {
+			heap.Pop(&h)
+		}
+		if err := s.waitDecode(e.length); err != nil {
+			return err
+		}
+		c, err := s.chunk(e.ref)
+		if err != nil {
+			return errors.Wrapf(err, "read chunk %d", e.ref)
+		}
+		if err := s.unlocked(func() error { return fn(e.ref, c) }); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// timeEntry is a chunk to be passed by IterateByTime.
+type timeEntry struct {
+	ref    uint64
+	mint   int64
+	length int
+}
+
+func (e timeEntry) before(o timeEntry) bool {
+	if e.mint != o.mint {
+		return e.mint < o.mint
+	}
+	return e.ref < o.ref
+}
+
+// timeHeap is a min-heap of lists of chunks ordered by MinTime, keyed by
+// the first chunk of every list.
+type timeHeap [][]timeEntry
+
+// add sorts es and adds it to the heap unless it is empty. The heap must be
+// initialized afterwards.
+func (h *timeHeap) add(es []timeEntry) {
+	if len(es) == 0 {
+		return
+	}
+	sort.Slice(es, func(i, j int) bool { return es[i].before(es[j]) })
+	*h = append(*h, es)
+}
+
+func (h timeHeap) Len() int           { return len(h) }
+func (h timeHeap) Less(i, j int) bool { return h[i][0].before(h[j][0]) }
+func (h timeHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *timeHeap) Push(x interface{}) {
+	*h = append(*h, x.([]timeEntry))
+}
+
+func (h *timeHeap) Pop() interface{} {
+	old := *h
+	es := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return es
+}
+
+// putChunk returns c to the pool unless it is nil.
+func (s *Reader) putChunk(c chunkenc.Chunk) {
+	if c != nil {
+		s.pool.Put(c)
+	}
+}
+
+// latestHeap is a min-heap of chunks ordered by MaxTime, so that the root is
+// the chunk to drop first.
+type latestHeap []Meta
+
+// after reports whether a is later than b. Ties are broken by preferring the
+// lower reference.
+func (h latestHeap) after(a, b Meta) bool {
+	if a.MaxTime != b.MaxTime {
+		return a.MaxTime > b.MaxTime
+	}
+	return a.Ref < b.Ref
+}
+
+func (h latestHeap) Len() int           { return len(h) }
+func (h latestHeap) Less(i, j int) bool { return h.after(h[j], h[i]) }
+func (h latestHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *latestHeap) Push(x interface{}) {
+	*h = append(*h, x.(Meta))
+}
+
+func (h *latestHeap) Pop() interface{} {
+	old := *h
+	m := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return m
+}
+
+// IterateRuns calls fn for every run of consecutive chunks with the same
+// encoding, in segment order, with the references of the chunks of the run.
+// Runs continue across segment boundaries. Chunks are not decoded, so runs
+// already in a desired encoding can be skipped cheaply. fn may retain refs.
+func (s *Reader) IterateRuns(fn func(enc chunkenc.Encoding, refs []uint64) error) error {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	if s.closed {
+		return errReaderClosed
+	}
+	var (
+		enc  chunkenc.Encoding
+		refs []uint64
+	)
+	for seq := range s.bs {
+		m := &s.segs[seq]
+
+		err := s.scanSegment(seq, func(f chunkFrame) error {
+			fenc := m.chunkEncoding(f.enc)
+			if len(refs) > 0 && fenc != enc {
+				run := refs
+				if err := s.unlocked(func() error { return fn(enc, run) }); err != nil {
+					return err
+				}
+				refs = nil
+			}
+			enc = fenc
+			refs = append(refs, f.ref)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if len(refs) > 0 {
+		return s.unlocked(func() error { return fn(enc, refs) })
+	}
+	return nil
+}
+
+// ChunkIterator iterates over all chunks of a Reader in segment order by
+// parsing the chunk frames of every segment, so that chunks can be
+// enumerated without knowing their references, e.g. to rebuild a lost
+// index. It is created with Reader.Iter.
+type ChunkIterator struct {
+	r   *Reader
+	seq int
+	off int
+
+	h   hash.Hash32
+	buf []byte
+	cur chunkFrame
+	// Checksum error of the current chunk.
+	crcErr error
+	err    error
+}
+
+// Iter returns an iterator over all chunk frames of the Reader in segment
+// order. Within a segment, frames are parsed one after another from the end
+// of the header on. A segment ends at its footer or at the first zero
+// length, which marks the zero padding left behind by pre-allocation.
+// Tombstoned chunks are skipped. Iteration stops at the first segment that
+// is unavailable or holds a frame that cannot be parsed, which Err then
+// returns, or once the Reader is closed.
+func (s *Reader) Iter() *ChunkIterator {
+	return &ChunkIterator{r: s, h: newCRC32(), buf: make([]byte, crc32Size)}
+}
+
+// Next advances the iterator to the next chunk. It returns false once all
+// chunks were iterated or an error occurred.
+func (it *ChunkIterator) Next() bool {
+	it.r.mtx.RLock()
+	defer it.r.mtx.RUnlock()
+
+	if it.err == nil && it.r.closed {
+		it.err = errReaderClosed
+	}
+	for it.err == nil && it.seq < len(it.r.bs) {
+		if err := it.r.segs[it.seq].err; err != nil {
+			it.err = err
+			return false
+		}
+		if it.off == 0 {
+			it.off = SegmentHeaderSize
+		}
+		f, ok, err := it.r.readFrame(it.seq, it.off)
+		if err != nil {
+			it.err = &CorruptionErr{Segment: it.seq, Offset: int64(it.off), Err: err}
+			return false
+		}
+		if !ok {
+			it.seq, it.off = it.seq+1, 0
+			continue
+		}
+		_, off := unpackRef(f.ref)
+		it.off = f.next
+
+		if it.r.segs[it.seq].tombstoned(off) {
+			continue
+		}
+		it.cur = f
+		it.crcErr = verifyFrame(it.h, it.buf, f)
+		return true
+	}
+	return false
+}
+
+// Ref returns the reference of the current chunk.
+func (it *ChunkIterator) Ref() uint64 {
+	return it.cur.ref
+}
+
+// Encoding returns the stored encoding of the current chunk.
+func (it *ChunkIterator) Encoding() chunkenc.Encoding {
+	return it.cur.enc
+}
+
+// Data returns the stored data of the current chunk, which is encrypted or
+// compressed if the segment is. It aliases the underlying byte slice and
+// must not be modified.
+func (it *ChunkIterator) Data() []byte {
+	return it.cur.data
+}
+
+// CRCErr returns an error if the checksum of the current chunk does not
+// match its data.
+func (it *ChunkIterator) CRCErr() error {
+	if it.crcErr != nil {
+		_, off := unpackRef(it.cur.ref)
+		return &CorruptionErr{Segment: it.seq, Offset: int64(off), Err: it.crcErr}
+	}
+	return nil
+}
+
+// Chunk decodes the current chunk like Reader.Chunk.
+func (it *ChunkIterator) Chunk() (chunkenc.Chunk, error) {
+	it.r.mtx.RLock()
+	defer it.r.mtx.RUnlock()
+
+	if it.r.closed {
+		return nil, errReaderClosed
+	}
+	return it.r.decodeFrame(it.seq, it.cur)
+}
+
+// Err returns the error that stopped the iteration, if any. It is nil if
+// all chunks were iterated.
+func (it *ChunkIterator) Err() error {
+	return it.err
+}
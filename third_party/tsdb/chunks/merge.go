@@ -0,0 +1,368 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunks
+
+import (
+	"math"
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/tsdb/chunkenc"
+)
+
+// MergeOverlappingChunks removes the samples whose timestamp is overlapping.
+// The last appearing sample is retained in case there is overlapping.
+// This assumes that `chks []Meta` is sorted w.r.t. MinTime.
+func MergeOverlappingChunks(chks []Meta) ([]Meta, error) {
+	return mergeOverlappingChunks(chks, func(*Meta) error { return nil })
+}
+
+// MergeOverlappingChunksFromReader is like MergeOverlappingChunks but takes
+// chunks that only have their Ref set and loads each of them from r once it
+// is reached. This way not all chunks have to be held in memory up front.
+//
+// Merged chunks are newly allocated. Chunks that did not need merging are
+// returned as loaded and are only valid as long as r is open.
+func MergeOverlappingChunksFromReader(r *Reader, chks []Meta) ([]Meta, error) {
+	return mergeOverlappingChunks(chks, func(c *Meta) error {
+		chk, err := r.Chunk(c.Ref)
+		if err != nil {
+			return errors.Wrapf(err, "load chunk %d", c.Ref)
+		}
+		c.Chunk = chk
+		return nil
+	})
+}
+
+// mergeOverlappingChunks implements MergeOverlappingChunks. load is called
+// for every chunk right before its data is needed.
+func mergeOverlappingChunks(chks []Meta, load func(*Meta) error) ([]Meta, error) {
+	if len(chks) == 0 {
+		return chks, nil
+	}
+	newChks := make([]Meta, 0, len(chks)) // Will contain the merged chunks.
+	newChks = append(newChks, chks[0])
+	if err := load(&newChks[0]); err != nil {
+		return nil, err
+	}
+	last := 0
+	for _, c := range chks[1:] {
+		if err := load(&c); err != nil {
+			return nil, err
+		}
+		// We need to check only the last chunk in newChks.
+		// Reason: (1) newChks[last-1].MaxTime < newChks[last].MinTime (non overlapping)
+		//         (2) As chks are sorted w.r.t. MinTime, newChks[last].MinTime < c.MinTime.
+		// So never overlaps with newChks[last-1] or anything before that.
+		if c.MinTime > newChks[last].MaxTime {
+			newChks = append(newChks, c)
+			last++
+			continue
+		}
+		nc := &newChks[last]
+		if c.MaxTime > nc.MaxTime {
+			nc.MaxTime = c.MaxTime
+		}
+		chk, err := MergeChunks(nc.Chunk, c.Chunk)
+		if err != nil {
+			return nil, err
+		}
+		nc.Chunk = chk
+	}
+
+	return newChks, nil
+}
+
+// OverlapInfo describes two chunks whose time ranges overlap.
+type OverlapInfo struct {
+	// Indices of the overlapping chunks in the Metas passed to
+	// DetectOverlaps, with A < B.
+	A, B int
+	// MinTime and MaxTime delimit the closed interval both chunks cover.
+	MinTime, MaxTime int64
+}
+
+// DetectOverlaps returns every pair of metas whose time ranges overlap as
+// determined by OverlapsClosedInterval, ordered by A and B. Only the time
+// ranges are used, so it can be used to check whether MergeOverlappingChunks
+// is needed before loading any chunk. metas do not need to be sorted.
+func DetectOverlaps(metas []Meta) []OverlapInfo {
+	order := make([]int, len(metas))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return metas[order[i]].MinTime < metas[order[j]].MinTime
+	})
+
+	var res []OverlapInfo
+	for i, a := range order {
+		am := &metas[a]
+		for _, b := range order[i+1:] {
+			bm := &metas[b]
+			// Chunks are ordered by MinTime, so no later chunk overlaps either.
+			if !am.OverlapsClosedInterval(bm.MinTime, bm.MaxTime) {
+				break
+			}
+			o := OverlapInfo{A: a, B: b, MinTime: bm.MinTime, MaxTime: am.MaxTime}
+			if bm.MaxTime < o.MaxTime {
+				o.MaxTime = bm.MaxTime
+			}
+			if o.A > o.B {
+				o.A, o.B = o.B, o.A
+			}
+			res = append(res, o)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].A != res[j].A {
+			return res[i].A < res[j].A
+		}
+		return res[i].B < res[j].B
+	})
+	return res
+}
+
+// TimeRange is a closed interval of time.
+type TimeRange struct {
+	MinTime, MaxTime int64
+}
+
+// CoverageGaps returns the gaps between the chunks of a series that are
+// longer than maxGap, in order. A gap starts at the latest MaxTime of all
+// preceding chunks and ends at the MinTime of the next chunk, i.e. it is
+// delimited by the samples around it. Overlapping or adjacent chunks leave
+// no gap, and an open chunk covers all time after its MinTime. metas must be
+// sorted by MinTime.
+func CoverageGaps(metas []Meta, maxGap int64) []TimeRange {
+	if len(metas) == 0 {
+		return nil
+	}
+	var (
+		gaps []TimeRange
+		last = metas[0].MaxTime
+	)
+	for _, m := range metas[1:] {
+		if last == math.MaxInt64 {
+			break
+		}
+		if m.MinTime > last && m.MinTime-last > maxGap {
+			gaps = append(gaps, TimeRange{MinTime: last, MaxTime: m.MinTime})
+		}
+		if m.MaxTime > last {
+			last = m.MaxTime
+		}
+	}
+	return gaps
+}
+
+// MergedChunkIterator returns an iterator over the samples of the chunks
+// refs[i] of readers[i] for all i, ordered by timestamp. If several readers
+// hold a sample with the same timestamp, the one of the reader with the
+// highest index wins. The refs of every reader must be ordered by time and
+// must not overlap each other. Chunks are loaded as the iterator reaches
+// them, so merged chunks are never materialized.
+func MergedChunkIterator(readers []*Reader, refs [][]uint64) (chunkenc.Iterator, error) {
+	if len(readers) != len(refs) {
+		return nil, errors.Errorf("got %d readers but refs for %d", len(readers), len(refs))
+	}
+	it := &mergedIterator{its: make([]*seriesIterator, 0, len(readers))}
+
+	for i, r := range readers {
+		it.its = append(it.its, &seriesIterator{r: r, refs: refs[i]})
+	}
+	it.ok = make([]bool, len(it.its))
+
+	for i, sit := range it.its {
+		it.ok[i] = sit.Next()
+		if sit.err != nil {
+			return nil, errors.Wrapf(sit.err, "reader %d", i)
+		}
+	}
+	return it, nil
+}
+
+// mergedIterator merges the samples of several series iterators.
+type mergedIterator struct {
+	its []*seriesIterator
+	// ok[i] is set while its[i] is positioned at a sample.
+	ok  []bool
+	t   int64
+	v   float64
+	err error
+}
+
+func (it *mergedIterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	win := -1
+	for i, sit := range it.its {
+		if !it.ok[i] {
+			continue
+		}
+		// On equal timestamps the later iterator wins.
+		if t, _ := sit.At(); win < 0 || t <= it.t {
+			win, it.t = i, t
+		}
+	}
+	if win < 0 {
+		return false
+	}
+	_, it.v = it.its[win].At()
+
+	for i, sit := range it.its {
+		if !it.ok[i] {
+			continue
+		}
+		if t, _ := sit.At(); t != it.t {
+			continue
+		}
+		it.ok[i] = sit.Next()
+		if sit.err != nil {
+			it.err = errors.Wrapf(sit.err, "reader %d", i)
+			return false
+		}
+	}
+	return true
+}
+
+func (it *mergedIterator) At() (int64, float64) {
+	return it.t, it.v
+}
+
+func (it *mergedIterator) Err() error {
+	return it.err
+}
+
+const (
+	// maxXORSampleSize is the largest number of bytes appending a sample can
+	// add to an XOR chunk: a timestamp delta of delta of up to 68 bits and
+	// a value of up to 77 bits.
+	maxXORSampleSize = 20
+	// MinSplitChunkBytes is the smallest chunk size SplitChunk accepts. It
+	// holds the chunk header and at least one sample.
+	MinSplitChunkBytes = 2 + maxXORSampleSize
+)
+
+// SplitChunk re-appends the samples of c in order into XOR chunks whose data
+// does not exceed maxBytes and returns them with their time ranges set. Each
+// chunk is filled as far as the next sample is guaranteed to fit. A chunk
+// without samples yields no chunks.
+func SplitChunk(c chunkenc.Chunk, maxBytes int) ([]Meta, error) {
+	if maxBytes < MinSplitChunkBytes {
+		return nil, errors.Errorf("maximum chunk size %d is below minimum of %d bytes", maxBytes, MinSplitChunkBytes)
+	}
+	var (
+		res []Meta
+		cur *chunkenc.XORChunk
+		app chunkenc.Appender
+		err error
+	)
+	it := c.Iterator()
+	for it.Next() {
+		t, v := it.At()
+		if cur != nil && (len(cur.Bytes())+maxXORSampleSize > maxBytes || cur.NumSamples() == math.MaxUint16) {
+			cur = nil
+		}
+		if cur == nil {
+			cur = chunkenc.NewXORChunk()
+			if app, err = cur.Appender(); err != nil {
+				return nil, err
+			}
+			res = append(res, Meta{Chunk: cur, MinTime: t})
+		}
+		app.Append(t, v)
+		res[len(res)-1].MaxTime = t
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// MergeChunks vertically merges a and b, i.e., if there is any sample
+// with same timestamp in both a and b, the sample in a is discarded.
+func MergeChunks(a, b chunkenc.Chunk) (*chunkenc.XORChunk, error) {
+	return mergeChunks(a, b, func(_, bv float64) float64 { return bv })
+}
+
+// staleNaN is the bit pattern of the NaN value marking a series as stale.
+// It has to match value.StaleNaN of the Prometheus server.
+const staleNaN uint64 = 0x7ff0000000000002
+
+// isStaleNaN reports whether v is a staleness marker.
+func isStaleNaN(v float64) bool {
+	return math.Float64bits(v) == staleNaN
+}
+
+// MergeChunksStaleAware merges a and b like MergeChunks while treating
+// staleness markers as distinct from all other values, including other
+// NaNs. A staleness marker in b wins over the sample in a at the same
+// timestamp and keeps its exact bit pattern, so it is not mistaken for an
+// arbitrary NaN once merged. A staleness marker in a is replaced by a
+// sample of b at the same timestamp like any other sample.
+func MergeChunksStaleAware(a, b chunkenc.Chunk) (*chunkenc.XORChunk, error) {
+	return mergeChunks(a, b, func(_, bv float64) float64 {
+		if isStaleNaN(bv) {
+			return math.Float64frombits(staleNaN)
+		}
+		return bv
+	})
+}
+
+// mergeChunks merges a and b. For samples with the same timestamp in both
+// chunks, resolve returns the value to retain.
+func mergeChunks(a, b chunkenc.Chunk, resolve func(av, bv float64) float64) (*chunkenc.XORChunk, error) {
+	newChunk := chunkenc.NewXORChunk()
+	app, err := newChunk.Appender()
+	if err != nil {
+		return nil, err
+	}
+	ait := a.Iterator()
+	bit := b.Iterator()
+	aok, bok := ait.Next(), bit.Next()
+	for aok && bok {
+		at, av := ait.At()
+		bt, bv := bit.At()
+		if at < bt {
+			app.Append(at, av)
+			aok = ait.Next()
+		} else if bt < at {
+			app.Append(bt, bv)
+			bok = bit.Next()
+		} else {
+			app.Append(bt, resolve(av, bv))
+			aok = ait.Next()
+			bok = bit.Next()
+		}
+	}
+	for aok {
+		at, av := ait.At()
+		app.Append(at, av)
+		aok = ait.Next()
+	}
+	for bok {
+		bt, bv := bit.At()
+		app.Append(bt, bv)
+		bok = bit.Next()
+	}
+	if ait.Err() != nil {
+		return nil, ait.Err()
+	}
+	if bit.Err() != nil {
+		return nil, bit.Err()
+	}
+	return newChunk, nil
+}
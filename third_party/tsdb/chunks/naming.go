@@ -0,0 +1,148 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunks
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/tsdb/fileutil"
+)
+
+// NamingStrategy maps the sequence numbers of segments to file names, so
+// that segments can share a directory with other files.
+type NamingStrategy interface {
+	// Match returns the sequence number of the segment with the given file
+	// name. It returns ok=false if name is not a segment file.
+	Match(name string) (seq int, ok bool)
+	// Format returns the file name of the segment with sequence number seq.
+	// Match must return seq for it.
+	Format(seq int) string
+}
+
+// NumericNaming names segments by their sequence number, padded with zeros
+// to six digits. It is the default NamingStrategy.
+var NumericNaming NamingStrategy = numericNaming{}
+
+type numericNaming struct{}
+
+func (numericNaming) Match(name string) (int, bool) {
+	seq, err := strconv.ParseUint(name, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return int(seq), true
+}
+
+func (numericNaming) Format(seq int) string {
+	return fmt.Sprintf("%0.6d", seq)
+}
+
+// segmentRangeName returns the name of the segment with sequence number seq
+// holding chunks within the given time range. The sequence number keeps the
+// names of segments with equal time ranges apart.
+func segmentRangeName(seq int, mint, maxt int64) string {
+	return fmt.Sprintf("%0.6d-%d-%d", seq, mint, maxt)
+}
+
+// parseSegmentRangeName returns the sequence number and time range encoded
+// in a segment name created by segmentRangeName.
+func parseSegmentRangeName(name string) (seq int, mint, maxt int64, err error) {
+	if _, err := fmt.Sscanf(name, "%d-%d-%d", &seq, &mint, &maxt); err != nil {
+		return 0, 0, 0, errors.Wrapf(err, "parse segment name %q", name)
+	}
+	if seq < 0 || segmentRangeName(seq, mint, maxt) != name || mint > maxt {
+		return 0, 0, 0, errors.Errorf("invalid time range segment name %q", name)
+	}
+	return seq, mint, maxt, nil
+}
+
+// renameTail renames the finalized tail segment fn to its index and the time
+// range of its chunks and records it in the segment names sidecar. Segments
+// without chunks keep their sequence name.
+func (w *Writer) renameTail(fn string) error {
+	name := filepath.Base(fn)
+
+	if w.tailMinTime <= w.tailMaxTime {
+		name = segmentRangeName(len(w.segmentNames)+1, w.tailMinTime, w.tailMaxTime)
+		p := filepath.Join(w.dirFile.Name(), name)
+
+		if _, err := os.Stat(p); err == nil {
+			return errors.Errorf("segment %s already exists", name)
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		if err := fileutil.Rename(fn, p); err != nil {
+			return errors.Wrap(err, "rename segment")
+		}
+	}
+	w.segmentNames = append(w.segmentNames, name)
+
+	return errors.Wrap(writeSegmentNames(w.dirFile.Name(), w.segmentNames), "write segment names")
+}
+
+// writeSegmentNames writes names as the segment names sidecar of the chunks
+// directory dir.
+func writeSegmentNames(dir string, names []string) error {
+	return writeSidecar(dir, segmentNamesFilename, func(wr io.Writer) error {
+		return json.NewEncoder(wr).Encode(names)
+	})
+}
+
+// readSegmentNames returns the names of the segments in dir in order of their
+// index as recorded by a Writer with NameByTimeRange set.
+func readSegmentNames(dir string) ([]string, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, segmentNamesFilename))
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+
+	if err := json.Unmarshal(b, &names); err != nil {
+		return nil, err
+	}
+	for _, n := range names {
+		if _, err := strconv.ParseUint(n, 10, 64); err == nil {
+			continue
+		}
+		if _, _, _, err := parseSegmentRangeName(n); err != nil {
+			return nil, err
+		}
+	}
+	return names, nil
+}
+
+// SegmentTimeRange returns the time range encoded in the file name of the
+// given segment. It returns ok=false if the segment is not named by its time
+// range, e.g. because the Reader is not backed by a directory written with
+// NameByTimeRange.
+func (s *Reader) SegmentTimeRange(index int) (mint, maxt int64, ok bool) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	if index < 0 || index >= len(s.files) {
+		return 0, 0, false
+	}
+	_, mint, maxt, err := parseSegmentRangeName(filepath.Base(s.files[index]))
+	if err != nil {
+		return 0, 0, false
+	}
+	return mint, maxt, true
+}
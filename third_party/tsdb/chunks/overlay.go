@@ -0,0 +1,71 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunks
+
+import (
+	"github.com/pkg/errors"
+	"github.com/prometheus/tsdb/chunkenc"
+)
+
+// NewOverlayReader returns a Reader against the segments of base that
+// redirects the references in override to the chunks of patch they map to.
+// Chunk returns the patched chunk for a reference in override and the chunk
+// of base for all others, so that corrections written to patch can be tried
+// without modifying base. Other methods are not redirected.
+//
+// The segments of patch follow the ones of base, i.e. references into patch
+// returned by methods of the overlay have their segment index increased by
+// the number of segments of base. The overlay uses the options of base. It
+// shares the segments of both Readers, which must stay open while it is
+// used, and closing it does not close them.
+func NewOverlayReader(base, patch *Reader, override map[uint64]uint64, pool chunkenc.Pool) (*Reader, error) {
+	base.mtx.RLock()
+	defer base.mtx.RUnlock()
+	patch.mtx.RLock()
+	defer patch.mtx.RUnlock()
+
+	if base.closed || patch.closed {
+		return nil, errReaderClosed
+	}
+	if pool == nil {
+		pool = chunkenc.NewPool()
+	}
+	var (
+		bs          = make([]ByteSlice, 0, len(base.bs)+len(patch.bs))
+		unavailable = map[int]error{}
+	)
+	for _, r := range []*Reader{base, patch} {
+		for i, b := range r.bs {
+			if err := r.segs[i].err; err != nil {
+				unavailable[len(bs)] = err
+			}
+			bs = append(bs, b)
+		}
+	}
+	shift := uint64(len(base.bs)) << 32
+
+	o := make(map[uint64]uint64, len(override))
+	for ref, pref := range override {
+		if seq, _ := unpackRef(pref); seq >= len(patch.bs) {
+			return nil, errors.Errorf("override of chunk %d: reference sequence %d out of range", ref, seq)
+		}
+		o[ref] = pref + shift
+	}
+	r, err := newReader(bs, nil, unavailable, pool, &base.opts)
+	if err != nil {
+		return nil, err
+	}
+	r.override = o
+	return r, nil
+}
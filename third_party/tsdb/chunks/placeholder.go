@@ -0,0 +1,142 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunks
+
+import (
+	"encoding/binary"
+	"math"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/tsdb/chunkenc"
+)
+
+// placeholder locates a chunk frame reserved by ReservePlaceholder.
+type placeholder struct {
+	// Offsets of the encoding, the data and the checksum in the segment file.
+	encOff, dataOff, crcOff int64
+	size            int
+	// Position of the encoding in the footer being built, or -1.
+	footerEncPos int
+}
+
+// ReservePlaceholder writes a chunk of size zero bytes with encoding EncNone
+// and returns its reference, so that the chunk can be referenced before its
+// data is known. The data is written later with FillPlaceholder.
+//
+// The footer entry of a placeholder covers all time as its time range is not
+// known when it is written, and EnforceTimeOrder does not apply to it.
+// Placeholders cannot be combined with options that process the chunk data
+// as it is written, i.e. Cipher, DictCompression, BindTimeRanges,
+// IntraChunkCRCInterval, WriteSampleCountIndex and WriteManifest.
+func (w *Writer) ReservePlaceholder(size int) (ref uint64, err error) {
+	if w.aborted {
+		return 0, errWriterAborted
+	}
+	if size <= 0 {
+		return 0, errors.Errorf("invalid placeholder size %d", size)
+	}
+	if w.opts.Cipher != nil || w.opts.DictCompression || w.opts.BindTimeRanges || w.opts.IntraChunkCRCInterval > 0 || w.opts.WriteSampleCountIndex || w.opts.WriteManifest {
+		return 0, errors.New("placeholders are not supported with the configured options")
+	}
+	frameLen, err := w.frameSize(0, int64(size))
+	if err != nil {
+		return 0, err
+	}
+	if err := w.reserve(MaxChunkLengthFieldSize+frameLen, maxFooterEntrySize); err != nil {
+		return 0, err
+	}
+	ref = uint64(w.seq())<<32 | uint64(w.n)
+
+	p := placeholder{
+		encOff:       w.n + int64(binary.PutUvarint(w.buf[:], uint64(size))),
+		size:         size,
+		footerEncPos: -1,
+	}
+	if w.opts.FixedFrameLength {
+		p.encOff += frameLengthSize
+	}
+	data := make([]byte, size)
+
+	w.crc32.Reset()
+	if err := writeHash(w.crc32, w.buf[:], chunkenc.EncNone, data); err != nil {
+		return 0, err
+	}
+	if err := w.writeFrame(chunkenc.EncNone, data, w.crc32.Sum(w.sum[:0]), math.MinInt64, math.MaxInt64, nil); err != nil {
+		return 0, err
+	}
+	if w.opts.CRCPlacement == CRCLeading {
+		p.dataOff = w.n - int64(size)
+		p.crcOff = p.dataOff - crc32Size
+	} else {
+		p.dataOff = w.n - crc32Size - int64(size)
+		p.crcOff = p.dataOff + int64(size)
+	}
+	if w.version == chunksFormatV2 {
+		p.footerEncPos = w.footer.lastEncPos
+	}
+	if w.placeholders == nil {
+		w.placeholders = map[uint64]placeholder{}
+	}
+	w.placeholders[ref] = p
+
+	return ref, nil
+}
+
+// FillPlaceholder overwrites the placeholder ref with the given encoding and
+// data, which must have the size the placeholder was reserved with, and
+// updates its checksum. It may be called again to replace the data.
+//
+// The placeholder is written in place in the segment file, which must still
+// be open, i.e. the tail segment of the Writer. Pending buffered writes are
+// flushed before, so that none of them can overwrite it afterwards.
+func (w *Writer) FillPlaceholder(ref uint64, enc chunkenc.Encoding, data []byte) error {
+	if w.aborted {
+		return errWriterAborted
+	}
+	p, ok := w.placeholders[ref]
+	if !ok {
+		return errors.Errorf("no placeholder at reference %d in the tail segment", ref)
+	}
+	if len(data) != p.size {
+		return errors.Errorf("data of %d bytes does not match placeholder size %d", len(data), p.size)
+	}
+	if err := w.wbuf.Flush(); err != nil {
+		return err
+	}
+	w.crc32.Reset()
+	if err := writeHash(w.crc32, w.buf[:], enc, data); err != nil {
+		return err
+	}
+	tf := w.tail()
+
+	if _, err := tf.WriteAt([]byte{byte(enc)}, p.encOff); err != nil {
+		return errors.Wrap(err, "write placeholder encoding")
+	}
+	if _, err := tf.WriteAt(data, p.dataOff); err != nil {
+		return errors.Wrap(err, "write placeholder data")
+	}
+	if _, err := tf.WriteAt(w.crc32.Sum(w.sum[:0]), p.crcOff); err != nil {
+		return errors.Wrap(err, "write placeholder checksum")
+	}
+	if p.footerEncPos >= 0 {
+		w.footer.buf[p.footerEncPos] = byte(enc)
+	}
+	// Account for the time range of the chunk if it can be determined.
+	if c, err := chunkenc.FromData(enc, data); err == nil {
+		if mint, maxt, ok, err := chunkTimeRange(c); err == nil && ok {
+			w.trackTimeRange(mint, maxt)
+		}
+	}
+	return nil
+}
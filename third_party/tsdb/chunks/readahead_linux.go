@@ -0,0 +1,23 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunks
+
+import "syscall"
+
+// adviseWillNeed hints the kernel to read the pages of b in the background.
+// b has to start at a page boundary of a memory mapping. Errors are ignored
+// as the hint is best-effort.
+func adviseWillNeed(b []byte) {
+	syscall.Madvise(b, syscall.MADV_WILLNEED)
+}
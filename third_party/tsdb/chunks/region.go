@@ -0,0 +1,54 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunks
+
+import (
+	"github.com/pkg/errors"
+	"github.com/prometheus/tsdb/chunkenc"
+)
+
+// subByteSlice is the part [start, end) of a ByteSlice.
+type subByteSlice struct {
+	b          ByteSlice
+	start, end int
+}
+
+func (b subByteSlice) Len() int {
+	return b.end - b.start
+}
+
+func (b subByteSlice) Range(start, end int) []byte {
+	return b.b.Range(b.start+start, b.start+end)
+}
+
+// NewReaderFromRegion returns a Reader against the chunks region b of a file
+// that also holds other data, e.g. a block packed into a single file.
+// segmentOffsets holds the start of every segment within b in increasing
+// order. Each segment ends at the start of the next one, the last one at the
+// end of b. References resolve against the segments in the given order.
+func NewReaderFromRegion(b ByteSlice, segmentOffsets []int64, pool chunkenc.Pool) (*Reader, error) {
+	bs := make([]ByteSlice, 0, len(segmentOffsets))
+
+	for i, off := range segmentOffsets {
+		end := int64(b.Len())
+		if i+1 < len(segmentOffsets) {
+			end = segmentOffsets[i+1]
+		}
+		if off < 0 || off >= end || end > int64(b.Len()) {
+			return nil, errors.Errorf("invalid range [%d, %d) of segment %d in region of %d bytes", off, end, i, b.Len())
+		}
+		bs = append(bs, subByteSlice{b: b, start: int(off), end: int(end)})
+	}
+	return NewReader(bs, pool)
+}
@@ -0,0 +1,670 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunks
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/tsdb/chunkenc"
+	"github.com/prometheus/tsdb/fileutil"
+)
+
+// DedupeSegments removes trailing segments of dir that are byte-identical to
+// an earlier segment. Only trailing segments are considered as removing any
+// other segment would shift the indices of all segments following it.
+//
+// The manifest, sample count index and segment names sidecars, if present,
+// are rewritten to no longer describe the removed segments. If an error
+// occurs after the first segment was removed, the sidecars may still describe
+// the old layout.
+//
+// It returns the indices of the removed segments and a mapping from every
+// chunk reference into a removed segment to the equivalent reference into the
+// retained identical segment.
+func DedupeSegments(dir string) (removed []int, remap map[uint64]uint64, err error) {
+	return DedupeSegmentsWithNaming(dir, nil)
+}
+
+// DedupeSegmentsWithNaming is like DedupeSegments but matches the segments
+// by naming, or NumericNaming if it is nil.
+func DedupeSegmentsWithNaming(dir string, naming NamingStrategy) (removed []int, remap map[uint64]uint64, err error) {
+	r, err := NewDirReaderWithOptions(dir, nil, &ReaderOptions{Naming: naming})
+	if err != nil {
+		return nil, nil, err
+	}
+	files := r.files
+	remap = map[uint64]uint64{}
+
+	for last := len(r.bs) - 1; last > 0; last-- {
+		dup := -1
+		for i := 0; i < last; i++ {
+			if segmentsEqual(r.bs[i], r.bs[last]) {
+				dup = i
+				break
+			}
+		}
+		if dup < 0 {
+			break
+		}
+		err := r.scanSegment(last, func(f chunkFrame) error {
+			_, off := unpackRef(f.ref)
+			remap[f.ref] = packRef(dup, off)
+			return nil
+		})
+		if err != nil {
+			r.Close()
+			return nil, nil, err
+		}
+		removed = append(removed, last)
+	}
+	// Unmap all segments before removing any of them.
+	if err := r.Close(); err != nil {
+		return nil, nil, err
+	}
+	for _, i := range removed {
+		if err := os.Remove(files[i]); err != nil {
+			return nil, nil, errors.Wrapf(err, "remove segment %d", i)
+		}
+	}
+	if len(removed) == 0 {
+		return nil, remap, nil
+	}
+	// Removed segments are trailing and found last to first.
+	if err := truncateSidecars(dir, removed[len(removed)-1]); err != nil {
+		return nil, nil, err
+	}
+	df, err := fileutil.OpenDir(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := fileutil.Fsync(df); err != nil {
+		df.Close()
+		return nil, nil, err
+	}
+	return removed, remap, df.Close()
+}
+
+// segmentsEqual reports whether a and b hold exactly the same bytes.
+func segmentsEqual(a, b ByteSlice) bool {
+	if a.Len() != b.Len() {
+		return false
+	}
+	return bytes.Equal(a.Range(0, a.Len()), b.Range(0, b.Len()))
+}
+
+// SplitSegment rewrites the chunks of segment index of srcDir into new
+// segments of at most segmentSize bytes in dstDir. Chunk data is copied
+// unchanged and the format version, alignment, framing, compression and time
+// range checksums of the source segment are preserved, as are the time range
+// and tags recorded for every chunk in its footer. Compressed chunks are
+// compressed again against the dictionaries of the new segments. Tombstoned
+// chunks are dropped.
+//
+// It returns a mapping from every chunk reference into the source segment,
+// except tombstoned ones, to the reference of the chunk in dstDir.
+func SplitSegment(srcDir string, index int, segmentSize int64, dstDir string, pool chunkenc.Pool) (refRemap map[uint64]uint64, err error) {
+	return SplitSegmentWithNaming(srcDir, index, segmentSize, dstDir, pool, nil)
+}
+
+// SplitSegmentWithNaming is like SplitSegment but matches the segments of
+// both directories by naming, or NumericNaming if it is nil.
+func SplitSegmentWithNaming(srcDir string, index int, segmentSize int64, dstDir string, pool chunkenc.Pool, naming NamingStrategy) (refRemap map[uint64]uint64, err error) {
+	r, err := NewDirReaderWithOptions(srcDir, pool, &ReaderOptions{Naming: naming})
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	if index < 0 || index >= len(r.bs) {
+		return nil, errors.Errorf("segment %d out of range", index)
+	}
+	m := r.segs[index]
+	if m.flags&SegmentFlagEncrypted != 0 {
+		return nil, errors.Errorf("segment %d is encrypted", index)
+	}
+	opts := &WriterOptions{SegmentSize: segmentSize, Naming: naming}
+	if m.version == chunksFormatV2 {
+		opts.FormatVersion = chunksFormatV2
+		opts.Alignment = m.align
+		opts.FixedFrameLength = m.flags&SegmentFlagFixedFrameLength != 0
+		opts.IntraChunkCRCInterval = m.crcInterval
+		opts.DictCompression = m.flags&SegmentFlagDictCompressed != 0
+		if m.flags&SegmentFlagLeadingCRC != 0 {
+			opts.CRCPlacement = CRCLeading
+		}
+		for _, e := range m.footer {
+			if e.flags&footerFlagTimeRangeSum != 0 {
+				opts.BindTimeRanges = true
+				break
+			}
+		}
+	}
+	w, err := NewWriterWithOptions(dstDir, opts)
+	if err != nil {
+		return nil, err
+	}
+	refRemap = map[uint64]uint64{}
+
+	chk := make([]Meta, 1)
+	err = r.scanSegment(index, func(f chunkFrame) error {
+		_, off := unpackRef(f.ref)
+		if m.tombstoned(off) {
+			return nil
+		}
+		c, err := r.decodeFrame(index, f)
+		if err != nil {
+			return errors.Wrapf(err, "decode chunk %d", f.ref)
+		}
+		defer r.pool.Put(c)
+
+		chk[0] = Meta{Chunk: c}
+		var tags []byte
+		if opts.FormatVersion == chunksFormatV2 {
+			// Time ranges are recorded in the footer. Segments without one
+			// were not finalized and their time ranges are recomputed.
+			if e, ok := m.footerEntry(off); ok {
+				chk[0].MinTime, chk[0].MaxTime = e.mint, e.maxt
+				tags = e.tags
+			} else {
+				mint, maxt, _, err := chunkTimeRange(c)
+				if err != nil {
+					return errors.Wrapf(err, "iterate chunk %d", f.ref)
+				}
+				chk[0].MinTime, chk[0].MaxTime = mint, maxt
+			}
+		}
+		if err := w.writeChunks(chk, tags); err != nil {
+			return errors.Wrapf(err, "write chunk %d", f.ref)
+		}
+		refRemap[f.ref] = chk[0].Ref
+		return nil
+	})
+	if err != nil {
+		w.Close()
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return refRemap, nil
+}
+
+// CopyChunks writes all chunks of src to dst in segment order and returns a
+// mapping from every source reference to the reference of the chunk in dst.
+// Chunks are decoded and re-framed according to the options of dst, so dst
+// may use a different segment size, format version or alignment. Chunk tags
+// are not copied and tombstoned chunks are dropped. dst is not closed.
+//
+// If progress is not nil, it is called after every chunk with the number of
+// source bytes processed so far and the total size of all source segments.
+// Use CopyChunksFrom to resume an interrupted copy.
+func CopyChunks(src *Reader, dst *Writer, progress func(done, total int64)) (refRemap map[uint64]uint64, err error) {
+	refRemap, _, _, err = CopyChunksFrom(src, dst, 0, 0, progress)
+	if err != nil {
+		return nil, err
+	}
+	return refRemap, nil
+}
+
+// CopyChunksFrom is like CopyChunks but starts at the chunk at the given
+// position of src. An offset of 0 starts at the first chunk of the segment.
+//
+// It returns the position at which copying stopped, which is always a chunk
+// boundary: the number of segments once all chunks were copied, or the first
+// chunk that was not copied if an error is returned. The returned mapping
+// holds all chunks copied before the error. Calling CopyChunksFrom with the
+// returned position and a Writer holding these chunks, e.g. dst itself
+// after a transient error, resumes the copy. The mappings of all calls
+// together cover src.
+func CopyChunksFrom(src *Reader, dst *Writer, segment int, offset int64, progress func(done, total int64)) (refRemap map[uint64]uint64, nextSegment int, nextOffset int64, err error) {
+	src.mtx.RLock()
+	defer src.mtx.RUnlock()
+
+	if src.closed {
+		return nil, segment, offset, errReaderClosed
+	}
+	if segment < 0 || segment > len(src.bs) {
+		return nil, segment, offset, errors.Errorf("segment %d out of range", segment)
+	}
+	if offset < SegmentHeaderSize {
+		offset = SegmentHeaderSize
+	}
+	var total, base int64
+	for i, b := range src.bs {
+		total += int64(b.Len())
+		if i < segment {
+			base += int64(b.Len())
+		}
+	}
+	refRemap = map[uint64]uint64{}
+
+	chk := make([]Meta, 1)
+	for seq := segment; seq < len(src.bs); seq++ {
+		b := src.bs[seq]
+		nextSegment, nextOffset = seq, offset
+
+		err := src.scanSegmentFrom(seq, int(offset), func(f chunkFrame) error {
+			_, off := unpackRef(f.ref)
+			nextOffset = int64(off)
+
+			if src.segs[seq].tombstoned(off) {
+				nextOffset = int64(f.next)
+				return nil
+			}
+			c, err := src.scanDecode(seq, f)
+			if err != nil {
+				return errors.Wrapf(err, "decode chunk %d", f.ref)
+			}
+			defer src.pool.Put(c)
+
+			chk[0] = Meta{Chunk: c}
+			if dst.version == chunksFormatV2 {
+				// Time ranges are recorded in the footer.
+				mint, maxt, _, err := chunkTimeRange(c)
+				if err != nil {
+					return errors.Wrapf(err, "iterate chunk %d", f.ref)
+				}
+				chk[0].MinTime, chk[0].MaxTime = mint, maxt
+			}
+			if err := dst.WriteChunks(chk...); err != nil {
+				return errors.Wrapf(err, "write chunk %d", f.ref)
+			}
+			refRemap[f.ref] = chk[0].Ref
+			nextOffset = int64(f.next)
+
+			if progress != nil {
+				done := base + int64(f.next)
+				return src.unlocked(func() error { progress(done, total); return nil })
+			}
+			return nil
+		})
+		if err != nil {
+			return refRemap, nextSegment, nextOffset, err
+		}
+		base += int64(b.Len())
+		offset = SegmentHeaderSize
+
+		if progress != nil {
+			done := base
+			if err := src.unlocked(func() error { progress(done, total); return nil }); err != nil {
+				return refRemap, seq + 1, 0, err
+			}
+		}
+	}
+	return refRemap, len(src.bs), 0, nil
+}
+
+// OverwriteChunk replaces the data and encoding of the chunk ref in the
+// chunks directory dir in place and updates its checksums, including the
+// block checksums and a time range checksum in the footer. The new data must
+// have exactly the length of the existing data, so that the offsets of all
+// following chunks are retained. The segment file is synced before
+// returning. If the directory has a manifest or a sample count index, the
+// checksum of the segment and the sample count of the chunk are updated as
+// well.
+//
+// The encoding, data and checksums of the frame are written with a single
+// positioned write and an updated footer with a second one. Neither is
+// atomic if the process or machine crashes: the chunk may be left partially
+// written, which its checksum detects, and the sidecars may still describe
+// the old chunk. Repeating the overwrite repairs both.
+//
+// Chunks of encrypted segments cannot be overwritten. For segments with a
+// footer, the encoding has to stay the same as it is recorded there. The
+// time range and tags recorded in the footer are not updated, so the new
+// data has to cover the same time range. In segments with dictionary
+// compression, newData and enc are stored as given: they have to be
+// compressed against the dictionary of the segment and carry the
+// compression marker if the existing chunk does.
+func OverwriteChunk(dir string, ref uint64, newData []byte, enc chunkenc.Encoding) error {
+	return OverwriteChunkWithNaming(dir, ref, newData, enc, nil)
+}
+
+// OverwriteChunkWithNaming is like OverwriteChunk but matches the segments
+// by naming, or NumericNaming if it is nil.
+func OverwriteChunkWithNaming(dir string, ref uint64, newData []byte, enc chunkenc.Encoding, naming NamingStrategy) error {
+	r, err := NewDirReaderWithOptions(dir, nil, &ReaderOptions{Naming: naming})
+	if err != nil {
+		return err
+	}
+	files := r.files
+
+	seq, off := unpackRef(ref)
+	if seq >= len(r.bs) {
+		r.Close()
+		return errors.Errorf("reference sequence %d out of range", seq)
+	}
+	m := r.segs[seq]
+	f, ok, err := r.readFrame(seq, off)
+	if err == nil && !ok {
+		err = errors.Errorf("no chunk at offset %d", off)
+	}
+	if err != nil {
+		r.Close()
+		return errors.Wrapf(err, "read chunk %d", ref)
+	}
+	fo := m.frameOffsets(off, f)
+
+	// Re-encode the footer before unmapping the segment as entries alias it.
+	// Updating the checksum does not change the size of the entry.
+	var footer []byte
+	if m.hasFooter {
+		var (
+			fb    = footerBuilder{hasDict: m.flags&SegmentFlagDictCompressed != 0, dict: m.dict}
+			buf   [binary.MaxVarintLen32]byte
+			h     = newCRC32()
+			bound bool
+		)
+		if err := writeHash(h, buf[:], enc, newData); err != nil {
+			r.Close()
+			return err
+		}
+		for _, e := range m.footer {
+			if e.off == off && e.flags&footerFlagTimeRangeSum != 0 {
+				e.sum = timeRangeSum(h.Sum(nil), e.mint, e.maxt)
+				bound = true
+			}
+			fb.add(e)
+		}
+		if bound {
+			footer = fb.encode()
+		}
+	}
+
+	// Unmap the segment before modifying it.
+	if err := r.Close(); err != nil {
+		return err
+	}
+	switch {
+	case m.flags&SegmentFlagEncrypted != 0:
+		return errors.Errorf("chunk %d is encrypted", ref)
+	case len(newData) != fo.length:
+		return errors.Errorf("new chunk length %d differs from existing length %d", len(newData), fo.length)
+	case m.hasFooter && enc != f.enc:
+		return errors.Errorf("new encoding %s differs from encoding %s recorded in footer", enc, f.enc)
+	}
+
+	sf, err := os.OpenFile(files[seq], os.O_RDWR, 0666)
+	if err != nil {
+		return err
+	}
+	if err := writeFrameAt(sf, fo, enc, newData, m.crcInterval); err != nil {
+		sf.Close()
+		return err
+	}
+	if footer != nil {
+		if _, err := sf.WriteAt(footer, int64(m.dataEnd)); err != nil {
+			sf.Close()
+			return err
+		}
+	}
+	if err := fileutil.Fsync(sf); err != nil {
+		sf.Close()
+		return err
+	}
+	if err := sf.Close(); err != nil {
+		return err
+	}
+	return errors.Wrap(updateSidecars(dir, files[seq], ref, naming), "update sidecars")
+}
+
+// updateSidecars updates the manifest entry of the segment file fn and the
+// sample count of the chunk ref of the chunks directory dir after the chunk
+// was overwritten. Sidecars that do not exist are left alone.
+func updateSidecars(dir, fn string, ref uint64, naming NamingStrategy) error {
+	seq, _ := unpackRef(ref)
+
+	segs, err := readManifest(dir)
+	switch {
+	case err == nil:
+		if seq >= len(segs) {
+			return errors.Errorf("manifest lists %d segments, no segment %d", len(segs), seq)
+		}
+		size, sum, err := fileChecksum(fn)
+		if err != nil {
+			return err
+		}
+		segs[seq].Size, segs[seq].CRC32 = size, sum
+
+		if err := writeManifest(dir, segs); err != nil {
+			return err
+		}
+	case !os.IsNotExist(err):
+		return err
+	}
+
+	counts, err := LoadSampleCounts(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if _, ok := counts[ref]; !ok {
+		return nil
+	}
+	r, err := NewDirReaderWithOptions(dir, nil, &ReaderOptions{Naming: naming})
+	if err != nil {
+		return err
+	}
+	c, err := r.Chunk(ref)
+	if err != nil {
+		r.Close()
+		return err
+	}
+	n := c.NumSamples()
+	if err := r.Close(); err != nil {
+		return err
+	}
+	if n > math.MaxUint16 {
+		n = math.MaxUint16
+	}
+	counts[ref] = uint16(n)
+
+	return writeSampleCounts(dir, sortedSampleCounts(counts))
+}
+
+// frameOffsets holds the positions of the parts of a chunk frame that are
+// rewritten when its data is replaced in place.
+type frameOffsets struct {
+	enc, data, sums, crc int
+	length               int
+}
+
+// frameOffsets returns the positions of the parts of the frame f at offset
+// off of the segment.
+func (m *segmentMeta) frameOffsets(off int, f chunkFrame) frameOffsets {
+	var buf [binary.MaxVarintLen32]byte
+	encOff := off + binary.PutUvarint(buf[:], uint64(len(f.data)))
+	if m.flags&SegmentFlagFixedFrameLength != 0 {
+		encOff += frameLengthSize
+	}
+	leading := m.flags&SegmentFlagLeadingCRC != 0
+	end := f.next
+	if !leading {
+		end -= crc32Size
+	}
+	fo := frameOffsets{enc: encOff, crc: end, sums: end - len(f.sums), length: len(f.data)}
+	fo.data = fo.sums - len(f.data)
+	if leading {
+		fo.crc = fo.data - crc32Size
+	}
+	return fo
+}
+
+// writeFrameAt writes the encoding, data, block checksums and checksum of a
+// frame at the positions fo of the segment file sf. data must have the
+// length of the existing data. The parts are assembled in a copy of the
+// frame, which is written back with a single write.
+func writeFrameAt(sf *os.File, fo frameOffsets, enc chunkenc.Encoding, data []byte, crcInterval int) error {
+	var buf [binary.MaxVarintLen32]byte
+
+	h := newCRC32()
+	if err := writeHash(h, buf[:], enc, data); err != nil {
+		return err
+	}
+	sums := appendBlockSums(nil, data, crcInterval)
+
+	end := fo.crc + crc32Size
+	if e := fo.sums + len(sums); e > end {
+		end = e
+	}
+	frame := make([]byte, end-fo.enc)
+	if _, err := sf.ReadAt(frame, int64(fo.enc)); err != nil {
+		return errors.Wrap(err, "read frame")
+	}
+	frame[0] = byte(enc)
+	copy(frame[fo.data-fo.enc:], data)
+	copy(frame[fo.sums-fo.enc:], sums)
+	copy(frame[fo.crc-fo.enc:], h.Sum(nil))
+
+	_, err := sf.WriteAt(frame, int64(fo.enc))
+	return err
+}
+
+// RepairFromReplica replaces the chunks of targetDir whose checksum does not
+// match with the same chunks of sourceDir, a replica of the same block, in
+// place. A chunk is only copied if its checksum matches in sourceDir and its
+// length and encoding equal those of the corrupted chunk. It returns the
+// references of the repaired chunks and of the corrupted chunks that could
+// not be repaired, e.g. because they are corrupted in sourceDir as well.
+// Chunks of encrypted and dictionary compressed segments are never
+// repaired, as their stored data depends on the key or dictionary of the
+// segment, which may differ between replicas. Every repaired segment file
+// is opened and synced once.
+//
+// Frames whose length cannot be parsed make the rest of their segment
+// unreadable and cause an error, as a corruption the size of a chunk cannot
+// be repaired by copying a single chunk.
+func RepairFromReplica(targetDir, sourceDir string, pool chunkenc.Pool) (repaired []uint64, unrepairable []uint64, err error) {
+	return RepairFromReplicaWithNaming(targetDir, sourceDir, pool, nil)
+}
+
+// RepairFromReplicaWithNaming is like RepairFromReplica but matches the
+// segments of both directories by naming, or NumericNaming if it is nil.
+func RepairFromReplicaWithNaming(targetDir, sourceDir string, pool chunkenc.Pool, naming NamingStrategy) (repaired []uint64, unrepairable []uint64, err error) {
+	ropts := &ReaderOptions{Naming: naming}
+
+	target, err := NewDirReaderWithOptions(targetDir, pool, ropts)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "open target")
+	}
+	type corruptChunk struct {
+		ref         uint64
+		enc         chunkenc.Encoding
+		offsets     frameOffsets
+		crcInterval int
+		unsupported bool
+	}
+	var (
+		files     = target.files
+		corrupted []corruptChunk
+		h         = newCRC32()
+		buf       = make([]byte, crc32Size)
+	)
+	for seq := range target.bs {
+		m := &target.segs[seq]
+		if m.err != nil {
+			target.Close()
+			return nil, nil, m.err
+		}
+		err := target.scanSegment(seq, func(f chunkFrame) error {
+			_, off := unpackRef(f.ref)
+			if m.tombstoned(off) || verifyFrame(h, buf, f) == nil {
+				return nil
+			}
+			corrupted = append(corrupted, corruptChunk{
+				ref:         f.ref,
+				enc:         f.enc,
+				offsets:     m.frameOffsets(off, f),
+				crcInterval: m.crcInterval,
+				unsupported: m.flags&(SegmentFlagEncrypted|SegmentFlagDictCompressed) != 0,
+			})
+			return nil
+		})
+		if err != nil {
+			target.Close()
+			return nil, nil, errors.Wrapf(err, "scan segment %d of target", seq)
+		}
+	}
+	if err := target.Close(); err != nil {
+		return nil, nil, err
+	}
+	if len(corrupted) == 0 {
+		return nil, nil, nil
+	}
+
+	source, err := NewDirReaderWithOptions(sourceDir, pool, ropts)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "open source")
+	}
+	type replacement struct {
+		corruptChunk
+		data []byte
+	}
+	var good []replacement
+
+	for _, c := range corrupted {
+		if c.unsupported {
+			unrepairable = append(unrepairable, c.ref)
+			continue
+		}
+		seq, f, err := source.lookupFrame(c.ref)
+		if err != nil || source.segs[seq].flags&(SegmentFlagEncrypted|SegmentFlagDictCompressed) != 0 ||
+			verifyFrame(h, buf, f) != nil || len(f.data) != c.offsets.length || f.enc != c.enc {
+			unrepairable = append(unrepairable, c.ref)
+			continue
+		}
+		// Copy the data as the source is unmapped before the target is
+		// written.
+		good = append(good, replacement{corruptChunk: c, data: append([]byte(nil), f.data...)})
+	}
+	if err := source.Close(); err != nil {
+		return nil, nil, err
+	}
+
+	// Replacements are in segment order, so every segment file is opened
+	// once.
+	for i := 0; i < len(good); {
+		seq, _ := unpackRef(good[i].ref)
+
+		sf, err := os.OpenFile(files[seq], os.O_RDWR, 0666)
+		if err != nil {
+			return repaired, unrepairable, errors.Wrapf(err, "open segment %d", seq)
+		}
+		for ; i < len(good); i++ {
+			g := good[i]
+			if s, _ := unpackRef(g.ref); s != seq {
+				break
+			}
+			if err := writeFrameAt(sf, g.offsets, g.enc, g.data, g.crcInterval); err != nil {
+				sf.Close()
+				return repaired, unrepairable, errors.Wrapf(err, "overwrite chunk %d", g.ref)
+			}
+			repaired = append(repaired, g.ref)
+		}
+		if err := fileutil.Fsync(sf); err != nil {
+			sf.Close()
+			return repaired, unrepairable, errors.Wrapf(err, "sync segment %d", seq)
+		}
+		if err := sf.Close(); err != nil {
+			return repaired, unrepairable, err
+		}
+	}
+	return repaired, unrepairable, nil
+}
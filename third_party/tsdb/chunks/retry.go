@@ -0,0 +1,77 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunks
+
+import (
+	"io"
+	"time"
+)
+
+// RetryPolicy configures how a Writer retries failed file operations.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of times an operation is attempted,
+	// including the first attempt.
+	MaxAttempts int
+	// Backoff is the delay before the first retry. It doubles with every
+	// further retry.
+	Backoff time.Duration
+	// IsTransient reports whether an operation that failed with err may
+	// succeed when retried. Other errors are returned immediately.
+	IsTransient func(err error) bool
+}
+
+// retry runs op until it succeeds, fails with a non-transient error, or the
+// attempts allowed by the retry policy are exhausted.
+func (w *Writer) retry(op func() error) error {
+	p := w.opts.RetryPolicy
+	if p == nil || p.IsTransient == nil {
+		return op()
+	}
+	backoff := p.Backoff
+
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil || attempt >= p.MaxAttempts || !p.IsTransient(err) {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// retryWriter retries writes to the underlying writer according to the
+// retry policy of the Writer. Retrying must happen below the buffered writer
+// as it does not accept further writes after the first failed one.
+type retryWriter struct {
+	w  *Writer
+	wr io.Writer
+}
+
+func (rw retryWriter) Write(b []byte) (n int, err error) {
+	err = rw.w.retry(func() error {
+		m, err := rw.wr.Write(b[n:])
+		n += m
+		return err
+	})
+	return n, err
+}
+
+// segmentWriter returns the writer that data for the segment file f is
+// written to.
+func (w *Writer) segmentWriter(f io.Writer) io.Writer {
+	if w.opts.RetryPolicy == nil {
+		return f
+	}
+	return retryWriter{w: w, wr: f}
+}
@@ -0,0 +1,451 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunks
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/tsdb/chunkenc"
+	"github.com/prometheus/tsdb/fileutil"
+)
+
+// Sidecar files written next to the segments. Their names are not numeric
+// and are thus never mistaken for sequence files.
+const (
+	provenanceFilename   = "provenance.json"
+	sampleCountsFilename = "samples.idx"
+	segmentNamesFilename = "segments.json"
+	manifestFilename     = "manifest.json"
+)
+
+// Provenance records which writer created a chunks directory.
+type Provenance struct {
+	WriterVersion string `json:"writerVersion"`
+	// Hostname defaults to the hostname reported by the kernel.
+	Hostname string `json:"hostname"`
+
+	// PID and Created are set by the Writer when the directory is closed.
+	PID     int       `json:"pid"`
+	Created time.Time `json:"created"`
+}
+
+// writeProvenance writes the provenance sidecar of the Writer.
+func (w *Writer) writeProvenance() error {
+	p := *w.opts.Provenance
+	if p.Hostname == "" {
+		p.Hostname, _ = os.Hostname()
+	}
+	p.PID = os.Getpid()
+	p.Created = time.Now().UTC()
+
+	return writeSidecar(w.dirFile.Name(), provenanceFilename, func(wr io.Writer) error {
+		enc := json.NewEncoder(wr)
+		enc.SetIndent("", "\t")
+		return enc.Encode(&p)
+	})
+}
+
+// ReadProvenance returns the provenance recorded for the chunks directory dir.
+func ReadProvenance(dir string) (*Provenance, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, provenanceFilename))
+	if err != nil {
+		return nil, err
+	}
+	var p Provenance
+
+	if err := json.Unmarshal(b, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// The sample count index holds the number of entries, one fixed size entry
+// per chunk and a checksum over both:
+//
+//   ┌───────────────┬──────────┬───────────────┬─────┬────────────┐
+//   │ #entries <4b> │ ref <8b> │ #samples <2b> │ ... │ CRC32 <4b> │
+//   └───────────────┴──────────┴───────────────┴─────┴────────────┘
+const sampleCountEntrySize = 8 + 2
+
+// sampleCount records the number of samples of the chunk ref.
+type sampleCount struct {
+	ref   uint64
+	count uint16
+}
+
+// addSampleCount records the sample count of chunk c written as ref if the
+// sample count index is enabled.
+func (w *Writer) addSampleCount(ref uint64, c chunkenc.Chunk) {
+	if !w.opts.WriteSampleCountIndex {
+		return
+	}
+	n := c.NumSamples()
+	if n > math.MaxUint16 {
+		n = math.MaxUint16
+	}
+	ref += uint64(w.baseSegments) << 32
+	w.sampleCounts = append(w.sampleCounts, sampleCount{ref: ref, count: uint16(n)})
+}
+
+// loadSidecars loads the manifest and the sample count index of the segments
+// the directory of the Writer already holds if WriteManifest or
+// WriteSampleCountIndex is set, so that they are extended rather than
+// replaced when the Writer is closed. It returns an error if a sidecar does
+// not cover all existing segments.
+func (w *Writer) loadSidecars() error {
+	if !w.opts.WriteManifest && !w.opts.WriteSampleCountIndex {
+		return nil
+	}
+	dir := w.dirFile.Name()
+
+	files, err := sequenceFilesNamed(dir, w.opts.Naming)
+	if err != nil {
+		return err
+	}
+	n := len(files)
+	if n == 0 {
+		return nil
+	}
+	if w.opts.WriteManifest {
+		segs, err := readManifest(dir)
+		if err != nil {
+			return errors.Wrapf(err, "read manifest of %d existing segments", n)
+		}
+		if len(segs) != n {
+			return errors.Errorf("manifest lists %d segments but directory holds %d", len(segs), n)
+		}
+		w.manifest = segs
+	}
+	if w.opts.WriteSampleCountIndex {
+		counts, err := LoadSampleCounts(dir)
+		if err != nil {
+			return errors.Wrapf(err, "load sample count index of %d existing segments", n)
+		}
+		for ref := range counts {
+			if seq, _ := unpackRef(ref); seq >= n {
+				return errors.Errorf("sample count index holds chunk %d beyond the %d existing segments", ref, n)
+			}
+		}
+		w.sampleCounts = sortedSampleCounts(counts)
+	}
+	w.baseSegments = n
+	return nil
+}
+
+// writeSampleCounts writes the sample count index sidecar of the Writer.
+func (w *Writer) writeSampleCounts() error {
+	return writeSampleCounts(w.dirFile.Name(), w.sampleCounts)
+}
+
+// writeSampleCounts writes counts as the sample count index sidecar of the
+// chunks directory dir.
+func writeSampleCounts(dir string, counts []sampleCount) error {
+	return writeSidecar(dir, sampleCountsFilename, func(wr io.Writer) error {
+		var (
+			h   = newCRC32()
+			mw  = io.MultiWriter(wr, h)
+			buf [sampleCountEntrySize]byte
+		)
+		binary.BigEndian.PutUint32(buf[:4], uint32(len(counts)))
+		if _, err := mw.Write(buf[:4]); err != nil {
+			return err
+		}
+		for _, sc := range counts {
+			binary.BigEndian.PutUint64(buf[:8], sc.ref)
+			binary.BigEndian.PutUint16(buf[8:], sc.count)
+			if _, err := mw.Write(buf[:]); err != nil {
+				return err
+			}
+		}
+		_, err := wr.Write(h.Sum(buf[:0]))
+		return err
+	})
+}
+
+// sortedSampleCounts returns the sample counts of counts in order of their
+// reference, which is the order in which a Writer records them.
+func sortedSampleCounts(counts map[uint64]uint16) []sampleCount {
+	res := make([]sampleCount, 0, len(counts))
+	for ref, c := range counts {
+		res = append(res, sampleCount{ref: ref, count: c})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].ref < res[j].ref })
+	return res
+}
+
+// LoadSampleCounts returns the number of samples of every chunk recorded in
+// the sample count index of the chunks directory dir.
+func LoadSampleCounts(dir string) (map[uint64]uint16, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, sampleCountsFilename))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < 4+crc32Size {
+		return nil, errors.Wrap(errInvalidSize, "sample count index")
+	}
+	body, sum := b[:len(b)-crc32Size], b[len(b)-crc32Size:]
+
+	if crc32Checksum(body) != binary.BigEndian.Uint32(sum) {
+		return nil, errors.Wrap(errInvalidChecksum, "sample count index")
+	}
+	n := int(binary.BigEndian.Uint32(body[:4]))
+	body = body[4:]
+
+	if len(body) != n*sampleCountEntrySize {
+		return nil, errors.Wrapf(errInvalidSize, "sample count index of %d bytes for %d entries", len(body), n)
+	}
+	counts := make(map[uint64]uint16, n)
+
+	for ; len(body) > 0; body = body[sampleCountEntrySize:] {
+		counts[binary.BigEndian.Uint64(body)] = binary.BigEndian.Uint16(body[8:])
+	}
+	return counts, nil
+}
+
+// TotalSamples returns the number of samples of all chunks in the chunks
+// directory dir, excluding tombstoned chunks. If the directory has a sample
+// count index, the counts are taken from it without reading any chunk data
+// and indexed is true. Otherwise every chunk is decoded, which is as
+// expensive as a full scan of the directory, and indexed is false.
+func TotalSamples(dir string, pool chunkenc.Pool) (total int64, indexed bool, err error) {
+	return TotalSamplesWithNaming(dir, pool, nil)
+}
+
+// TotalSamplesWithNaming is like TotalSamples but matches the segments by
+// naming, or NumericNaming if it is nil.
+func TotalSamplesWithNaming(dir string, pool chunkenc.Pool, naming NamingStrategy) (total int64, indexed bool, err error) {
+	counts, err := LoadSampleCounts(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, false, errors.Wrap(err, "load sample counts")
+	}
+	r, err := NewDirReaderWithOptions(dir, pool, &ReaderOptions{Naming: naming})
+	if err != nil {
+		return 0, false, err
+	}
+	defer r.Close()
+
+	if counts != nil {
+		for ref, n := range counts {
+			if seq, off := unpackRef(ref); seq < len(r.segs) && r.segs[seq].tombstoned(off) {
+				continue
+			}
+			total += int64(n)
+		}
+		return total, true, nil
+	}
+	for seq := range r.bs {
+		err := r.scanSegment(seq, func(f chunkFrame) error {
+			if _, off := unpackRef(f.ref); r.segs[seq].tombstoned(off) {
+				return nil
+			}
+			c, err := r.scanDecode(seq, f)
+			if err != nil {
+				return errors.Wrapf(err, "decode chunk %d", f.ref)
+			}
+			total += int64(c.NumSamples())
+			r.pool.Put(c)
+			return nil
+		})
+		if err != nil {
+			return 0, false, err
+		}
+	}
+	return total, false, nil
+}
+
+// manifest lists the segments of a chunks directory.
+type manifest struct {
+	Segments []manifestSegment `json:"segments"`
+}
+
+// manifestSegment describes a single segment file in the manifest.
+type manifestSegment struct {
+	Index int    `json:"index"`
+	File  string `json:"file"`
+	Size  int64  `json:"size"`
+	// CRC32 with the package's polynomial over the whole file.
+	CRC32 uint32 `json:"crc32"`
+}
+
+// writeManifest writes the manifest sidecar of the Writer.
+func (w *Writer) writeManifest() error {
+	return writeManifest(w.dirFile.Name(), w.manifest)
+}
+
+// writeManifest writes segs as the manifest sidecar of the chunks directory
+// dir.
+func writeManifest(dir string, segs []manifestSegment) error {
+	return writeSidecar(dir, manifestFilename, func(wr io.Writer) error {
+		enc := json.NewEncoder(wr)
+		enc.SetIndent("", "\t")
+		return enc.Encode(&manifest{Segments: segs})
+	})
+}
+
+// readManifest returns the segments listed in the manifest sidecar of the
+// chunks directory dir.
+func readManifest(dir string) ([]manifestSegment, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, manifestFilename))
+	if err != nil {
+		return nil, err
+	}
+	var m manifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, errors.Wrap(err, "decode manifest")
+	}
+	return m.Segments, nil
+}
+
+// truncateSidecars drops everything describing the segments with an index
+// of n or higher from the sidecars of the chunks directory dir, e.g. after
+// these segments were removed. Sidecars that do not exist are left alone.
+func truncateSidecars(dir string, n int) error {
+	segs, err := readManifest(dir)
+	switch {
+	case err == nil:
+		if len(segs) > n {
+			segs = segs[:n]
+		}
+		if err := writeManifest(dir, segs); err != nil {
+			return errors.Wrap(err, "write manifest")
+		}
+	case !os.IsNotExist(err):
+		return err
+	}
+
+	counts, err := LoadSampleCounts(dir)
+	switch {
+	case err == nil:
+		for ref := range counts {
+			if seq, _ := unpackRef(ref); seq >= n {
+				delete(counts, ref)
+			}
+		}
+		if err := writeSampleCounts(dir, sortedSampleCounts(counts)); err != nil {
+			return errors.Wrap(err, "write sample count index")
+		}
+	case !os.IsNotExist(err):
+		return errors.Wrap(err, "load sample count index")
+	}
+
+	names, err := readSegmentNames(dir)
+	switch {
+	case err == nil:
+		if len(names) > n {
+			names = names[:n]
+		}
+		if err := writeSegmentNames(dir, names); err != nil {
+			return errors.Wrap(err, "write segment names")
+		}
+	case !os.IsNotExist(err):
+		return errors.Wrap(err, "read segment names")
+	}
+	return nil
+}
+
+// VerifyManifest checks the segments of the chunks directory dir against the
+// manifest written by a Writer with WriteManifest set. Every segment file is
+// read once to recompute its checksum. It returns an error describing the
+// first mismatch.
+func VerifyManifest(dir string) error {
+	return VerifyManifestWithNaming(dir, nil)
+}
+
+// VerifyManifestWithNaming is like VerifyManifest but matches the segments
+// by naming, or NumericNaming if it is nil.
+func VerifyManifestWithNaming(dir string, naming NamingStrategy) error {
+	segs, err := readManifest(dir)
+	if err != nil {
+		return err
+	}
+	files, err := sequenceFilesNamed(dir, naming)
+	if err != nil {
+		return err
+	}
+	if len(files) != len(segs) {
+		return errors.Errorf("manifest lists %d segments but directory holds %d", len(segs), len(files))
+	}
+	for i, e := range segs {
+		if name := filepath.Base(files[i]); e.Index != i || name != e.File {
+			return errors.Errorf("segment %d: file %s does not match manifest entry %d for %s", i, name, e.Index, e.File)
+		}
+		size, sum, err := fileChecksum(files[i])
+		if err != nil {
+			return errors.Wrapf(err, "segment %d", i)
+		}
+		if size != e.Size {
+			return errors.Errorf("segment %d (%s): size %d differs from %d in manifest", i, e.File, size, e.Size)
+		}
+		if sum != e.CRC32 {
+			return errors.Wrapf(errInvalidChecksum, "segment %d (%s): read: %x, manifest: %x", i, e.File, sum, e.CRC32)
+		}
+	}
+	return nil
+}
+
+// fileChecksum returns the size and checksum of the file fn.
+func fileChecksum(fn string) (int64, uint32, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	h := newCRC32()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return 0, 0, err
+	}
+	return n, h.Sum32(), nil
+}
+
+// writeSidecar atomically replaces the file name in dir with the contents
+// written by write.
+func writeSidecar(dir, name string, write func(io.Writer) error) error {
+	path := filepath.Join(dir, name)
+	tmp := path + ".tmp"
+
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(f)
+
+	if err := write(bw); err != nil {
+		f.Close()
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := fileutil.Fsync(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return fileutil.Rename(tmp, path)
+}
@@ -0,0 +1,102 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunks
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/tsdb/chunkenc"
+	"github.com/prometheus/tsdb/fileutil"
+)
+
+// Snapshot returns a Reader against all chunks written so far. Finalized
+// segments are mapped from their files while the part of the tail segment
+// written so far is copied into memory, so the Reader does not observe
+// chunks written after the snapshot. References of the Writer resolve against
+// the Reader. Snapshot must not be called concurrently with writes.
+func (w *Writer) Snapshot(pool chunkenc.Pool) (*Reader, error) {
+	if w.aborted {
+		return nil, errWriterAborted
+	}
+	if w.wbuf != nil {
+		if err := w.wbuf.Flush(); err != nil {
+			return nil, err
+		}
+	}
+	if pool == nil {
+		pool = chunkenc.NewPool()
+	}
+	var (
+		bs  []ByteSlice
+		cs  []io.Closer
+		dir = w.dirFile.Name()
+	)
+	// All but the tail segment are finalized.
+	for i := 0; i < len(w.files)-1; i++ {
+		fn := w.files[i].Name()
+		if i < len(w.segmentNames) {
+			fn = filepath.Join(dir, w.segmentNames[i])
+		}
+		mf, err := fileutil.OpenMmapFile(fn)
+		if err != nil {
+			closeAll(cs...)
+			return nil, errors.Wrapf(err, "mmap segment %d", i)
+		}
+		cs = append(cs, mf)
+		bs = append(bs, realByteSlice(mf.Bytes()))
+	}
+	if tf := w.tail(); tf != nil {
+		b, err := readPrefix(tf.Name(), w.n)
+		if err != nil {
+			closeAll(cs...)
+			return nil, errors.Wrap(err, "read tail segment")
+		}
+		bs = append(bs, realByteSlice(b))
+	}
+	r, err := newReader(bs, cs, nil, pool, DefaultReaderOptions)
+	if err != nil {
+		closeAll(cs...)
+		return nil, err
+	}
+	r.openSeq = len(bs) - 1
+	return r, nil
+}
+
+// readPrefix reads the first n bytes of the file fn.
+func readPrefix(fn string, n int64) ([]byte, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	b := make([]byte, n)
+	if _, err := io.ReadFull(f, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// IsRefInOpenSegment reports whether ref points into the segment the Writer
+// was still appending to when the Reader was created by Writer.Snapshot.
+// Chunks in that segment are complete, but the segment is not finalized yet
+// and may still change, e.g. be renamed, truncated or get a footer. It
+// always returns false for Readers not created by Writer.Snapshot.
+func (s *Reader) IsRefInOpenSegment(ref uint64) bool {
+	seq, _ := unpackRef(ref)
+	return s.openSeq >= 0 && seq == s.openSeq
+}
@@ -0,0 +1,350 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunks
+
+import (
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/tsdb/chunkenc"
+)
+
+// ChunkStats summarizes the chunk layout of a block.
+type ChunkStats struct {
+	Segments int
+	Chunks   int
+	// SegmentBytes is the total size of all segments including headers,
+	// chunk framing and checksums. ChunkBytes only counts chunk data.
+	SegmentBytes int64
+	ChunkBytes   int64
+	Encodings    map[chunkenc.Encoding]int
+	// MinTime and MaxTime span the samples of all chunks. Both are zero
+	// if the block holds no samples.
+	MinTime, MaxTime int64
+	AvgChunkSize     float64
+}
+
+// Stats walks all segments once and summarizes the chunks they hold.
+// For segments with a footer the stored time ranges are used and chunks are
+// only decoded if their time range is unknown, e.g. for placeholders. Chunks
+// of all other segments are decoded to determine their time range.
+// Tombstoned chunks are skipped.
+func (s *Reader) Stats() (ChunkStats, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	if s.closed {
+		return ChunkStats{}, errReaderClosed
+	}
+
+	st := ChunkStats{
+		Segments:  len(s.bs),
+		Encodings: map[chunkenc.Encoding]int{},
+		MinTime:   math.MaxInt64,
+		MaxTime:   math.MinInt64,
+	}
+	add := func(enc chunkenc.Encoding, length int, mint, maxt int64, ok bool) {
+		st.Chunks++
+		st.ChunkBytes += int64(length)
+		st.Encodings[enc]++
+
+		if ok && mint < st.MinTime {
+			st.MinTime = mint
+		}
+		if ok && maxt > st.MaxTime {
+			st.MaxTime = maxt
+		}
+	}
+	for seq, b := range s.bs {
+		st.SegmentBytes += int64(b.Len())
+		m := &s.segs[seq]
+
+		if m.hasFooter {
+			for _, e := range m.footer {
+				if e.flags&footerFlagTombstone != 0 {
+					continue
+				}
+				mint, maxt, ok := e.mint, e.maxt, true
+				if mint == math.MinInt64 && maxt == math.MaxInt64 {
+					_, f, err := s.lookupFrame(packRef(seq, e.off))
+					if err != nil {
+						return ChunkStats{}, errors.Wrapf(err, "segment %d: footer offset %d", seq, e.off)
+					}
+					if mint, maxt, ok, err = s.frameTimeRange(seq, f); err != nil {
+						return ChunkStats{}, err
+					}
+				}
+				add(m.chunkEncoding(e.enc), e.length, mint, maxt, ok)
+			}
+			continue
+		}
+		err := s.scanSegment(seq, func(f chunkFrame) error {
+			mint, maxt, ok, err := s.frameTimeRange(seq, f)
+			if err != nil {
+				return err
+			}
+			add(m.chunkEncoding(f.enc), len(f.data), mint, maxt, ok)
+			return nil
+		})
+		if err != nil {
+			return ChunkStats{}, err
+		}
+	}
+	if st.MinTime > st.MaxTime {
+		st.MinTime, st.MaxTime = 0, 0
+	}
+	if st.Chunks > 0 {
+		st.AvgChunkSize = float64(st.ChunkBytes) / float64(st.Chunks)
+	}
+	return st, nil
+}
+
+// EncStatEntry summarizes the chunks of a single encoding.
+type EncStatEntry struct {
+	Encoding chunkenc.Encoding
+	Count    int
+	// Bytes is the size of the stored chunk data.
+	Bytes int64
+	// Percent is the share of chunks of the encoding in all chunks.
+	Percent float64
+}
+
+// EncodingStatsSorted returns the number and size of the chunks of every
+// encoding in the chunks directory dir, ordered by encoding. Chunks are not
+// decoded.
+func EncodingStatsSorted(dir string, pool chunkenc.Pool) ([]EncStatEntry, error) {
+	return EncodingStatsSortedWithNaming(dir, pool, nil)
+}
+
+// EncodingStatsSortedWithNaming is like EncodingStatsSorted but matches the
+// segments by naming, or NumericNaming if it is nil.
+func EncodingStatsSortedWithNaming(dir string, pool chunkenc.Pool, naming NamingStrategy) ([]EncStatEntry, error) {
+	r, err := NewDirReaderWithOptions(dir, pool, &ReaderOptions{Naming: naming})
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var (
+		byEnc = map[chunkenc.Encoding]*EncStatEntry{}
+		total int
+	)
+	for seq := range r.bs {
+		m := &r.segs[seq]
+
+		err := r.scanSegment(seq, func(f chunkFrame) error {
+			enc := m.chunkEncoding(f.enc)
+			e, ok := byEnc[enc]
+			if !ok {
+				e = &EncStatEntry{Encoding: enc}
+				byEnc[enc] = e
+			}
+			e.Count++
+			e.Bytes += int64(len(f.data))
+			total++
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	res := make([]EncStatEntry, 0, len(byEnc))
+	for _, e := range byEnc {
+		e.Percent = 100 * float64(e.Count) / float64(total)
+		res = append(res, *e)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Encoding < res[j].Encoding })
+	return res, nil
+}
+
+// SampleStats estimates the Stats of the Reader from a random sample of
+// chunks. Every chunk is picked with probability fraction, which must be in
+// (0, 1], and the same seed always picks the same chunks. Only picked chunks
+// are decoded, and for segments with a footer all other chunks are skipped
+// without being read.
+//
+// Chunk counts and sizes are extrapolated from the sample, while the time
+// range only spans the picked chunks. SegmentBytes and Segments are exact.
+func (s *Reader) SampleStats(fraction float64, seed int64) (ChunkStats, error) {
+	if !(fraction > 0 && fraction <= 1) {
+		return ChunkStats{}, errors.Errorf("sample fraction %v not in (0, 1]", fraction)
+	}
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	if s.closed {
+		return ChunkStats{}, errReaderClosed
+	}
+	var (
+		rng = rand.New(rand.NewSource(seed))
+		st  = ChunkStats{
+			Segments:  len(s.bs),
+			Encodings: map[chunkenc.Encoding]int{},
+			MinTime:   math.MaxInt64,
+			MaxTime:   math.MinInt64,
+		}
+		encodings = map[chunkenc.Encoding]int{}
+		chunks    int
+		bytes     int64
+	)
+	sample := func(seq int, f chunkFrame) error {
+		chunks++
+		bytes += int64(len(f.data))
+		encodings[s.segs[seq].chunkEncoding(f.enc)]++
+
+		mint, maxt, ok, err := s.frameTimeRange(seq, f)
+		if err != nil {
+			return err
+		}
+		if ok && mint < st.MinTime {
+			st.MinTime = mint
+		}
+		if ok && maxt > st.MaxTime {
+			st.MaxTime = maxt
+		}
+		return nil
+	}
+	for seq, b := range s.bs {
+		st.SegmentBytes += int64(b.Len())
+
+		if m := s.segs[seq]; m.hasFooter {
+			for _, e := range m.footer {
+				if e.flags&footerFlagTombstone != 0 || rng.Float64() >= fraction {
+					continue
+				}
+				_, f, err := s.lookupFrame(packRef(seq, e.off))
+				if err != nil {
+					return ChunkStats{}, errors.Wrapf(err, "segment %d: footer offset %d", seq, e.off)
+				}
+				if err := sample(seq, f); err != nil {
+					return ChunkStats{}, err
+				}
+			}
+			continue
+		}
+		err := s.scanSegment(seq, func(f chunkFrame) error {
+			if rng.Float64() >= fraction {
+				return nil
+			}
+			return sample(seq, f)
+		})
+		if err != nil {
+			return ChunkStats{}, err
+		}
+	}
+	if st.MinTime > st.MaxTime {
+		st.MinTime, st.MaxTime = 0, 0
+	}
+	st.Chunks = int(math.Round(float64(chunks) / fraction))
+	st.ChunkBytes = int64(math.Round(float64(bytes) / fraction))
+	for enc, n := range encodings {
+		st.Encodings[enc] = int(math.Round(float64(n) / fraction))
+	}
+	if chunks > 0 {
+		st.AvgChunkSize = float64(bytes) / float64(chunks)
+	}
+	return st, nil
+}
+
+// frameTimeRange decodes the chunk of f and returns the timestamps of its
+// first and last sample. It returns ok=false if the chunk holds no samples.
+func (s *Reader) frameTimeRange(seq int, f chunkFrame) (mint, maxt int64, ok bool, err error) {
+	c, err := s.scanDecode(seq, f)
+	if err != nil {
+		return 0, 0, false, errors.Wrapf(err, "decode chunk %d", f.ref)
+	}
+	defer s.pool.Put(c)
+
+	mint, maxt, ok, err = chunkTimeRange(c)
+	return mint, maxt, ok, errors.Wrapf(err, "iterate chunk %d", f.ref)
+}
+
+// chunkTimeRange returns the timestamps of the first and last sample of c.
+func chunkTimeRange(c chunkenc.Chunk) (mint, maxt int64, ok bool, err error) {
+	it := c.Iterator()
+	for it.Next() {
+		t, _ := it.At()
+		if !ok {
+			mint, ok = t, true
+		}
+		maxt = t
+	}
+	return mint, maxt, ok, it.Err()
+}
+
+// MemStats describes the memory a Reader is responsible for.
+type MemStats struct {
+	// MmapBytes is the size of all memory-mapped segment files. They are
+	// part of the resident set only as far as they were accessed recently.
+	MmapBytes int64
+	// CacheBytes is the size of decoded chunks held by the Reader's cache.
+	// It is zero if ReaderOptions.DecodedCacheSize is not set.
+	CacheBytes int64
+	// BufferBytes is the size of segments the Reader read into heap memory.
+	BufferBytes int64
+}
+
+// MemoryUsage returns an estimate of the memory the Reader is responsible
+// for. Byte slices passed to NewReader are owned by the caller and are not
+// accounted for.
+func (s *Reader) MemoryUsage() MemStats {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	var ms MemStats
+	for _, b := range s.bs {
+		switch {
+		case s.ownsBuffers:
+			ms.BufferBytes += int64(b.Len())
+		case s.files != nil:
+			ms.MmapBytes += int64(b.Len())
+		}
+	}
+	if s.cache != nil {
+		ms.CacheBytes = s.cache.bytes()
+	}
+	return ms
+}
+
+// ErrNoSegmentFiles is returned by SegmentModTimes for Readers whose segments
+// are not backed by files, e.g. ones created by NewReader. Use errors.Cause
+// to match it.
+var ErrNoSegmentFiles = errors.New("segments are not backed by files")
+
+// SegmentModTimes returns the modification time of the file of every
+// segment as reported by the file system, which is the time the segment was
+// finalized unless it was modified later, e.g. by OverwriteChunk. For
+// Readers without segment files it returns zero times and
+// ErrNoSegmentFiles.
+func (s *Reader) SegmentModTimes() ([]time.Time, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	times := make([]time.Time, len(s.bs))
+	if s.ownsBuffers || len(s.files) != len(s.bs) {
+		return times, ErrNoSegmentFiles
+	}
+	for i, fn := range s.files {
+		fi, err := os.Stat(fn)
+		if err != nil {
+			return nil, errors.Wrapf(err, "stat segment %d", i)
+		}
+		times[i] = fi.ModTime()
+	}
+	return times, nil
+}
@@ -0,0 +1,171 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunks
+
+import (
+	"bytes"
+	"hash"
+	"io"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/tsdb/chunkenc"
+)
+
+// streamWindow is the maximum number of bytes a chunkDataReader requests
+// from the underlying ByteSlice at once.
+const streamWindow = 32 * 1024
+
+// ChunkDataReader returns the encoding and a reader over the raw data of the
+// chunk referenced by ref. The data is requested from the underlying byte
+// slice incrementally, so a chunk never has to be materialized in memory as
+// a whole. verify checks the chunk's checksum and must only be called once
+// the reader is fully consumed.
+//
+// Encrypted chunks cannot be streamed as they are authenticated as a whole,
+// and compressed chunks as their stored data is not the chunk data. Reading
+// and verify fail once the Reader is closed.
+func (s *Reader) ChunkDataReader(ref uint64) (enc chunkenc.Encoding, r io.Reader, verify func() error, err error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	if s.closed {
+		return 0, nil, nil, errReaderClosed
+	}
+	seq, off := unpackRef(ref)
+	if seq >= len(s.bs) {
+		return 0, nil, nil, errors.Errorf("reference sequence %d out of range", seq)
+	}
+	if err := s.segs[seq].err; err != nil {
+		return 0, nil, nil, err
+	}
+	if s.segs[seq].flags&SegmentFlagEncrypted != 0 {
+		return 0, nil, nil, errors.Errorf("segment %d is encrypted and cannot be streamed", seq)
+	}
+	b := s.bs[seq]
+
+	enc, start, l, ok, err := readFrameHeader(b, &s.segs[seq], off)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	if !ok {
+		return 0, nil, nil, errors.Errorf("no chunk at offset %d", off)
+	}
+	if s.segs[seq].flags&SegmentFlagDictCompressed != 0 && enc&encDictCompressed != 0 {
+		return 0, nil, nil, errors.Errorf("chunk %d is compressed and cannot be streamed", ref)
+	}
+	cr := &chunkDataReader{r: s, b: b, off: start, end: start + l, h: newCRC32()}
+
+	var buf [crc32Size]byte
+	if err := writeHash(cr.h, buf[:], enc, nil); err != nil {
+		return 0, nil, nil, err
+	}
+	crcInterval, leading := s.segs[seq].crcInterval, s.segs[seq].flags&SegmentFlagLeadingCRC != 0
+
+	verify = func() error {
+		s.mtx.RLock()
+		defer s.mtx.RUnlock()
+
+		if s.closed {
+			return errReaderClosed
+		}
+		if cr.off != cr.end {
+			return errors.Errorf("chunk data not fully consumed, %d bytes left", cr.end-cr.off)
+		}
+		crcOff := cr.end + blockSumsSize(l, crcInterval)
+		if leading {
+			crcOff = start - crc32Size
+		}
+		stored := b.Range(crcOff, crcOff+crc32Size)
+		if exp := cr.h.Sum(buf[:0]); !bytes.Equal(exp, stored) {
+			return errors.Wrapf(errInvalidChecksum, "read: %x, expected: %x", stored, exp)
+		}
+		return nil
+	}
+	return enc, cr, verify, nil
+}
+
+// ChunkFrame returns the complete stored frame of the chunk referenced by
+// ref, i.e. its length, encoding, data and checksum as laid out in the
+// segment, after verifying the checksum. Frames of segments with header
+// flags also hold the fields these flags add, e.g. a frame length or
+// padding. This allows forwarding verified chunks without re-serializing
+// them.
+//
+// The returned slice aliases the underlying byte slice unless CopyData is
+// set in the ReaderOptions.
+func (s *Reader) ChunkFrame(ref uint64) ([]byte, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	if s.closed {
+		return nil, errReaderClosed
+	}
+	seq, off := unpackRef(ref)
+	if seq >= len(s.bs) {
+		return nil, errors.Errorf("reference sequence %d out of range", seq)
+	}
+	if err := s.segs[seq].err; err != nil {
+		return nil, err
+	}
+	f, ok, err := s.readFrame(seq, off)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errors.Errorf("no chunk at offset %d", off)
+	}
+	if err := verifyFrame(newCRC32(), make([]byte, crc32Size), f); err != nil {
+		return nil, errors.Wrapf(err, "chunk %d", ref)
+	}
+	b := s.bs[seq].Range(off, f.next)
+
+	if s.opts.CopyData {
+		buf := s.opts.Alloc(len(b))
+		copy(buf, b)
+		b = buf
+	}
+	return b, nil
+}
+
+// chunkDataReader reads the byte range [off, end) of a ByteSlice of r and
+// feeds everything read into a hash.
+type chunkDataReader struct {
+	r        *Reader
+	b        ByteSlice
+	off, end int
+	h        hash.Hash
+}
+
+func (r *chunkDataReader) Read(p []byte) (int, error) {
+	r.r.mtx.RLock()
+	defer r.r.mtx.RUnlock()
+
+	if r.r.closed {
+		return 0, errReaderClosed
+	}
+	if r.off >= r.end {
+		return 0, io.EOF
+	}
+	n := len(p)
+	if n > streamWindow {
+		n = streamWindow
+	}
+	if left := r.end - r.off; n > left {
+		n = left
+	}
+	n = copy(p, r.b.Range(r.off, r.off+n))
+	r.h.Write(p[:n])
+	r.off += n
+	return n, nil
+}
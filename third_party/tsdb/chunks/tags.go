@@ -0,0 +1,138 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunks
+
+import (
+	"encoding/binary"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// MaxChunkTagsSize is the maximum encoded size of the tags of a chunk.
+const MaxChunkTagsSize = 1024
+
+// Tags are encoded as the length of the remainder followed by the number of
+// tags and a key/value pair per tag ordered by key:
+//
+//   ┌────────────┬──────────────┬────────────────────────────────┬─────┐
+//   │ len <uvar> │ #tags <uvar> │ key len <uvar> │ key <bytes>   │     │
+//   │            │              ├────────────────┼───────────────┤ ... │
+//   │            │              │ val len <uvar> │ value <bytes> │     │
+//   └────────────┴──────────────┴────────────────┴───────────────┴─────┘
+
+// encodeChunkTags returns the encoded tags. It returns nil if there are no
+// tags.
+func encodeChunkTags(tags map[string]string) ([]byte, error) {
+	if len(tags) == 0 {
+		return nil, nil
+	}
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var (
+		b    [binary.MaxVarintLen64]byte
+		body []byte
+	)
+	body = append(body, b[:binary.PutUvarint(b[:], uint64(len(tags)))]...)
+	for _, k := range keys {
+		for _, s := range []string{k, tags[k]} {
+			body = append(body, b[:binary.PutUvarint(b[:], uint64(len(s)))]...)
+			body = append(body, s...)
+		}
+	}
+	enc := append(b[:binary.PutUvarint(b[:], uint64(len(body)))], body...)
+
+	if len(enc) > MaxChunkTagsSize {
+		return nil, errors.Errorf("encoded tags of %d bytes exceed maximum of %d bytes", len(enc), MaxChunkTagsSize)
+	}
+	return enc, nil
+}
+
+// decodeChunkTags decodes tags encoded by encodeChunkTags.
+func decodeChunkTags(b []byte) (map[string]string, error) {
+	d := footerDecbuf{b: b}
+	d.b = d.uvarintBytes()
+
+	n := d.uvarint()
+	if d.err != nil {
+		return nil, d.err
+	}
+	if n > uint64(len(d.b)) {
+		return nil, errors.Wrapf(errInvalidSize, "%d tags", n)
+	}
+	tags := make(map[string]string, n)
+
+	for i := uint64(0); i < n; i++ {
+		k, v := d.uvarintBytes(), d.uvarintBytes()
+		if d.err != nil {
+			return nil, errors.Wrapf(d.err, "tag %d", i)
+		}
+		tags[string(k)] = string(v)
+	}
+	return tags, nil
+}
+
+// WriteChunkTagged writes chunk m with the given tags and returns its
+// reference. The tags are stored in the segment footer and can be read with
+// Reader.ChunkTags. Their encoded size is limited to MaxChunkTagsSize. Chunks
+// without tags do not take any additional space. Tags require format
+// version 2.
+func (w *Writer) WriteChunkTagged(m Meta, tags map[string]string) (uint64, error) {
+	if len(tags) > 0 && w.version != chunksFormatV2 {
+		return 0, errors.Errorf("chunk tags require format version %d", chunksFormatV2)
+	}
+	enc, err := encodeChunkTags(tags)
+	if err != nil {
+		return 0, err
+	}
+	chks := []Meta{m}
+
+	if err := w.writeChunks(chks, enc); err != nil {
+		return 0, err
+	}
+	return chks[0].Ref, nil
+}
+
+// ChunkTags returns the tags the chunk ref was written with. It returns an
+// empty map if the chunk has no tags. The segment of the chunk must have a
+// footer, i.e. it must have been finalized.
+func (s *Reader) ChunkTags(ref uint64) (map[string]string, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	seq, off := unpackRef(ref)
+	if seq >= len(s.bs) {
+		return nil, errors.Errorf("reference sequence %d out of range", seq)
+	}
+	m := s.segs[seq]
+	if m.err != nil {
+		return nil, m.err
+	}
+	if !m.hasFooter {
+		return nil, errors.Errorf("segment %d has no footer", seq)
+	}
+	e, ok := m.footerEntry(off)
+	if !ok {
+		return nil, errors.Errorf("no chunk at offset %d", off)
+	}
+	if e.flags&footerFlagTags == 0 {
+		return map[string]string{}, nil
+	}
+	tags, err := decodeChunkTags(e.tags)
+	return tags, errors.Wrapf(err, "decode tags of chunk %d", ref)
+}
@@ -0,0 +1,91 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunks
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/tsdb/chunkenc"
+)
+
+// NewTarReader returns a new Reader against the sequence files read from a
+// tar archive of a block. All regular entries of the form chunks/NNNNNN,
+// optionally nested in a block directory, are read fully into memory and
+// ordered by their sequence number. All other entries are skipped.
+func NewTarReader(tr *tar.Reader, pool chunkenc.Pool) (*Reader, error) {
+	type segment struct {
+		seq  uint64
+		name string
+		b    []byte
+	}
+	var (
+		segs []segment
+		seen = map[uint64]string{}
+	)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "read tar header")
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
+		}
+		name := path.Clean(hdr.Name)
+		if path.Base(path.Dir(name)) != "chunks" {
+			continue
+		}
+		seq, err := strconv.ParseUint(path.Base(name), 10, 64)
+		if err != nil {
+			continue
+		}
+		if prev, ok := seen[seq]; ok {
+			return nil, errors.Errorf("duplicate sequence file %s and %s", prev, hdr.Name)
+		}
+		seen[seq] = hdr.Name
+
+		b, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "read %s", hdr.Name)
+		}
+		segs = append(segs, segment{seq: seq, name: name, b: b})
+	}
+	sort.Slice(segs, func(i, j int) bool { return segs[i].seq < segs[j].seq })
+
+	if pool == nil {
+		pool = chunkenc.NewPool()
+	}
+	var (
+		bs    []ByteSlice
+		files []string
+	)
+	for _, s := range segs {
+		bs = append(bs, realByteSlice(s.b))
+		files = append(files, s.name)
+	}
+	r, err := newReader(bs, nil, nil, pool, DefaultReaderOptions)
+	if err != nil {
+		return nil, err
+	}
+	r.files, r.ownsBuffers = files, true
+	return r, nil
+}
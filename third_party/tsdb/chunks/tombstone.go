@@ -0,0 +1,96 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunks
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/tsdb/fileutil"
+)
+
+// ErrTombstoned is returned by the Reader for chunks that were marked as
+// deleted with Tombstone. Use errors.Cause to match it.
+var ErrTombstoned = errors.New("chunk is tombstoned")
+
+// Tombstone marks the chunk ref in the chunks directory dir as deleted by
+// setting a flag in its footer entry. The chunk data stays in place until the
+// segment is rewritten, e.g. by CopyChunks, which drops tombstoned chunks.
+// Readers opened afterwards return ErrTombstoned for the chunk and skip it
+// when iterating by time range. Tombstoning a chunk twice is a no-op. The
+// segment file is synced before returning.
+//
+// Only chunks of finalized V2 segments, i.e. segments with a footer, can be
+// tombstoned.
+func Tombstone(dir string, ref uint64) error {
+	return TombstoneWithNaming(dir, ref, nil)
+}
+
+// TombstoneWithNaming is like Tombstone but matches the segments by naming,
+// or NumericNaming if it is nil.
+func TombstoneWithNaming(dir string, ref uint64, naming NamingStrategy) error {
+	r, err := NewDirReaderWithOptions(dir, nil, &ReaderOptions{Naming: naming})
+	if err != nil {
+		return err
+	}
+	files := r.files
+	seq, off := unpackRef(ref)
+	if seq >= len(r.bs) {
+		r.Close()
+		return errors.Errorf("reference sequence %d out of range", seq)
+	}
+	m := r.segs[seq]
+
+	// Encode the footer before unmapping the segment as entries alias it.
+	fb := footerBuilder{hasDict: m.flags&SegmentFlagDictCompressed != 0, dict: m.dict}
+	found, done := false, false
+	for _, e := range m.footer {
+		if e.off == off {
+			done = e.flags&footerFlagTombstone != 0
+			e.flags |= footerFlagTombstone
+			found = true
+		}
+		fb.add(e)
+	}
+	footer := fb.encode()
+
+	// Unmap the segment before modifying it.
+	if err := r.Close(); err != nil {
+		return err
+	}
+	switch {
+	case m.version != chunksFormatV2 || !m.hasFooter:
+		return errors.Errorf("segment %d has no footer", seq)
+	case !found:
+		return errors.Errorf("no chunk at offset %d", off)
+	case done:
+		return nil
+	}
+
+	// The flag does not change the size of the entry, so the re-encoded
+	// footer replaces the existing one exactly.
+	f, err := os.OpenFile(files[seq], os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteAt(footer, int64(m.dataEnd)); err != nil {
+		f.Close()
+		return err
+	}
+	if err := fileutil.Fsync(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
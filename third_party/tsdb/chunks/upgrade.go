@@ -0,0 +1,121 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunks
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/tsdb/chunkenc"
+	"github.com/prometheus/tsdb/fileutil"
+)
+
+// UpgradeV1ToV2 upgrades all V1 segments of the chunks directory dir to the
+// V2 format in place. The header version is bumped and a footer indexing all
+// chunks of the segment is appended. Chunk offsets do not change, so all
+// references remain valid. V2 segments are left untouched.
+//
+// Time ranges are determined by decoding the chunks. Chunks that cannot be
+// decoded or hold no samples are recorded as covering all time.
+//
+// Every segment is replaced atomically, but the upgrade of the directory as a
+// whole is not. If it fails, segments of both versions may remain and the
+// upgrade has to be run again.
+func UpgradeV1ToV2(dir string, pool chunkenc.Pool) error {
+	return UpgradeV1ToV2WithNaming(dir, pool, nil)
+}
+
+// UpgradeV1ToV2WithNaming is like UpgradeV1ToV2 but matches the segments by
+// naming, or NumericNaming if it is nil.
+func UpgradeV1ToV2WithNaming(dir string, pool chunkenc.Pool, naming NamingStrategy) error {
+	files, err := sequenceFilesNamed(dir, naming)
+	if err != nil {
+		return err
+	}
+	if pool == nil {
+		pool = chunkenc.NewPool()
+	}
+	for i, fn := range files {
+		if err := upgradeSegment(fn, pool); err != nil {
+			return errors.Wrapf(err, "upgrade segment %d", i)
+		}
+	}
+	return nil
+}
+
+// upgradeSegment upgrades the segment file fn to V2 unless it is a V2
+// segment already.
+func upgradeSegment(fn string, pool chunkenc.Pool) error {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return err
+	}
+	r, err := NewReader([]ByteSlice{realByteSlice(b)}, pool)
+	if err != nil {
+		return err
+	}
+	if r.segs[0].version == chunksFormatV2 {
+		return nil
+	}
+	if len(b) < SegmentHeaderSize {
+		return errors.Wrap(errInvalidSize, "segment header")
+	}
+
+	var fb footerBuilder
+	err = r.scanSegment(0, func(f chunkFrame) error {
+		_, off := unpackRef(f.ref)
+		e := footerEntry{
+			off:    off,
+			length: len(f.data),
+			enc:    f.enc,
+			mint:   math.MinInt64,
+			maxt:   math.MaxInt64,
+		}
+		if mint, maxt, ok, err := r.frameTimeRange(0, f); err == nil && ok {
+			e.mint, e.maxt = mint, maxt
+		}
+		fb.add(e)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	b[MagicChunksSize] = chunksFormatV2
+
+	tmp := fn + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write(fb.encode()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := fileutil.Fsync(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return fileutil.Rename(tmp, fn)
+}
@@ -0,0 +1,632 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunks
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// verifyFrame checks the stored checksum of f against its encoding and data.
+// buf is used as scratch space and must hold at least crc32Size bytes. Block
+// checksums are only consulted to locate a corruption once the checksum does
+// not match.
+func verifyFrame(h hash.Hash32, buf []byte, f chunkFrame) error {
+	h.Reset()
+	if err := writeHash(h, buf, f.enc, f.data); err != nil {
+		return err
+	}
+	if exp := h.Sum(buf[:0]); !bytes.Equal(exp, f.crc) {
+		return locateCorruption(f, errors.Wrapf(errInvalidChecksum, "read: %x, expected: %x", f.crc, exp))
+	}
+	return nil
+}
+
+// VerifyFrom verifies the checksums of all chunks from the given position to
+// the end of its segment. An offset of 0 starts at the first chunk. Chunks
+// written with BindTimeRanges are decoded to additionally verify that their
+// samples lie within the time range declared when writing them.
+//
+// It returns the position at which verification stopped, which is always a
+// chunk boundary: the start of the next segment once the segment was verified
+// successfully, or the offending chunk if an error is returned. Verification
+// of a whole Reader is complete once nextSegment equals the number of
+// segments. This allows a scheduler to checkpoint progress and resume later.
+func (s *Reader) VerifyFrom(segment int, offset int64) (nextSegment int, nextOffset int64, err error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	if s.closed {
+		return segment, offset, errReaderClosed
+	}
+	if segment < 0 || segment > len(s.bs) {
+		return segment, offset, errors.Errorf("segment %d out of range", segment)
+	}
+	if segment == len(s.bs) {
+		return segment, 0, nil
+	}
+	if err := s.segs[segment].err; err != nil {
+		return segment, offset, err
+	}
+	if offset < SegmentHeaderSize {
+		offset = SegmentHeaderSize
+	}
+	var (
+		h      = newCRC32()
+		buf    = make([]byte, crc32Size)
+		footer = s.segs[segment].footer
+		// Set if fn failed rather than the parsing of a frame.
+		fnErr bool
+	)
+	err = s.scanSegmentFrom(segment, int(offset), func(f chunkFrame) error {
+		_, off := unpackRef(f.ref)
+		if err := verifyFrame(h, buf, f); err != nil {
+			fnErr = true
+			return &CorruptionErr{Segment: segment, Offset: int64(off), Err: s.diagnoseMisalignment(segment, off, f.next, err)}
+		}
+		for len(footer) > 0 && footer[0].off < off {
+			footer = footer[1:]
+		}
+		if len(footer) > 0 && footer[0].off == off && footer[0].flags&footerFlagTimeRangeSum != 0 {
+			if err := s.verifyTimeRange(segment, f, footer[0]); err != nil {
+				fnErr = true
+				return &CorruptionErr{Segment: segment, Offset: int64(off), Err: err}
+			}
+		}
+		return nil
+	})
+	if cerr, ok := err.(*CorruptionErr); ok {
+		if !fnErr {
+			cerr.Err = s.diagnoseMisalignment(segment, int(cerr.Offset), -1, cerr.Err)
+		}
+		return segment, cerr.Offset, err
+	}
+	if err != nil {
+		return segment, offset, err
+	}
+	return segment + 1, 0, nil
+}
+
+// MisalignmentErr describes a corruption after which the following chunks
+// cannot be read as they are no longer found at the offsets the preceding
+// frames point to, e.g. because a length field is off by a few bytes. It is
+// returned as the Err of the CorruptionErr returned by VerifyFrom.
+type MisalignmentErr struct {
+	// Offset of the first frame that could not be read.
+	Offset int64
+	// Unreadable is the number of chunks following the one at Offset that
+	// cannot be reached by scanning the segment. For segments without a
+	// footer only the chunks from ResyncOffset on are counted, and it is -1
+	// if resynchronization failed.
+	Unreadable int
+	// Resynced is set if valid chunks were found again after Offset.
+	// ResyncOffset is the offset of the first of them.
+	Resynced     bool
+	ResyncOffset int64
+	// Err is the error reading the frame at Offset.
+	Err error
+}
+
+func (e *MisalignmentErr) Error() string {
+	msg := fmt.Sprintf("misalignment detected at offset %d", e.Offset)
+	if e.Unreadable >= 0 {
+		msg += fmt.Sprintf("; %d subsequent chunks unreadable", e.Unreadable)
+	}
+	if e.Resynced {
+		msg += fmt.Sprintf("; resynchronized at offset %d", e.ResyncOffset)
+	} else {
+		msg += "; resynchronization failed"
+	}
+	return fmt.Sprintf("%s: %s", msg, e.Err)
+}
+
+const (
+	// resyncWindow is the number of bytes after an unreadable frame that
+	// are searched for the start of a valid frame.
+	resyncWindow = 64 * 1024
+	// resyncFrames is the number of consecutive valid frames that have to
+	// follow an offset for it to be accepted as the start of a frame, unless
+	// the chunk data ends before.
+	resyncFrames = 3
+)
+
+// diagnoseMisalignment checks whether the frame at offset off of segment seq
+// that failed with err is followed by unreadable frames. next is the offset
+// the frame points to, or -1 if it could not be parsed. If the frame at next
+// is valid or the chunk data ends there, only the frame at off is corrupted
+// and err is returned unchanged. Otherwise the following resyncWindow bytes
+// are searched for valid frames and a MisalignmentErr is returned.
+func (s *Reader) diagnoseMisalignment(seq, off, next int, err error) error {
+	m := &s.segs[seq]
+	if next >= 0 {
+		if n, end := s.validFrames(seq, next, 1); n > 0 || end {
+			return err
+		}
+	}
+	merr := &MisalignmentErr{Offset: int64(off), Unreadable: -1, Err: err}
+
+	end := off + resyncWindow
+	if end > m.dataEnd {
+		end = m.dataEnd
+	}
+	for o := off + 1; o < end; o++ {
+		if n, end := s.validFrames(seq, o, resyncFrames); n == resyncFrames || n > 0 && end {
+			merr.Resynced, merr.ResyncOffset = true, int64(o)
+			merr.Unreadable, _ = s.validFrames(seq, o, 0)
+			break
+		}
+	}
+	// The footer tells exactly how many chunks follow.
+	if m.hasFooter {
+		merr.Unreadable = 0
+		for _, e := range m.footer {
+			if e.off > off {
+				merr.Unreadable++
+			}
+		}
+	}
+	return merr
+}
+
+// validFrames returns the number of consecutive frames starting at offset
+// off of segment seq that can be parsed and match their checksums, up to a
+// maximum of max frames unless max is 0. end is set if the frames are
+// followed by the end of the chunk data, i.e. only zero bytes follow.
+func (s *Reader) validFrames(seq, off, max int) (n int, end bool) {
+	var (
+		h   = newCRC32()
+		buf = make([]byte, crc32Size)
+	)
+	for ; max == 0 || n < max; n++ {
+		f, ok, err := s.readFrame(seq, off)
+		if err != nil {
+			return n, false
+		}
+		if !ok {
+			// Frames end at the end of the chunk data or at the zero
+			// padding of pre-allocation, but zero bytes inside chunk data
+			// may be misread as an end too.
+			data := subByteSlice{b: s.bs[seq], end: s.segs[seq].dataEnd}
+			return n, off >= data.end || trimTrailingZeros(data, off) == off
+		}
+		if verifyFrame(h, buf, f) != nil {
+			return n, false
+		}
+		off = f.next
+	}
+	return n, false
+}
+
+// VerifyReport summarizes the verification of all segments by VerifyAll.
+type VerifyReport struct {
+	Segments      int
+	GoodChunks    int
+	CorruptChunks int
+	// Corruptions holds all corruptions found, ordered by segment and
+	// offset. Segments that are unavailable or whose frames cannot be
+	// parsed beyond some offset are reported once with that offset.
+	Corruptions []*CorruptionErr
+}
+
+// segmentReport is the result of verifying a single segment.
+type segmentReport struct {
+	good, corrupt int
+	corruptions   []*CorruptionErr
+}
+
+// VerifyAll verifies the checksums of all chunks of all segments using the
+// given number of workers, which defaults to GOMAXPROCS if it is not
+// positive. Every worker verifies whole segments. Unlike VerifyFrom it does
+// not stop at the first corrupted chunk but continues with the next one as
+// long as the frames can still be parsed. The report does not depend on the
+// number of workers, but the Progress callback of the ReaderOptions may be
+// called concurrently.
+func (s *Reader) VerifyAll(workers int) (VerifyReport, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	if s.closed {
+		return VerifyReport{}, errReaderClosed
+	}
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	var (
+		reports = make([]segmentReport, len(s.bs))
+		errs    = make([]error, len(s.bs))
+		segs    = make(chan int)
+		wg      sync.WaitGroup
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for seq := range segs {
+				reports[seq], errs[seq] = s.verifySegment(seq)
+			}
+		}()
+	}
+	for seq := range s.bs {
+		segs <- seq
+	}
+	close(segs)
+	wg.Wait()
+
+	rep := VerifyReport{Segments: len(s.bs)}
+	for seq, r := range reports {
+		if errs[seq] != nil {
+			return VerifyReport{}, errors.Wrapf(errs[seq], "verify segment %d", seq)
+		}
+		rep.GoodChunks += r.good
+		rep.CorruptChunks += r.corrupt
+		rep.Corruptions = append(rep.Corruptions, r.corruptions...)
+	}
+	return rep, nil
+}
+
+// verifySegment verifies the checksums of all chunks of segment seq.
+func (s *Reader) verifySegment(seq int) (segmentReport, error) {
+	var r segmentReport
+
+	if err := s.segs[seq].err; err != nil {
+		r.corruptions = append(r.corruptions, &CorruptionErr{Segment: seq, Err: err})
+		return r, nil
+	}
+	var (
+		h   = newCRC32()
+		buf = make([]byte, crc32Size)
+	)
+	err := s.scanSegment(seq, func(f chunkFrame) error {
+		if err := verifyFrame(h, buf, f); err != nil {
+			_, off := unpackRef(f.ref)
+			r.corrupt++
+			r.corruptions = append(r.corruptions, &CorruptionErr{Segment: seq, Offset: int64(off), Err: err})
+			return nil
+		}
+		r.good++
+		return nil
+	})
+	if cerr, ok := err.(*CorruptionErr); ok {
+		r.corruptions = append(r.corruptions, cerr)
+		return r, nil
+	}
+	return r, err
+}
+
+// FindCorrupt verifies the checksums of all chunks of all segments like
+// VerifyAll and returns a CorruptionErr for every corrupted chunk in segment
+// and offset order. Tombstoned chunks are skipped. Unlike VerifyAll it also
+// continues after frames that cannot be parsed or after which the following
+// frames are misaligned, whose Err is then a MisalignmentErr. Scanning
+// resumes at the next chunk recorded in the footer or, for segments without
+// a footer, at the offset the MisalignmentErr was resynchronized at. The
+// rest of a segment is skipped if resynchronization failed. Segments that
+// are unavailable are reported with an offset of 0.
+func (s *Reader) FindCorrupt() ([]*CorruptionErr, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	if s.closed {
+		return nil, errReaderClosed
+	}
+	var res []*CorruptionErr
+
+	for seq := range s.bs {
+		if err := s.segs[seq].err; err != nil {
+			res = append(res, &CorruptionErr{Segment: seq, Err: err})
+			continue
+		}
+		off := SegmentHeaderSize
+		for off > 0 {
+			var err error
+			if res, off, err = s.findCorruptFrom(seq, off, res); err != nil {
+				return nil, errors.Wrapf(err, "scan segment %d", seq)
+			}
+		}
+	}
+	return res, nil
+}
+
+// findCorruptFrom verifies the chunks of segment seq from offset off on and
+// appends a CorruptionErr for every corrupted chunk to res. It stops at the
+// first corruption after which the following frames cannot be read and
+// returns the offset to resume at, or 0 if the segment is done.
+func (s *Reader) findCorruptFrom(seq, off int, res []*CorruptionErr) ([]*CorruptionErr, int, error) {
+	var (
+		h    = newCRC32()
+		buf  = make([]byte, crc32Size)
+		stop = errors.New("misaligned")
+		merr *MisalignmentErr
+		at   int
+	)
+	err := s.scanSegmentFrom(seq, off, func(f chunkFrame) error {
+		_, off := unpackRef(f.ref)
+		if s.segs[seq].tombstoned(off) {
+			return nil
+		}
+		err := verifyFrame(h, buf, f)
+		if err == nil {
+			return nil
+		}
+		err = s.diagnoseMisalignment(seq, off, f.next, err)
+		res = append(res, &CorruptionErr{Segment: seq, Offset: int64(off), Err: err})
+
+		if e, ok := err.(*MisalignmentErr); ok {
+			merr, at = e, off
+			return stop
+		}
+		return nil
+	})
+	if cerr, ok := err.(*CorruptionErr); ok {
+		err := s.diagnoseMisalignment(seq, int(cerr.Offset), -1, cerr.Err)
+		merr, _ = err.(*MisalignmentErr)
+		at = int(cerr.Offset)
+		res = append(res, &CorruptionErr{Segment: seq, Offset: cerr.Offset, Err: err})
+	} else if err != nil && err != stop {
+		return nil, 0, err
+	}
+	if merr == nil {
+		return res, 0, nil
+	}
+	if m := &s.segs[seq]; m.hasFooter {
+		for _, e := range m.footer {
+			if e.off > at {
+				return res, e.off, nil
+			}
+		}
+		return res, 0, nil
+	}
+	if merr.Resynced {
+		return res, int(merr.ResyncOffset), nil
+	}
+	return res, 0, nil
+}
+
+// verifyTimeRange checks that the time range recorded in footer entry e is
+// bound to the checksum of frame f and covers the samples of its chunk.
+func (s *Reader) verifyTimeRange(seq int, f chunkFrame, e footerEntry) error {
+	if exp := timeRangeSum(f.crc, e.mint, e.maxt); exp != e.sum {
+		return errors.Wrapf(errInvalidChecksum, "time range checksum read: %x, expected: %x", e.sum, exp)
+	}
+	mint, maxt, ok, err := s.frameTimeRange(seq, f)
+	if err != nil {
+		return err
+	}
+	if ok && (mint < e.mint || maxt > e.maxt) {
+		return errors.Errorf("samples in [%d, %d] outside of declared time range [%d, %d]", mint, maxt, e.mint, e.maxt)
+	}
+	return nil
+}
+
+// Validate performs a cheap structural check of all segments without reading
+// any chunk data. It verifies that every segment starts with a valid header
+// of a known and consistent format version, that the files backing the
+// segments are numbered contiguously unless they are named by time range,
+// that files on disk still have the size of the mapped segments, e.g. were
+// not truncated since the Reader was opened, and that the sizes of all
+// segments add up to Size. It returns an error describing the first problem
+// found.
+func (s *Reader) Validate() error {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	if s.closed {
+		return errReaderClosed
+	}
+	var (
+		version byte
+		size    int64
+	)
+	for i, b := range s.bs {
+		size += int64(b.Len())
+
+		if err := s.segs[i].err; err != nil {
+			return err
+		}
+		if b.Len() < SegmentHeaderSize {
+			return errors.Wrapf(errInvalidSize, "header of segment %d", i)
+		}
+		h := b.Range(0, SegmentHeaderSize)
+
+		if m := binary.BigEndian.Uint32(h[:MagicChunksSize]); m != MagicChunks {
+			return errors.Errorf("segment %d: invalid magic number %x", i, m)
+		}
+		v := h[MagicChunksSize]
+		if v != chunksFormatV1 && v != chunksFormatV2 {
+			return errors.Errorf("segment %d: unknown format version %d", i, v)
+		}
+		if i > 0 && v != version {
+			return errors.Errorf("segment %d: format version %d differs from version %d of previous segments", i, v, version)
+		}
+		version = v
+
+		if v == chunksFormatV1 {
+			for _, p := range h[MagicChunksSize+ChunksFormatVersionSize:] {
+				if p != 0 {
+					return errors.Errorf("segment %d: non-zero header padding", i)
+				}
+			}
+		} else if f := s.segs[i].flags; f&^knownSegmentFlags != 0 {
+			return errors.Errorf("segment %d: unknown header flags %x", i, f)
+		}
+		// Files of Readers owning their buffers, e.g. read from a tar
+		// archive, are not on disk.
+		if !s.ownsBuffers && len(s.files) == len(s.bs) {
+			fi, err := os.Stat(s.files[i])
+			if err != nil {
+				return errors.Wrapf(err, "segment %d", i)
+			}
+			if fi.Size() != int64(b.Len()) {
+				return errors.Wrapf(errInvalidSize, "segment %d: file %s has %d bytes but %d are mapped", i, s.files[i], fi.Size(), b.Len())
+			}
+		}
+	}
+	if size != s.size {
+		return errors.Wrapf(errInvalidSize, "segments hold %d bytes but the size is %d", size, s.size)
+	}
+
+	// Segments named by time range are ordered by the segment names sidecar.
+	// Files of different directories are numbered independently.
+	named := map[string]bool{}
+
+	for i, fn := range s.files {
+		dir := filepath.Dir(fn)
+		if _, ok := named[dir]; !ok {
+			names, _ := readSegmentNames(dir)
+			named[dir] = len(names) > 0
+		}
+		if named[dir] {
+			continue
+		}
+		seq, ok := s.opts.Naming.Match(filepath.Base(fn))
+		if !ok {
+			return errors.Errorf("segment %d: %s is not a sequence file", i, fn)
+		}
+		if i > 0 && filepath.Dir(s.files[i-1]) == dir {
+			prev, _ := s.opts.Naming.Match(filepath.Base(s.files[i-1]))
+			if seq != prev+1 {
+				return errors.Errorf("segment %d: sequence file %s does not follow %s", i, fn, s.files[i-1])
+			}
+		}
+	}
+	return nil
+}
+
+// RefsDigest returns a checksum over the stored checksums of the chunks
+// referenced by refs, in order. Chunk data is neither read nor decoded, so
+// the digest is a cheap way to compare sets of chunks of different blocks.
+// References are resolved like by Chunk: overridden references of an
+// overlay use the patched chunk and tombstoned chunks are an error.
+func (s *Reader) RefsDigest(refs []uint64) (uint32, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	if s.closed {
+		return 0, errReaderClosed
+	}
+	h := newCRC32()
+
+	for _, ref := range refs {
+		fref := ref
+		if o, ok := s.override[ref]; ok {
+			fref = o
+		}
+		_, f, err := s.lookupFrame(fref)
+		if err != nil {
+			return 0, errors.Wrapf(err, "read chunk %d", ref)
+		}
+		if _, err := h.Write(f.crc); err != nil {
+			return 0, err
+		}
+	}
+	return h.Sum32(), nil
+}
+
+// RefsAlias reports whether the refs a and b point at the same chunk frame
+// and, separately, whether their chunks have the same encoding and stored
+// data, without decoding them. It can be used to check the result of
+// deduplication. Encrypted chunks only have the same bytes if they were
+// copied, as every chunk is encrypted with a random nonce.
+func (s *Reader) RefsAlias(a, b uint64) (sameOffset bool, sameBytes bool, err error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	if s.closed {
+		return false, false, errReaderClosed
+	}
+	_, fa, err := s.lookupFrame(a)
+	if err != nil {
+		return false, false, errors.Wrapf(err, "chunk %d", a)
+	}
+	_, fb, err := s.lookupFrame(b)
+	if err != nil {
+		return false, false, errors.Wrapf(err, "chunk %d", b)
+	}
+	return a == b, fa.enc == fb.enc && bytes.Equal(fa.data, fb.data), nil
+}
+
+// errStopScan stops a segment scan early without signalling an error.
+var errStopScan = errors.New("stop scan")
+
+// VerifyRefs checks that every ref points at the start of a chunk whose
+// checksum matches and returns the refs that do not, in the order they were
+// given. Refs are sorted, so that each segment is only scanned once up to
+// the largest ref into it.
+func (s *Reader) VerifyRefs(refs []uint64) ([]uint64, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	if s.closed {
+		return nil, errReaderClosed
+	}
+	sorted := make([]uint64, len(refs))
+	copy(sorted, refs)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	var (
+		valid = make(map[uint64]struct{}, len(refs))
+		h     = newCRC32()
+		buf   = make([]byte, crc32Size)
+	)
+	for i := 0; i < len(sorted); {
+		seq, _ := unpackRef(sorted[i])
+		// Collect all refs into the same segment.
+		j := i
+		for j < len(sorted) && int(sorted[j]>>32) == seq {
+			j++
+		}
+		group := sorted[i:j]
+		i = j
+
+		if seq >= len(s.bs) || s.segs[seq].err != nil {
+			continue
+		}
+		err := s.scanSegment(seq, func(f chunkFrame) error {
+			for len(group) > 0 && group[0] < f.ref {
+				group = group[1:]
+			}
+			if len(group) == 0 {
+				return errStopScan
+			}
+			if group[0] == f.ref && verifyFrame(h, buf, f) == nil {
+				valid[f.ref] = struct{}{}
+			}
+			return nil
+		})
+		if _, ok := err.(*CorruptionErr); ok {
+			// Refs at or after the corruption cannot be resolved.
+			continue
+		}
+		if err != nil && err != errStopScan {
+			return nil, err
+		}
+	}
+
+	var failed []uint64
+	for _, ref := range refs {
+		if _, ok := valid[ref]; !ok {
+			failed = append(failed, ref)
+		}
+	}
+	return failed, nil
+}